@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+)
+
+// APIError is the body of every /api/v2 error response, wrapped as
+// {"error": {...}}.
+type APIError struct {
+	Status    int    `json:"-"`
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id"`
+}
+
+type contextKey string
+
+const requestIDKey contextKey = "requestID"
+
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+func requestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey).(string)
+	return id
+}
+
+// RequestIDHandler tags every request with an ID, reusing the client's
+// X-Request-ID when it sends a sane one, and echoes it in the response.
+func RequestIDHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		id := req.Header.Get("X-Request-ID")
+		if !validRequestID.MatchString(id) {
+			id = newRequestID()
+		}
+		w.Header().Set("X-Request-ID", id)
+		h.ServeHTTP(w, req.WithContext(context.WithValue(req.Context(), requestIDKey, id)))
+	})
+}
+
+func writeAPIError(w http.ResponseWriter, req *http.Request, apiErr *APIError) {
+	apiErr.RequestID = requestID(req)
+	var jsonResp struct {
+		Error *APIError `json:"error"`
+	}
+	jsonResp.Error = apiErr
+	message, _ := json.Marshal(jsonResp)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(apiErr.Status)
+	w.Write(message)
+}
+
+var authErrorCodes = map[error]string{
+	errMalformedSignature: "malformed_signature",
+	errInvalidSignature:   "invalid_signature",
+	errInvalidTimestamp:   "invalid_timestamp",
+	errExpiredTimestamp:   "expired_timestamp",
+}
+
+func APIAuthenticatedHandler(f http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := traced(req.Context(), "authenticate", func() error { return authenticate(req) }); err != nil {
+			recordAuthFailure(req, err)
+			countAuthFailure(req, err)
+			writeAPIError(w, req, &APIError{Status: http.StatusForbidden, Code: authErrorCodes[err], Message: err.Error()})
+			return
+		}
+
+		f(w, req)
+	})
+}
+
+func RequireMethod(method string, f http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != method {
+			w.Header().Set("Allow", method)
+			writeAPIError(w, req, &APIError{Status: http.StatusMethodNotAllowed, Code: "method_not_allowed", Message: fmt.Sprintf("%s requires %s", req.URL.Path, method)})
+			return
+		}
+
+		f(w, req)
+	})
+}
+
+func APINotFoundHandler(w http.ResponseWriter, req *http.Request) {
+	writeAPIError(w, req, &APIError{Status: http.StatusNotFound, Code: "not_found", Message: fmt.Sprintf("No route for %s", req.URL.Path)})
+}
+
+func APIStatusHandler(doorStatus func(context.Context, int) (string, error), logger *Logger, statusPin int, watcher *DoorWatcher) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := requestLogger(logger, req)
+		status, version, apiErr := readDoorStatus(req, doorStatus, statusPin, watcher)
+		if apiErr != nil {
+			logAPIError(log, apiErr)
+			writeAPIError(w, req, apiErr)
+			return
+		}
+
+		var jsonResp struct {
+			Text    string  `json:"doorStatus"`
+			Version *uint64 `json:"version,omitempty"`
+		}
+		jsonResp.Text = status
+		jsonResp.Version = version
+		message, err := json.Marshal(jsonResp)
+		if err != nil {
+			log.Error("Could not encode response", Field{"error", err})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(message)
+	})
+}
+
+var commandErrorStatus = map[string]int{
+	"sensor_unavailable": 422,
+	"relay_failed":       500,
+}
+
+// APICommandHandler runs toggle, open or close. open and close only pulse the
+// relay when the door isn't already in the requested state.
+func APICommandHandler(command string, control *DoorControl, doorStatus func(context.Context, int) (string, error), toggleSwitch func(context.Context, int, int) error, logger *Logger, pinNumber int, statusPin int, sleepTimeout int) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := requestLogger(logger, req)
+		result := runControlCommand(req.Context(), control, recordCommand(req), controlCommand{Command: command}, doorStatus, toggleSwitch, log, pinNumber, statusPin, sleepTimeout)
+		if !result.OK {
+			writeAPIError(w, req, &APIError{Status: commandErrorStatus[result.Code], Code: result.Code, Message: result.Error})
+			return
+		}
+
+		var jsonResp struct {
+			Status     string `json:"status"`
+			DoorStatus string `json:"doorStatus,omitempty"`
+		}
+		jsonResp.Status = result.Status
+		jsonResp.DoorStatus = result.DoorStatus
+		message, err := json.Marshal(jsonResp)
+		if err != nil {
+			log.Error("Could not encode response", Field{"error", err})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(message)
+	})
+}
+
+func APILogsHandler(logger *Logger, store *EventStore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := requestLogger(logger, req)
+		log.Info("Logs")
+		logs, apiErr := queryLogs(store, req)
+		if apiErr != nil {
+			logAPIError(log, apiErr)
+			writeAPIError(w, req, apiErr)
+			return
+		}
+		entries, err := json.Marshal(logs)
+		if err != nil {
+			log.Error("Could not encode response", Field{"error", err})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(entries)
+	})
+}
+
+func APIStatsHandler(logger *Logger, store *EventStore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := requestLogger(logger, req)
+		log.Info("Stats")
+		stats, apiErr := queryStats(store, req)
+		if apiErr != nil {
+			logAPIError(log, apiErr)
+			writeAPIError(w, req, apiErr)
+			return
+		}
+		body, err := json.Marshal(stats)
+		if err != nil {
+			log.Error("Could not encode response", Field{"error", err})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+var testAuditKey = []byte("test audit key, not for servers!")
+
+const testMetricsToken = "test metrics token"
+
+func CreateTestStore(t *testing.T) *EventStore {
+	store, err := OpenEventStore(filepath.Join(t.TempDir(), "events.jsonl"), testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// CorruptTestStore overwrites the start of the store's first line, so reads
+// fail at line 1.
+func CorruptTestStore(t *testing.T, store *EventStore) {
+	file, err := os.OpenFile(store.path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.WriteAt([]byte("x"), 0); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func CreateTestRouter(t *testing.T, legacy bool, state string, badRelay bool) http.Handler {
+	return NewRouter(CreateTestRouteConfig(t, legacy, state, badRelay))
+}
+
+func CreateTestRouteConfig(t *testing.T, legacy bool, state string, badRelay bool) RouteConfig {
+	hub := NewEventHub(10)
+	store := CreateTestStore(t)
+	store.Append(HistoryEvent{Type: EventCommandIssued, User: "dillon", Door: "garage", Outcome: OutcomeSuccess, Detail: "toggle"})
+	return RouteConfig{
+		Hub:            hub,
+		Watcher:        NewDoorWatcher(CreateDummyStatus(state), DummyLogger, 0, hub),
+		DoorStatus:     CreateDummyStatus(state),
+		ToggleSwitch:   CreateDummyRelay(badRelay),
+		CheckGPIO:      CreateDummyGPIOCheck(badRelay),
+		Logger:         DummyLogger,
+		Store:          store,
+		Door:           "garage",
+		Control:        NewDoorControl(),
+		SleepTimeout:   1,
+		Heartbeat:      time.Minute,
+		SessionTimeout: time.Minute,
+		Legacy:         legacy,
+		MetricsAccess:  MetricsAccess{Token: testMetricsToken},
+	}
+}
+
+func signedRequest(t *testing.T, method string, url string, secret string) *http.Request {
+	validTimestamp := CreateTimestamp(0)
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("signature", CreateSignature([]byte(validTimestamp), secret))
+	req.Header.Add("timestamp", validTimestamp)
+	return req
+}
+
+func decodeAPIError(t *testing.T, writer *httptest.ResponseRecorder) APIError {
+	var resp struct {
+		Error APIError `json:"error"`
+	}
+	decoder := json.NewDecoder(writer.Body)
+	if err := decoder.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	stringEqual(t, resp.Error.RequestID, writer.Header().Get("X-Request-ID"))
+	return resp.Error
+}
+
+func TestCommandsRequirePost(t *testing.T) {
+	writer := httptest.NewRecorder()
+	CreateTestRouter(t, false, "closed", false).ServeHTTP(writer, signedRequest(t, "GET", "/api/v2/toggle", SharedSecret))
+
+	responseEqual(t, writer.Code, 405)
+	stringEqual(t, writer.Header().Get("Allow"), "POST")
+	apiErr := decodeAPIError(t, writer)
+	stringEqual(t, apiErr.Code, "method_not_allowed")
+}
+
+func TestToggleOnAPI(t *testing.T) {
+	writer := httptest.NewRecorder()
+	CreateTestRouter(t, false, "closed", false).ServeHTTP(writer, signedRequest(t, "POST", "/api/v2/toggle", SharedSecret))
+
+	responseEqual(t, writer.Code, 200)
+	stringEqual(t, writer.Body.String(), `{"status":"signal received"}`)
+}
+
+func TestOpenWhenAlreadyOpenOnAPI(t *testing.T) {
+	writer := httptest.NewRecorder()
+	CreateTestRouter(t, false, "open", true).ServeHTTP(writer, signedRequest(t, "POST", "/api/v2/open", SharedSecret))
+
+	responseEqual(t, writer.Code, 200)
+	stringEqual(t, writer.Body.String(), `{"status":"already open","doorStatus":"open"}`)
+}
+
+func TestFailedToggleOnAPI(t *testing.T) {
+	writer := httptest.NewRecorder()
+	CreateTestRouter(t, false, "open", true).ServeHTTP(writer, signedRequest(t, "POST", "/api/v2/close", SharedSecret))
+
+	responseEqual(t, writer.Code, 500)
+	stringEqual(t, decodeAPIError(t, writer).Code, "relay_failed")
+}
+
+func TestErrorOnAPIStatus(t *testing.T) {
+	writer := httptest.NewRecorder()
+	CreateTestRouter(t, false, "error", false).ServeHTTP(writer, signedRequest(t, "GET", "/api/v2/status", SharedSecret))
+
+	responseEqual(t, writer.Code, 422)
+	apiErr := decodeAPIError(t, writer)
+	stringEqual(t, apiErr.Code, "sensor_unavailable")
+	stringEqual(t, apiErr.Message, "Could not read pin '0' on Raspberry Pi")
+}
+
+func TestUnverifiedSignatureOnAPI(t *testing.T) {
+	writer := httptest.NewRecorder()
+	req := signedRequest(t, "GET", "/api/v2/version", "Unverified Signature")
+	req.Header.Set("X-Request-ID", "abc-123")
+	CreateTestRouter(t, false, "closed", false).ServeHTTP(writer, req)
+
+	responseEqual(t, writer.Code, 403)
+	apiErr := decodeAPIError(t, writer)
+	stringEqual(t, apiErr.Code, "invalid_signature")
+	stringEqual(t, apiErr.RequestID, "abc-123")
+}
+
+func TestExpiredTimestampOnAPI(t *testing.T) {
+	writer := httptest.NewRecorder()
+	expiredTimestamp := CreateTimestamp(20)
+	req, err := http.NewRequest("GET", "/api/v2/status", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("signature", CreateSignature([]byte(expiredTimestamp), SharedSecret))
+	req.Header.Add("timestamp", expiredTimestamp)
+	CreateTestRouter(t, false, "closed", false).ServeHTTP(writer, req)
+
+	responseEqual(t, writer.Code, 403)
+	stringEqual(t, decodeAPIError(t, writer).Code, "expired_timestamp")
+}
+
+func TestUnknownRouteOnAPI(t *testing.T) {
+	writer := httptest.NewRecorder()
+	CreateTestRouter(t, false, "closed", false).ServeHTTP(writer, signedRequest(t, "GET", "/api/v2/garage", SharedSecret))
+
+	responseEqual(t, writer.Code, 404)
+	stringEqual(t, decodeAPIError(t, writer).Code, "not_found")
+}
+
+func TestLegacyRoutesFlag(t *testing.T) {
+	writer := httptest.NewRecorder()
+	CreateTestRouter(t, true, "closed", false).ServeHTTP(writer, signedRequest(t, "GET", "/toggle", SharedSecret))
+	responseEqual(t, writer.Code, 200)
+
+	writer = httptest.NewRecorder()
+	CreateTestRouter(t, false, "closed", false).ServeHTTP(writer, signedRequest(t, "GET", "/toggle", SharedSecret))
+	responseEqual(t, writer.Code, 404)
+}
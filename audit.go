@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// auditKeySize is the length in bytes of a generated audit key.
+const auditKeySize = 32
+
+// LoadAuditKey reads the key that chains the event store from path. The key
+// belongs to the server alone: every client holds GARAGE_SECRET, so a key
+// derived from it would let any of them rewrite the store and still pass
+// its audit. With create set, a missing key is generated and created says
+// so.
+func LoadAuditKey(path string, create bool) (key []byte, created bool, err error) {
+	key, err = readAuditKey(path)
+	if !create || !os.IsNotExist(err) {
+		return key, false, err
+	}
+
+	key = make([]byte, auditKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, false, err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp")
+	if err != nil {
+		return nil, false, err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.WriteString(hex.EncodeToString(key) + "\n")
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	// Linking, unlike renaming, fails if another process got there first,
+	// and then its key is the one to use.
+	if err := os.Link(tmp.Name(), path); os.IsExist(err) {
+		key, err = readAuditKey(path)
+		return key, false, err
+	} else if err != nil {
+		return nil, false, err
+	}
+	return key, true, nil
+}
+
+func readAuditKey(path string) ([]byte, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("audit key %s can be read by other users (mode %04o)", path, info.Mode().Perm())
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(key) < auditKeySize {
+		return nil, fmt.Errorf("audit key %s is not %d hex-encoded bytes", path, auditKeySize)
+	}
+	return key, nil
+}
+
+// legacyAuditKey is the key stores were chained with before the server had
+// its own, derived from the shared secret. It is only used to check such a
+// store before signing it again with the audit key.
+func legacyAuditKey(secret string) []byte {
+	if secret == "" {
+		return nil
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("garage-server audit log"))
+	return mac.Sum(nil)
+}
+
+// chainHash links event to the one before it: it is the HMAC of the
+// previous event's hash and the event itself without its own hash.
+func chainHash(key []byte, previous string, event HistoryEvent) (string, error) {
+	event.Hash = ""
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		return "", err
+	}
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(previous))
+	mac.Write([]byte("\n"))
+	mac.Write(encoded)
+	return hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+// auditHead records the last event written, so cutting events off the end
+// of the store, which leaves a valid chain behind, is caught too.
+type auditHead struct {
+	ID   uint64 `json:"id"`
+	Hash string `json:"hash"`
+	MAC  string `json:"mac"`
+}
+
+func headMAC(key []byte, id uint64, hash string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte("head\n" + strconv.FormatUint(id, 10) + "\n" + hash))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func auditHeadPath(path string) string {
+	return path + ".head"
+}
+
+// writeAuditHead replaces the head file in one rename, so it is never seen
+// half written.
+func writeAuditHead(path string, key []byte, id uint64, hash string) error {
+	encoded, err := json.Marshal(auditHead{ID: id, Hash: hash, MAC: headMAC(key, id, hash)})
+	if err != nil {
+		return err
+	}
+	tmp := auditHeadPath(path) + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(encoded)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, auditHeadPath(path))
+}
+
+// AuditReport is the outcome of checking the event store's hash chain.
+// Events written before the store was chained are counted as unsigned and
+// can't be checked.
+type AuditReport struct {
+	Verified bool   `json:"verified"`
+	Events   int    `json:"events"`
+	Unsigned int    `json:"unsigned,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+func (r AuditReport) fail(format string, args ...interface{}) AuditReport {
+	r.Verified = false
+	r.Error = fmt.Sprintf(format, args...)
+	return r
+}
+
+// VerifyAudit checks every event in the store at path against the chain and
+// the head file, which every keyed store has. Modified, deleted, reordered
+// and truncated events are reported; the error is only for a store that
+// couldn't be read.
+func VerifyAudit(path string, key []byte) (AuditReport, error) {
+	report := AuditReport{Verified: true}
+	if key == nil {
+		return report.fail("no audit key; set GARAGE_SECRET"), nil
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return report, err
+	}
+	defer file.Close()
+
+	var lastID uint64
+	previous := ""
+	signed := false
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		var event HistoryEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return report.fail("line %d: %s", lineNumber, err), nil
+		}
+		report.Events++
+
+		if event.ID != lastID+1 {
+			if lastID == 0 {
+				return report.fail("events before %d are missing", event.ID), nil
+			}
+			return report.fail("event %d follows event %d", event.ID, lastID), nil
+		}
+		lastID = event.ID
+
+		if event.Hash == "" {
+			if signed {
+				return report.fail("event %d is not signed", event.ID), nil
+			}
+			report.Unsigned++
+			continue
+		}
+		signed = true
+
+		expected, err := chainHash(key, previous, event)
+		if err != nil {
+			return report, err
+		}
+		if !hmac.Equal([]byte(expected), []byte(event.Hash)) {
+			return report.fail("event %d does not match its hash", event.ID), nil
+		}
+		previous = event.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return report, err
+	}
+
+	encoded, err := ioutil.ReadFile(auditHeadPath(path))
+	if os.IsNotExist(err) {
+		return report.fail("%s is missing", auditHeadPath(path)), nil
+	}
+	if err != nil {
+		return report, err
+	}
+	var head auditHead
+	if err := json.Unmarshal(encoded, &head); err != nil {
+		return report.fail("%s: %s", auditHeadPath(path), err), nil
+	}
+	if !hmac.Equal([]byte(head.MAC), []byte(headMAC(key, head.ID, head.Hash))) {
+		return report.fail("%s does not match its hash", auditHeadPath(path)), nil
+	}
+	if head.ID > lastID {
+		return report.fail("events after %d are missing; the last written was %d", lastID, head.ID), nil
+	}
+	if head.ID != lastID || head.Hash != previous {
+		return report.fail("event %d was not written by the server", lastID), nil
+	}
+	return report, nil
+}
+
+// runAudit implements `garage-server audit verify [-events path] [-audit-key path]`.
+func runAudit(args []string) int {
+	auditFlags := flag.NewFlagSet("audit", flag.ExitOnError)
+	auditFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage:  %s audit verify [options]\n", os.Args[0])
+		auditFlags.PrintDefaults()
+	}
+	if len(args) == 0 || args[0] != "verify" {
+		auditFlags.Usage()
+		return 2
+	}
+	auditFlags.StringVar(&options.events, "events", defaultEventStore, "Path of the event store to verify")
+	auditFlags.StringVar(&options.auditKey, "audit-key", "", "Path of the server's audit key (default: the event store's path with .key appended)")
+	auditFlags.Parse(args[1:])
+
+	// A running server appends as it likes; its own check is in /api/v2/logs.
+	file, err := os.Open(options.events)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+	if err := lockStore(file, syscall.LOCK_SH); err != nil {
+		fmt.Fprintf(os.Stderr, "%s; stop it, or see audit in /api/v2/logs\n", err)
+		return 1
+	}
+
+	key, _, err := LoadAuditKey(auditKeyPath(options.events), false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not read audit key:", err)
+		return 1
+	}
+	report, err := VerifyAudit(options.events, key)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if !report.Verified {
+		fmt.Fprintf(os.Stderr, "Audit failed after %d events: %s\n", report.Events, report.Error)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "Verified %d events (%d written before signing)\n", report.Events, report.Unsigned)
+	return 0
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// createAuditStore writes two unsigned events followed by three signed ones
+// and returns the store's path.
+func createAuditStore(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	for _, key := range [][]byte{nil, testAuditKey} {
+		store, err := OpenEventStore(path, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			store.Append(HistoryEvent{Type: EventCommandIssued, Outcome: OutcomeSuccess, Detail: "toggle"})
+		}
+		if key != nil {
+			store.Append(HistoryEvent{Type: EventStateChanged, Outcome: OutcomeSuccess, Detail: "open"})
+		}
+		store.Close()
+	}
+	return path
+}
+
+// editAuditStore replaces the store's lines with what edit returns.
+func editAuditStore(t *testing.T, path string, edit func([]string) []string) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := edit(strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"))
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestVerifyAudit(t *testing.T) {
+	path := createAuditStore(t)
+
+	report, err := VerifyAudit(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Verified {
+		t.Fatalf("expected the chain to verify, got '%s'", report.Error)
+	}
+	numberEqual(t, report.Events, 5)
+	numberEqual(t, report.Unsigned, 2)
+
+	report, _ = VerifyAudit(path, []byte("another audit key, not for servers"))
+	if report.Verified {
+		t.Error("expected a different key to fail")
+	}
+	stringEqual(t, report.Error, "event 3 does not match its hash")
+}
+
+func TestVerifyAuditDetectsTampering(t *testing.T) {
+	tests := []struct {
+		name     string
+		edit     func([]string) []string
+		expected string
+	}{
+		{"modified", func(lines []string) []string {
+			lines[3] = strings.Replace(lines[3], "toggle", "TOGGLE", 1)
+			return lines
+		}, "event 4 does not match its hash"},
+		{"deleted", func(lines []string) []string {
+			return append(lines[:2], lines[3:]...)
+		}, "event 4 follows event 2"},
+		{"truncated", func(lines []string) []string {
+			return lines[:4]
+		}, "events after 4 are missing; the last written was 5"},
+		{"unsigned", func(lines []string) []string {
+			lines[4] = lines[4][:strings.Index(lines[4], `,"hash"`)] + "}"
+			return lines
+		}, "event 5 is not signed"},
+	}
+
+	for _, test := range tests {
+		path := createAuditStore(t)
+		editAuditStore(t, path, test.edit)
+
+		report, err := VerifyAudit(path, testAuditKey)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if report.Verified {
+			t.Errorf("%s: expected verification to fail", test.name)
+		}
+		stringEqual(t, report.Error, test.expected)
+	}
+}
+
+func TestVerifyAuditHead(t *testing.T) {
+	path := createAuditStore(t)
+	head := auditHeadPath(path)
+
+	data, _ := ioutil.ReadFile(head)
+	ioutil.WriteFile(head, []byte(strings.Replace(string(data), `"id":5`, `"id":4`, 1)), 0600)
+	report, _ := VerifyAudit(path, testAuditKey)
+	stringEqual(t, report.Error, head+" does not match its hash")
+
+	ioutil.WriteFile(head, []byte("{}"), 0600)
+	report, _ = VerifyAudit(path, testAuditKey)
+	stringEqual(t, report.Error, head+" does not match its hash")
+
+	// A head for a shorter chain means events were appended without the key.
+	editAuditStore(t, path, func(lines []string) []string { return lines[:4] })
+	writeAuditHead(path, testAuditKey, 3, "")
+	report, _ = VerifyAudit(path, testAuditKey)
+	stringEqual(t, report.Error, "event 4 was not written by the server")
+}
+
+func TestVerifyAuditDowngrade(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	store, err := OpenEventStore(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Append(HistoryEvent{Type: EventCommandIssued, User: "dillon", Outcome: OutcomeSuccess, Detail: "toggle"})
+	store.Close()
+
+	// Opening with a key marks where signing started, even before anything
+	// is signed.
+	store, err = OpenEventStore(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+	report, _ := VerifyAudit(path, testAuditKey)
+	if !report.Verified {
+		t.Fatalf("expected the unsigned store to verify, got '%s'", report.Error)
+	}
+	numberEqual(t, report.Unsigned, 1)
+
+	store, _ = OpenEventStore(path, testAuditKey)
+	store.Append(HistoryEvent{Type: EventCommandIssued, User: "dillon", Outcome: OutcomeSuccess, Detail: "toggle"})
+	store.Close()
+
+	// Stripping every hash still leaves the head.
+	editAuditStore(t, path, func(lines []string) []string {
+		for i, line := range lines {
+			if at := strings.Index(line, `,"hash"`); at >= 0 {
+				line = line[:at] + "}"
+			}
+			lines[i] = strings.Replace(line, "dillon", "mallory", 1)
+		}
+		return lines
+	})
+	report, _ = VerifyAudit(path, testAuditKey)
+	stringEqual(t, report.Error, "event 2 was not written by the server")
+
+	// And deleting it too fails rather than passing as a never-signed store.
+	os.Remove(auditHeadPath(path))
+	report, _ = VerifyAudit(path, testAuditKey)
+	if report.Verified {
+		t.Error("expected a store without its head to fail")
+	}
+	stringEqual(t, report.Error, auditHeadPath(path)+" is missing")
+}
+
+func TestLogsReportAudit(t *testing.T) {
+	store := CreateTestStore(t)
+	store.Append(HistoryEvent{Type: EventCommandIssued, User: "dillon", Outcome: OutcomeSuccess, Detail: "toggle"})
+
+	_, logs := getLogs(t, store, "")
+	if logs.Audit == nil || !logs.Audit.Verified {
+		t.Fatalf("expected the audit to verify, got %+v", logs.Audit)
+	}
+	numberEqual(t, logs.Audit.Events, 1)
+
+	// Appends extend the cached result.
+	store.Append(HistoryEvent{Type: EventCommandIssued, User: "sam", Outcome: OutcomeSuccess, Detail: "toggle"})
+	_, logs = getLogs(t, store, "")
+	numberEqual(t, logs.Audit.Events, 2)
+
+	// Same length, so the store's offsets still hold.
+	editAuditStore(t, store.path, func(lines []string) []string {
+		lines[0] = strings.Replace(lines[0], "dillon", "dyllon", 1)
+		return lines
+	})
+	_, logs = getLogs(t, store, "")
+	if logs.Audit.Verified {
+		t.Error("expected the audit to fail after the store was modified")
+	}
+	stringEqual(t, logs.Audit.Error, "event 1 does not match its hash")
+}
+
+func TestLoadAuditKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl.key")
+	if _, _, err := LoadAuditKey(path, false); !os.IsNotExist(err) {
+		t.Fatalf("expected a missing key to be left missing, got %v", err)
+	}
+
+	key, created, err := LoadAuditKey(path, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !created || len(key) != auditKeySize {
+		t.Fatalf("expected a new %d byte key, got %d bytes (created %t)", auditKeySize, len(key), created)
+	}
+	info, _ := os.Stat(path)
+	stringEqual(t, info.Mode().Perm().String(), "-rw-------")
+
+	again, created, err := LoadAuditKey(path, true)
+	if err != nil || created || string(again) != string(key) {
+		t.Fatalf("expected the same key back, got %x (created %t, %v)", again, created, err)
+	}
+
+	os.Chmod(path, 0644)
+	if _, _, err := LoadAuditKey(path, true); err == nil || !strings.Contains(err.Error(), "can be read by other users") {
+		t.Errorf("expected a readable key to be refused, got %v", err)
+	}
+}
+
+func TestOpenEventStoreSignsWithAuditKey(t *testing.T) {
+	defer func(secret string) { SharedSecret = secret }(SharedSecret)
+	SharedSecret = "test secret"
+
+	// A store chained from the shared secret, as before the key file.
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	store, err := OpenEventStore(path, legacyAuditKey(SharedSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Append(HistoryEvent{Type: EventCommandIssued, User: "dillon", Outcome: OutcomeSuccess, Detail: "toggle"})
+	store.Append(HistoryEvent{Type: EventStateChanged, Outcome: OutcomeSuccess, Detail: "open"})
+	store.Close()
+
+	store, err = openEventStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	key, _, err := LoadAuditKey(path+".key", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report, _ := VerifyAudit(path, key); !report.Verified || report.Events != 2 {
+		t.Errorf("expected both events signed with the audit key, got %+v", report)
+	}
+	if report, _ := VerifyAudit(path, legacyAuditKey(SharedSecret)); report.Verified {
+		t.Error("expected the shared secret to no longer verify the store")
+	}
+}
+
+func TestOpenEventStoreKeepsTamperedStore(t *testing.T) {
+	defer func(secret string) { SharedSecret = secret }(SharedSecret)
+	SharedSecret = "test secret"
+
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	store, err := OpenEventStore(path, legacyAuditKey(SharedSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Append(HistoryEvent{Type: EventCommandIssued, User: "dillon", Outcome: OutcomeSuccess, Detail: "toggle"})
+	store.Close()
+	editAuditStore(t, path, func(lines []string) []string {
+		lines[0] = strings.Replace(lines[0], "dillon", "dyllon", 1)
+		return lines
+	})
+
+	if _, err := openEventStore(path); err == nil {
+		t.Fatal("expected a store that fails its audit not to be signed again")
+	}
+	if _, err := os.Stat(path + ".key"); !os.IsNotExist(err) {
+		t.Errorf("expected the new key to be removed, got %v", err)
+	}
+}
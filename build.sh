@@ -1,4 +1,13 @@
 #!/bin/bash
 set -e
 go test
-GOOS=linux GOARCH=arm GOARM=6 go build -v github.com/dillonhafer/garage-server
+
+# Stamp the binary with the release tag, commit and build time, so nobody
+# edits Version by hand. Untagged trees keep the default in version.go.
+VERSION=$(git describe --tags --abbrev=0 2>/dev/null | sed 's/^v//' || true)
+LDFLAGS="-X main.Commit=$(git rev-parse --short HEAD) -X main.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+if [ -n "$VERSION" ]; then
+  LDFLAGS="$LDFLAGS -X main.Version=$VERSION"
+fi
+
+GOOS=linux GOARCH=arm GOARM=6 go build -v -ldflags "$LDFLAGS" github.com/dillonhafer/garage-server
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type controlCommand struct {
+	ID      string `json:"id"`
+	Command string `json:"command"`
+}
+
+type controlResult struct {
+	Type       string `json:"type"`
+	ID         string `json:"id"`
+	OK         bool   `json:"ok"`
+	Status     string `json:"status,omitempty"`
+	DoorStatus string `json:"doorStatus,omitempty"`
+	Code       string `json:"code,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+type controlEvent struct {
+	Type    string      `json:"type"`
+	Event   string      `json:"event"`
+	EventID uint64      `json:"eventId,omitempty"`
+	Data    interface{} `json:"data"`
+}
+
+var errSessionExpired = errors.New("session expired")
+var errUnknownCommand = errors.New("unknown command")
+
+// authorizeCommand is checked before every command, not just at connect, so
+// a long-lived socket can't outlive the signature that opened it.
+func authorizeCommand(authorizedAt time.Time, sessionTimeout time.Duration, command string) error {
+	if time.Since(authorizedAt) > sessionTimeout {
+		return errSessionExpired
+	}
+	switch command {
+	case "status", "toggle", "open", "close":
+		return nil
+	}
+	return errUnknownCommand
+}
+
+// recordCommand records the outcome of a command sent with req.
+func recordCommand(req *http.Request) func(outcome string, command string) {
+	return func(outcome string, command string) {
+		recordEvent(req, EventCommandIssued, outcome, command)
+	}
+}
+
+// recordCommandAs records the outcome of a command sent by user outside of
+// a request, such as over MQTT or HomeKit.
+func recordCommandAs(store *EventStore, door string, user string, logger *Logger) func(outcome string, command string) {
+	return func(outcome string, command string) {
+		_, err := store.Append(HistoryEvent{Type: EventCommandIssued, User: user, Door: door, Outcome: outcome, Detail: command})
+		if err != nil {
+			logger.Error("Could not record event", Field{"type", EventCommandIssued}, Field{"error", err})
+		}
+	}
+}
+
+// commandSettleTimeout is how long a door sent to open or close is taken to
+// be on its way there.
+var commandSettleTimeout = 30 * time.Second
+
+// commandTargets is the state open and close send the door to, and
+// commandMoving describes the door on its way there.
+var commandTargets = map[string]string{"open": "open", "close": "closed"}
+var commandMoving = map[string]string{"open": "opening", "close": "closing"}
+
+// DoorControl serializes the commands sent to a door, however they arrive,
+// so the status one command reads can't be changed by another's toggle
+// before it acts on it. It also remembers the state the door was last sent
+// to: the reed switch only knows whether the door is closed, and toggling a
+// door that is still moving reverses it.
+type DoorControl struct {
+	mu      sync.Mutex
+	target  string
+	settles time.Time
+}
+
+func NewDoorControl() *DoorControl {
+	return &DoorControl{}
+}
+
+// pending returns the state the door was sent to, if it may still be on its
+// way there.
+func (d *DoorControl) pending() string {
+	if time.Now().After(d.settles) {
+		return ""
+	}
+	return d.target
+}
+
+// runControlCommand runs command against the door and records its outcome
+// with record, whichever way it was sent. Commands run one at a time per
+// control. open or close while the door is already on its way to that state
+// is a no-op, where a toggle would send it back.
+func runControlCommand(ctx context.Context, control *DoorControl, record func(outcome string, command string), command controlCommand, doorStatus func(context.Context, int) (string, error), toggleSwitch func(context.Context, int, int) error, logger *Logger, pinNumber int, statusPin int, sleepTimeout int) controlResult {
+	result := controlResult{Type: "result", ID: command.ID}
+	if command.Command != "status" {
+		control.mu.Lock()
+		defer control.mu.Unlock()
+	}
+
+	target := commandTargets[command.Command]
+	if command.Command != "toggle" {
+		status, err := doorStatus(ctx, statusPin)
+		if err != nil {
+			result.Code = "sensor_unavailable"
+			result.Error = fmt.Sprintf("Could not read pin '%d' on Raspberry Pi", statusPin)
+			logger.Error(result.Error, Field{"command", command.Command})
+			if command.Command != "status" {
+				record(OutcomeFailure, command.Command)
+			}
+			return result
+		}
+		result.DoorStatus = status
+
+		if command.Command == "status" {
+			result.OK = true
+			return result
+		}
+		// The reed switch only sees a closed door, so one on its way down
+		// still reads open.
+		pending := control.pending()
+		closing := pending == "closed" && status == "open"
+		if status == target && !closing {
+			result.OK = true
+			result.Status = "already " + status
+			record(OutcomeSuccess, command.Command)
+			return result
+		}
+		if pending == target {
+			result.OK = true
+			result.Status = "already " + commandMoving[command.Command]
+			record(OutcomeSuccess, command.Command)
+			return result
+		}
+	}
+
+	logger.Info("TOGGLE DOOR", Field{"command", command.Command})
+	if err := toggleSwitch(ctx, pinNumber, sleepTimeout); err != nil {
+		result.Code = "relay_failed"
+		result.Error = "Could not write to pin"
+		logger.Error(result.Error, Field{"pin", pinNumber}, Field{"error", err})
+		record(OutcomeFailure, command.Command)
+		return result
+	}
+	record(OutcomeSuccess, command.Command)
+	// A toggle has no target: there's no telling which way the door went.
+	control.target, control.settles = target, time.Now().Add(commandSettleTimeout)
+
+	result.OK = true
+	result.Status = "signal received"
+	return result
+}
+
+func ControlHandler(hub *EventHub, control *DoorControl, doorStatus func(context.Context, int) (string, error), toggleSwitch func(context.Context, int, int) error, logger *Logger, pinNumber int, statusPin int, sleepTimeout int, sessionTimeout time.Duration) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := requestLogger(logger, req)
+		authorizedAt := time.Now()
+		conn, err := upgradeWebSocket(w, req)
+		if err != nil {
+			log.Warn("Could not open control channel", Field{"error", err})
+			return
+		}
+		defer conn.Close(1000)
+		log.Info("Control")
+
+		send := func(v interface{}) error {
+			message, err := json.Marshal(v)
+			if err != nil {
+				return err
+			}
+			return conn.WriteMessage(opText, message)
+		}
+
+		_, events := hub.Subscribe("")
+		defer hub.Unsubscribe(events)
+		go func() {
+			for event := range events {
+				if err := send(controlEvent{Type: "event", Event: event.Type, EventID: event.ID, Data: event.Data}); err != nil {
+					return
+				}
+			}
+		}()
+
+		for {
+			_, message, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+
+			var command controlCommand
+			if err := json.Unmarshal(message, &command); err != nil {
+				send(controlResult{Type: "result", Code: "invalid_command", Error: "invalid command"})
+				continue
+			}
+
+			if err := authorizeCommand(authorizedAt, sessionTimeout, command.Command); err != nil {
+				if err == errSessionExpired {
+					log.Warn("Control session expired", Field{"command", command.Command})
+					send(controlResult{Type: "result", ID: command.ID, Code: "session_expired", Error: err.Error()})
+					conn.Close(1008)
+					return
+				}
+				send(controlResult{Type: "result", ID: command.ID, Code: "unknown_command", Error: fmt.Sprintf("unknown command '%s'", command.Command)})
+				continue
+			}
+
+			send(runControlCommand(req.Context(), control, recordCommand(req), command, doorStatus, toggleSwitch, log, pinNumber, statusPin, sleepTimeout))
+		}
+	})
+}
+
+// signatureFromQuery lets browsers, which can't set headers on a WebSocket
+// handshake, pass the signature and timestamp as query parameters instead.
+func signatureFromQuery(f http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		query := req.URL.Query()
+		for _, name := range []string{"signature", "timestamp"} {
+			if req.Header.Get(name) == "" && query.Get(name) != "" {
+				req.Header.Set(name, query.Get(name))
+			}
+		}
+		f(w, req)
+	})
+}
+
+func CreateControlHandler(hub *EventHub, control *DoorControl, doorStatus func(context.Context, int) (string, error), toggleSwitch func(context.Context, int, int) error, logger *Logger, pinNumber int, statusPin int, sleepTimeout int, sessionTimeout time.Duration) http.HandlerFunc {
+	return signatureFromQuery(AuthenticatedHandler(ControlHandler(hub, control, doorStatus, toggleSwitch, logger, pinNumber, statusPin, sleepTimeout, sessionTimeout)))
+}
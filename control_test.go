@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type testWebSocket struct {
+	conn   net.Conn
+	reader *bufio.Reader
+}
+
+func dialControl(t *testing.T, server *httptest.Server, secret string) (*testWebSocket, int) {
+	conn, err := net.Dial("tcp", strings.TrimPrefix(server.URL, "http://"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	validTimestamp := CreateTimestamp(0)
+	fmt.Fprintf(conn, "GET /control?timestamp=%s&signature=%s HTTP/1.1\r\n", validTimestamp, CreateSignature([]byte(validTimestamp), secret))
+	fmt.Fprint(conn, "Host: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n")
+	fmt.Fprint(conn, "Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n\r\n")
+
+	reader := bufio.NewReader(conn)
+	res, err := http.ReadResponse(reader, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode == 101 {
+		stringEqual(t, res.Header.Get("Sec-WebSocket-Accept"), "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=")
+	}
+	return &testWebSocket{conn: conn, reader: reader}, res.StatusCode
+}
+
+func (ws *testWebSocket) send(t *testing.T, message string) {
+	mask := []byte{1, 2, 3, 4}
+	frame := []byte{0x80 | opText, 0x80 | byte(len(message))}
+	frame = append(frame, mask...)
+	for i := 0; i < len(message); i++ {
+		frame = append(frame, message[i]^mask[i%4])
+	}
+	if _, err := ws.conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func (ws *testWebSocket) receive(t *testing.T) (byte, []byte) {
+	ws.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	var header [2]byte
+	if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	length := int(header[1] & 0x7F)
+	if length == 126 {
+		var ext [2]byte
+		io.ReadFull(ws.reader, ext[:])
+		length = int(binary.BigEndian.Uint16(ext[:]))
+	}
+	payload := make([]byte, length)
+	if _, err := io.ReadFull(ws.reader, payload); err != nil {
+		t.Fatal(err)
+	}
+	return header[0] & 0x0F, payload
+}
+
+func (ws *testWebSocket) receiveResult(t *testing.T) controlResult {
+	for {
+		_, payload := ws.receive(t)
+		var result controlResult
+		if err := json.Unmarshal(payload, &result); err != nil {
+			t.Fatal(err)
+		}
+		if result.Type == "result" {
+			return result
+		}
+	}
+}
+
+func TestControlCommands(t *testing.T) {
+	hub := NewEventHub(10)
+	toggles := 0
+	toggleSwitch := func(context.Context, int, int) error {
+		toggles++
+		return nil
+	}
+	Control := CreateControlHandler(hub, NewDoorControl(), CreateDummyStatus("closed"), toggleSwitch, DummyLogger, 0, 0, 1, time.Minute)
+	server := httptest.NewServer(Control)
+	defer server.Close()
+
+	ws, code := dialControl(t, server, SharedSecret)
+	defer ws.conn.Close()
+	responseEqual(t, code, 101)
+
+	ws.send(t, `{"id":"1","command":"close"}`)
+	result := ws.receiveResult(t)
+	stringEqual(t, result.ID, "1")
+	stringEqual(t, result.Status, "already closed")
+	numberEqual(t, toggles, 0)
+
+	ws.send(t, `{"id":"2","command":"open"}`)
+	result = ws.receiveResult(t)
+	stringEqual(t, result.ID, "2")
+	stringEqual(t, result.Status, "signal received")
+	numberEqual(t, toggles, 1)
+
+	ws.send(t, `{"id":"3","command":"launch"}`)
+	result = ws.receiveResult(t)
+	stringEqual(t, result.ID, "3")
+	stringEqual(t, result.Error, "unknown command 'launch'")
+}
+
+func TestControlCommandsWhileMoving(t *testing.T) {
+	control := NewDoorControl()
+	status := "open"
+	doorStatus := func(context.Context, int) (string, error) { return status, nil }
+	var toggles int32
+	toggleSwitch := func(context.Context, int, int) error {
+		atomic.AddInt32(&toggles, 1)
+		return nil
+	}
+	record := func(outcome string, command string) {}
+	run := func(command string) controlResult {
+		return runControlCommand(context.Background(), control, record, controlCommand{Command: command}, doorStatus, toggleSwitch, DummyLogger, 0, 0, 1)
+	}
+
+	// Only one of a burst of closes pulses the relay; the door still reads
+	// open on its way down.
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			run("close")
+		}()
+	}
+	wg.Wait()
+	numberEqual(t, int(toggles), 1)
+	stringEqual(t, run("close").Status, "already closing")
+
+	// Open sends it back up.
+	stringEqual(t, run("open").Status, "signal received")
+	stringEqual(t, run("open").Status, "already open")
+	numberEqual(t, int(toggles), 2)
+
+	// Once it settles the reed switch is trusted again.
+	control.settles = time.Time{}
+	stringEqual(t, run("close").Status, "signal received")
+	numberEqual(t, int(toggles), 3)
+}
+
+func TestControlPushesEvents(t *testing.T) {
+	hub := NewEventHub(10)
+	Control := CreateControlHandler(hub, NewDoorControl(), CreateDummyStatus("closed"), CreateDummyRelay(false), DummyLogger, 0, 0, 1, time.Minute)
+	server := httptest.NewServer(Control)
+	defer server.Close()
+
+	ws, _ := dialControl(t, server, SharedSecret)
+	defer ws.conn.Close()
+
+	// Round trip a command so the subscription is known to be in place.
+	ws.send(t, `{"id":"1","command":"status"}`)
+	ws.receiveResult(t)
+
+	hub.Publish("state", "open")
+	_, payload := ws.receive(t)
+	stringEqual(t, string(payload), `{"type":"event","event":"state","eventId":1,"data":"open"}`)
+}
+
+func TestControlSessionExpires(t *testing.T) {
+	Control := CreateControlHandler(NewEventHub(10), NewDoorControl(), CreateDummyStatus("closed"), CreateDummyRelay(false), DummyLogger, 0, 0, 1, 0)
+	server := httptest.NewServer(Control)
+	defer server.Close()
+
+	ws, _ := dialControl(t, server, SharedSecret)
+	defer ws.conn.Close()
+
+	ws.send(t, `{"id":"1","command":"toggle"}`)
+	result := ws.receiveResult(t)
+	stringEqual(t, result.Error, "session expired")
+
+	opcode, payload := ws.receive(t)
+	numberEqual(t, int(opcode), opClose)
+	numberEqual(t, int(binary.BigEndian.Uint16(payload)), 1008)
+
+	// Only the one close frame is sent before the connection ends.
+	ws.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if _, err := ws.reader.ReadByte(); err != io.EOF {
+		t.Errorf("Expected EOF after the close frame, got %v", err)
+	}
+}
+
+func TestControlRejectsReservedBits(t *testing.T) {
+	Control := CreateControlHandler(NewEventHub(10), NewDoorControl(), CreateDummyStatus("closed"), CreateDummyRelay(false), DummyLogger, 0, 0, 1, time.Minute)
+	server := httptest.NewServer(Control)
+	defer server.Close()
+
+	ws, _ := dialControl(t, server, SharedSecret)
+	defer ws.conn.Close()
+
+	// RSV1 set with no extension negotiated.
+	ws.conn.Write([]byte{0x80 | 0x40 | opText, 0x80 | 0, 1, 2, 3, 4})
+	opcode, payload := ws.receive(t)
+	numberEqual(t, int(opcode), opClose)
+	numberEqual(t, int(binary.BigEndian.Uint16(payload)), 1002)
+}
+
+func TestUnverifiedSignatureOnControl(t *testing.T) {
+	Control := CreateControlHandler(NewEventHub(10), NewDoorControl(), CreateDummyStatus("closed"), CreateDummyRelay(false), DummyLogger, 0, 0, 1, time.Minute)
+	server := httptest.NewServer(Control)
+	defer server.Close()
+
+	ws, code := dialControl(t, server, "Unverified Signature")
+	defer ws.conn.Close()
+	responseEqual(t, code, 403)
+}
+
+func TestControlRejectsPlainRequests(t *testing.T) {
+	writer := httptest.NewRecorder()
+	CreateTestRouter(t, false, "closed", false).ServeHTTP(writer, signedRequest(t, "GET", "/api/v2/control", SharedSecret))
+	responseEqual(t, writer.Code, 400)
+	stringEqual(t, writer.Header().Get("Content-Type"), "application/json")
+	stringEqual(t, decodeAPIError(t, writer).Code, "invalid_handshake")
+}
@@ -1,12 +1,50 @@
 package door
 
 import (
+	"context"
+	"sync"
 	"time"
 
 	"github.com/stianeikeland/go-rpio"
 )
 
-func CheckDoorStatus(pinNumber int) (state string, err error) {
+// gpio serializes access to /dev/mem. rpio.Open and rpio.Close map and unmap
+// global memory, so a status poll must not close it under a toggle.
+var gpio sync.Mutex
+
+// A Tracer is told as each step of a door operation starts, and ends the
+// step by calling the function it returns, so a slow toggle can be put down
+// to the lock, the pin or the pulse.
+type Tracer func(step string) (end func(err error))
+
+type tracerKey struct{}
+
+// WithTracer returns a context whose door operations report their steps to
+// tracer.
+func WithTracer(ctx context.Context, tracer Tracer) context.Context {
+	return context.WithValue(ctx, tracerKey{}, tracer)
+}
+
+func step(ctx context.Context, name string) func(err error) {
+	if tracer, ok := ctx.Value(tracerKey{}).(Tracer); ok {
+		return tracer(name)
+	}
+	return func(error) {}
+}
+
+func lock(ctx context.Context) {
+	end := step(ctx, "gpio.lock")
+	gpio.Lock()
+	end(nil)
+}
+
+func CheckDoorStatus(ctx context.Context, pinNumber int) (state string, err error) {
+	lock(ctx)
+	defer gpio.Unlock()
+
+	end := step(ctx, "gpio.read")
+	defer func() { end(err) }()
+
 	err = rpio.Open()
 	if err != nil {
 		return
@@ -23,9 +61,13 @@ func CheckDoorStatus(pinNumber int) (state string, err error) {
 	return status, err
 }
 
-func ToggleSwitch(pinNumber int, sleepTimeout int) (err error) {
+func ToggleSwitch(ctx context.Context, pinNumber int, sleepTimeout int) (err error) {
+	lock(ctx)
+	end := step(ctx, "gpio.write")
 	err = rpio.Open()
 	if err != nil {
+		end(err)
+		gpio.Unlock()
 		return err
 	}
 	pin := rpio.Pin(pinNumber)
@@ -33,10 +75,18 @@ func ToggleSwitch(pinNumber int, sleepTimeout int) (err error) {
 
 	pin.Low()
 	rpio.Close()
+	end(nil)
+	gpio.Unlock()
 
+	end = step(ctx, "relay.pulse")
 	snooze := time.Duration(sleepTimeout) * time.Millisecond
 	time.Sleep(snooze)
+	end(nil)
 
+	lock(ctx)
+	defer gpio.Unlock()
+	end = step(ctx, "gpio.write")
+	defer func() { end(err) }()
 	err = rpio.Open()
 	if err != nil {
 		return err
@@ -46,3 +96,18 @@ func ToggleSwitch(pinNumber int, sleepTimeout int) (err error) {
 
 	return nil
 }
+
+// CheckGPIO maps and unmaps the GPIO memory without touching a pin, to
+// check the server can still drive the relay.
+func CheckGPIO(ctx context.Context) (err error) {
+	lock(ctx)
+	defer gpio.Unlock()
+
+	end := step(ctx, "gpio.open")
+	defer func() { end(err) }()
+
+	if err = rpio.Open(); err != nil {
+		return err
+	}
+	return rpio.Close()
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type Event struct {
+	ID   uint64      `json:"id"`
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// EventHub fans events out to subscribers and keeps the most recent ones
+// so reconnecting clients can resume with Last-Event-ID.
+type EventHub struct {
+	mu          sync.Mutex
+	lastID      uint64
+	size        int
+	buffer      []Event
+	subscribers map[chan Event]bool
+}
+
+func NewEventHub(size int) *EventHub {
+	return &EventHub{size: size, subscribers: make(map[chan Event]bool)}
+}
+
+func (h *EventHub) Publish(eventType string, data interface{}) Event {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.lastID++
+	event := Event{ID: h.lastID, Type: eventType, Data: data}
+
+	h.buffer = append(h.buffer, event)
+	if len(h.buffer) > h.size {
+		h.buffer = h.buffer[len(h.buffer)-h.size:]
+	}
+
+	for ch := range h.subscribers {
+		select {
+		case ch <- event:
+		default:
+			// The subscriber can't keep up. Closing its channel ends the
+			// stream and the client resumes from the replay buffer.
+			delete(h.subscribers, ch)
+			close(ch)
+		}
+	}
+
+	return event
+}
+
+// Subscribe returns the buffered events newer than lastEventID along with a
+// channel of live events. An empty or unknown lastEventID replays nothing
+// unless it is ahead of the hub, which means the server restarted.
+func (h *EventHub) Subscribe(lastEventID string) ([]Event, chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var replay []Event
+	if lastEventID != "" {
+		lastID, err := strconv.ParseUint(lastEventID, 10, 64)
+		if err == nil {
+			if lastID > h.lastID {
+				lastID = 0
+			}
+			for _, event := range h.buffer {
+				if event.ID > lastID {
+					replay = append(replay, event)
+				}
+			}
+		}
+	}
+
+	ch := make(chan Event, h.size)
+	h.subscribers[ch] = true
+	return replay, ch
+}
+
+func (h *EventHub) Unsubscribe(ch chan Event) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.subscribers[ch] {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+}
+
+// Logger wraps logger so every message it writes is also published as a
+// log event. The line logged for each request is left out; health checks,
+// scrapes and the event streams themselves would drown everything else.
+func (h *EventHub) Logger(logger *Logger) *Logger {
+	return logger.WithHook(func(record Record) {
+		if record.Message == requestLogMessage {
+			return
+		}
+		var data struct {
+			Level   string `json:"level"`
+			Message string `json:"message"`
+		}
+		data.Level = record.Level.String()
+		data.Message = record.Message
+		h.Publish("log", data)
+	})
+}
+
+// Relay wraps toggleSwitch so the outcome of every toggle is published as a
+// command event.
+func (h *EventHub) Relay(toggleSwitch func(context.Context, int, int) error) func(context.Context, int, int) error {
+	return func(ctx context.Context, pinNumber int, sleepTimeout int) error {
+		err := toggleSwitch(ctx, pinNumber, sleepTimeout)
+		var data struct {
+			Command string `json:"command"`
+			Status  string `json:"status"`
+			Error   string `json:"error,omitempty"`
+		}
+		data.Command = "toggle"
+		data.Status = "signal received"
+		if err != nil {
+			data.Status = "failed"
+			data.Error = err.Error()
+		}
+		h.Publish("command", data)
+		return err
+	}
+}
+
+func writeServerSentEvent(w http.ResponseWriter, event Event) error {
+	data, err := json.Marshal(event.Data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data)
+	return err
+}
+
+func EventsHandler(hub *EventHub, logger *Logger, heartbeat time.Duration) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := requestLogger(logger, req)
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			apiErr := &APIError{Status: 500, Code: "streaming_unsupported", Message: "Streaming unsupported"}
+			logAPIError(log, apiErr)
+			writeAPIError(w, req, apiErr)
+			return
+		}
+
+		log.Info("Events")
+		replay, events := hub.Subscribe(req.Header.Get("Last-Event-ID"))
+		defer hub.Unsubscribe(events)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+		w.WriteHeader(200)
+
+		for _, event := range replay {
+			if err := writeServerSentEvent(w, event); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-req.Context().Done():
+				return
+			case event, open := <-events:
+				if !open {
+					return
+				}
+				if err := writeServerSentEvent(w, event); err != nil {
+					return
+				}
+			case <-ticker.C:
+				if _, err := fmt.Fprint(w, ": heartbeat\n\n"); err != nil {
+					return
+				}
+			}
+			flusher.Flush()
+		}
+	})
+}
+
+func CreateEventsHandler(hub *EventHub, logger *Logger, heartbeat time.Duration) http.HandlerFunc {
+	return AuthenticatedHandler(EventsHandler(hub, logger, heartbeat))
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readServerSentEvent(t *testing.T, reader *bufio.Reader) string {
+	var lines []string
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		line = strings.TrimRight(line, "\n")
+		if line == "" {
+			return strings.Join(lines, "\n")
+		}
+		lines = append(lines, line)
+	}
+}
+
+func openEventStream(t *testing.T, server *httptest.Server, lastEventID string) (*http.Response, *bufio.Reader) {
+	validTimestamp := CreateTimestamp(0)
+	req, err := http.NewRequest("GET", server.URL+"/events", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Add("signature", CreateSignature([]byte(validTimestamp), SharedSecret))
+	req.Header.Add("timestamp", validTimestamp)
+	if lastEventID != "" {
+		req.Header.Add("Last-Event-ID", lastEventID)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return res, bufio.NewReader(res.Body)
+}
+
+func TestEventHubReplay(t *testing.T) {
+	hub := NewEventHub(2)
+	hub.Publish("log", "one")
+	hub.Publish("log", "two")
+	hub.Publish("log", "three")
+
+	replay, ch := hub.Subscribe("1")
+	defer hub.Unsubscribe(ch)
+	numberEqual(t, len(replay), 2)
+	numberEqual(t, int(replay[0].ID), 2)
+
+	replay, ch = hub.Subscribe("")
+	defer hub.Unsubscribe(ch)
+	numberEqual(t, len(replay), 0)
+
+	replay, ch = hub.Subscribe("99")
+	defer hub.Unsubscribe(ch)
+	numberEqual(t, len(replay), 2)
+}
+
+func TestEventHubLogger(t *testing.T) {
+	hub := NewEventHub(10)
+	handler := RequestLogHandler(hub.Logger(DummyLogger), http.HandlerFunc(HealthHandler))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/healthz", nil))
+	hub.Logger(DummyLogger).Warn("Invalid wait 'soon'")
+
+	replay, ch := hub.Subscribe("0")
+	defer hub.Unsubscribe(ch)
+	numberEqual(t, len(replay), 1)
+	stringEqual(t, replay[0].Type, "log")
+}
+
+func TestEventHubDropsSlowSubscriber(t *testing.T) {
+	hub := NewEventHub(1)
+	_, ch := hub.Subscribe("")
+	hub.Publish("log", "one")
+	hub.Publish("log", "two")
+
+	<-ch
+	if _, open := <-ch; open {
+		t.Fatal("Expected slow subscriber to be closed")
+	}
+	hub.Unsubscribe(ch)
+}
+
+func TestEventsResumeFromLastEventID(t *testing.T) {
+	hub := NewEventHub(10)
+	hub.Publish("state", "open")
+	hub.Publish("state", "closed")
+
+	server := httptest.NewServer(CreateEventsHandler(hub, DummyLogger, time.Minute))
+	defer server.Close()
+
+	res, reader := openEventStream(t, server, "1")
+	defer res.Body.Close()
+	responseEqual(t, res.StatusCode, 200)
+	stringEqual(t, res.Header.Get("Content-Type"), "text/event-stream")
+
+	stringEqual(t, readServerSentEvent(t, reader), "id: 2\nevent: state\ndata: \"closed\"")
+
+	hub.Relay(CreateDummyRelay(false))(context.Background(), 0, 1)
+	stringEqual(t, readServerSentEvent(t, reader), `id: 3
+event: command
+data: {"command":"toggle","status":"signal received"}`)
+}
+
+func TestEventsHeartbeat(t *testing.T) {
+	hub := NewEventHub(10)
+	server := httptest.NewServer(CreateEventsHandler(hub, DummyLogger, 10*time.Millisecond))
+	defer server.Close()
+
+	res, reader := openEventStream(t, server, "")
+	defer res.Body.Close()
+	stringEqual(t, readServerSentEvent(t, reader), ": heartbeat")
+}
+
+func TestUnverifiedSignatureOnEvents(t *testing.T) {
+	writer := httptest.NewRecorder()
+	validTimestamp := CreateTimestamp(0)
+
+	req, err := http.NewRequest("GET", "/events", nil)
+	req.Header.Add("signature", CreateSignature([]byte(validTimestamp), "Unverified Signature"))
+	req.Header.Add("timestamp", validTimestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	Events := CreateEventsHandler(NewEventHub(10), DummyLogger, time.Minute)
+	Events(writer, req)
+	responseEqual(t, writer.Code, 403)
+}
+
+func TestEventsWithoutStreaming(t *testing.T) {
+	writer := httptest.NewRecorder()
+	// Hides the recorder's Flush.
+	unflushable := struct{ http.ResponseWriter }{writer}
+	EventsHandler(NewEventHub(10), DummyLogger, time.Minute)(unflushable, signedRequest(t, "GET", "/api/v2/events", SharedSecret))
+	responseEqual(t, writer.Code, 500)
+	stringEqual(t, decodeAPIError(t, writer).Code, "streaming_unsupported")
+}
+
+func TestDoorWatcherPublishesChanges(t *testing.T) {
+	hub := NewEventHub(10)
+	state := "closed"
+	var readErr error
+	doorStatus := func(context.Context, int) (string, error) { return state, readErr }
+
+	watcher := NewDoorWatcher(doorStatus, DummyLogger, 0, hub)
+	watcher.Poll()
+	watcher.Poll()
+	state = "open"
+	watcher.Poll()
+	readErr = errors.New("unprocessable entity")
+	watcher.Poll()
+
+	replay, ch := hub.Subscribe("0")
+	defer hub.Unsubscribe(ch)
+	numberEqual(t, len(replay), 2)
+	state, version := watcher.State()
+	stringEqual(t, state, "open")
+	numberEqual(t, int(version), 2)
+}
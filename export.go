@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exportEvents returns every event matching the request's /logs filters,
+// oldest first. Exports aren't paged, so cursor and limit are ignored, and
+// the store is only read back as far as from.
+func exportEvents(store *EventStore, filter LogFilter) ([]HistoryEvent, *APIError) {
+	filter.Before = 0
+	events, err := store.QuerySince(filter.From, filter.Match)
+	if err != nil {
+		return nil, &APIError{Status: 500, Code: "store_unavailable", Message: fmt.Sprintf("Could not read event store: %s", err)}
+	}
+	ReverseEvents(events)
+	return events, nil
+}
+
+var logsCSVHeader = []string{"timestamp", "date", "time", "type", "event", "user", "door", "outcome"}
+
+// csvCell stops a spreadsheet from running a value, such as a user header,
+// as a formula.
+func csvCell(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// LogsCSV renders the entries /logs would list as CSV, one row each, oldest
+// first.
+func LogsCSV(events []HistoryEvent, format LogFormat) []byte {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(logsCSVHeader)
+	for _, event := range events {
+		entry := LogFromEvent(event, format)
+		w.Write([]string{
+			entry.Timestamp,
+			csvCell(entry.Date),
+			csvCell(entry.Time),
+			csvCell(entry.Type),
+			entry.Event,
+			csvCell(entry.User),
+			csvCell(entry.Door),
+			entry.Outcome,
+		})
+	}
+	w.Flush()
+	return buf.Bytes()
+}
+
+const icsTimeLayout = "20060102T150405Z"
+
+var icsEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`, "\r", "")
+
+// writeICSLine writes one content line, folded at 75 octets as RFC 5545
+// requires without splitting a UTF-8 sequence.
+func writeICSLine(buf *bytes.Buffer, line string) {
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		buf.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	buf.WriteString(line + "\r\n")
+}
+
+// LogsICS renders each time the door was open as a calendar event from
+// when it opened to when it closed. A door still open is shown open until
+// now.
+func LogsICS(intervals []doorInterval, now time.Time) []byte {
+	var buf bytes.Buffer
+	writeICSLine(&buf, "BEGIN:VCALENDAR")
+	writeICSLine(&buf, "VERSION:2.0")
+	writeICSLine(&buf, "PRODID:-//garage-server//door history "+Version+"//EN")
+	writeICSLine(&buf, "CALSCALE:GREGORIAN")
+	writeICSLine(&buf, "X-WR-CALNAME:Garage door")
+
+	for _, interval := range intervals {
+		opened := interval.Opened
+		closed := interval.Closed.Time
+		door := opened.Door
+		if door == "" {
+			door = "Door"
+		}
+		summary := door + " open"
+		var description []string
+		if interval.User != "" {
+			description = append(description, "Opened by "+interval.User)
+		}
+		if interval.Closed.ID == 0 {
+			closed = now
+			summary += " (still open)"
+			description = append(description, "Still open")
+		}
+
+		writeICSLine(&buf, "BEGIN:VEVENT")
+		writeICSLine(&buf, fmt.Sprintf("UID:%d-%s@garage-server", opened.ID, icsEscaper.Replace(opened.Door)))
+		writeICSLine(&buf, "DTSTAMP:"+closed.UTC().Format(icsTimeLayout))
+		writeICSLine(&buf, "DTSTART:"+opened.Time.UTC().Format(icsTimeLayout))
+		writeICSLine(&buf, "DTEND:"+closed.UTC().Format(icsTimeLayout))
+		writeICSLine(&buf, "SUMMARY:"+icsEscaper.Replace(summary))
+		if len(description) > 0 {
+			writeICSLine(&buf, "DESCRIPTION:"+icsEscaper.Replace(strings.Join(description, "\n")))
+		}
+		writeICSLine(&buf, "END:VEVENT")
+	}
+
+	writeICSLine(&buf, "END:VCALENDAR")
+	return buf.Bytes()
+}
+
+func LogsCSVHandler(logger *Logger, store *EventStore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := requestLogger(logger, req)
+		log.Info("Logs", Field{"format", "csv"})
+		body, apiErr := exportCSV(store, req)
+		if apiErr != nil {
+			logAPIError(log, apiErr)
+			writeAPIError(w, req, apiErr)
+			return
+		}
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="garage-logs.csv"`)
+		w.Write(body)
+	})
+}
+
+func exportCSV(store *EventStore, req *http.Request) ([]byte, *APIError) {
+	filter, apiErr := ParseLogFilter(req)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	format, apiErr := ParseLogFormat(req)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	events, apiErr := exportEvents(store, filter)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	return LogsCSV(events, format), nil
+}
+
+func LogsICSHandler(logger *Logger, store *EventStore) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := requestLogger(logger, req)
+		log.Info("Logs", Field{"format", "ics"})
+		body, apiErr := exportICS(store, req)
+		if apiErr != nil {
+			logAPIError(log, apiErr)
+			writeAPIError(w, req, apiErr)
+			return
+		}
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="garage-logs.ics"`)
+		w.Write(body)
+	})
+}
+
+// exportICS builds the calendar from state changes and the commands that
+// caused them, whatever type asks for. An interval is listed if it opened
+// in the range, with its close even if that came later. A user filter keeps
+// the intervals that user opened.
+func exportICS(store *EventStore, req *http.Request) ([]byte, *APIError) {
+	filter, apiErr := ParseLogFilter(req)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+	query := filter
+	query.User = ""
+	query.To = time.Time{}
+	query.Types = []string{EventStateChanged, EventCommandIssued}
+	events, apiErr := exportEvents(store, query)
+	if apiErr != nil {
+		return nil, apiErr
+	}
+
+	intervals := []doorInterval{}
+	for _, interval := range doorIntervals(events) {
+		if !filter.To.IsZero() && !interval.Opened.Time.Before(filter.To) {
+			continue
+		}
+		if filter.User != "" && interval.User != filter.User {
+			continue
+		}
+		intervals = append(intervals, interval)
+	}
+	return LogsICS(intervals, time.Now()), nil
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func createExportHistory(t *testing.T) *EventStore {
+	store := CreateTestStore(t)
+	at := func(hour, minute int) time.Time {
+		return time.Date(2017, 3, 4, hour, minute, 0, 0, time.UTC)
+	}
+	record := func(event HistoryEvent) {
+		event.Door = "garage"
+		event.Outcome = OutcomeSuccess
+		store.Append(event)
+	}
+
+	record(HistoryEvent{Time: at(8, 0), Type: EventCommandIssued, User: "dillon", Detail: "toggle"})
+	record(HistoryEvent{Time: at(8, 0), Type: EventStateChanged, Detail: "open"})
+	record(HistoryEvent{Time: at(8, 10), Type: EventStateChanged, Detail: "closed"})
+	record(HistoryEvent{Time: at(18, 0), Type: EventCommandIssued, User: "=HYPERLINK(\"x\")", Detail: "open"})
+	record(HistoryEvent{Time: at(18, 0), Type: EventStateChanged, Detail: "open"})
+	record(HistoryEvent{Time: at(23, 30), Type: EventStateChanged, Detail: "closed"})
+	record(HistoryEvent{Time: at(23, 40), Type: EventStateChanged, Detail: "open"})
+	return store
+}
+
+func getExport(t *testing.T, handler func(*Logger, *EventStore) http.HandlerFunc, store *EventStore, path string) *httptest.ResponseRecorder {
+	writer := httptest.NewRecorder()
+	handler(DummyLogger, store)(writer, signedRequest(t, "GET", path, SharedSecret))
+	return writer
+}
+
+func TestLogsCSV(t *testing.T) {
+	store := createExportHistory(t)
+
+	writer := getExport(t, LogsCSVHandler, store, "/api/v2/logs.csv?tz=UTC")
+	responseEqual(t, writer.Code, 200)
+	stringEqual(t, writer.Header().Get("Content-Type"), "text/csv; charset=utf-8")
+
+	rows, err := csv.NewReader(writer.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, len(rows), 3)
+	stringEqual(t, strings.Join(rows[0], ","), "timestamp,date,time,type,event,user,door,outcome")
+	stringEqual(t, strings.Join(rows[1], ","), "2017-03-04T08:00:00Z,Sat Mar 4 2017,8:00 AM,Toggle,command_issued,dillon,garage,success")
+	// A user header can't run as a formula in a spreadsheet.
+	stringEqual(t, rows[2][5], `'=HYPERLINK("x")`)
+}
+
+func TestLogsCSVFilters(t *testing.T) {
+	store := createExportHistory(t)
+
+	writer := getExport(t, LogsCSVHandler, store, "/api/v2/logs.csv?type=state_changed&from=2017-03-04T12:00:00Z&limit=1&locale=de&tz=Europe/Berlin")
+	rows, err := csv.NewReader(writer.Body).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Exports aren't paged, so limit is ignored.
+	numberEqual(t, len(rows), 4)
+	stringEqual(t, rows[1][0], "2017-03-04T19:00:00+01:00")
+	stringEqual(t, rows[1][2], "19:00")
+	stringEqual(t, rows[3][3], "Open")
+
+	writer = getExport(t, LogsCSVHandler, store, "/api/v2/logs.csv?from=yesterday")
+	responseEqual(t, writer.Code, 400)
+	stringEqual(t, decodeAPIError(t, writer).Code, "invalid_parameter")
+}
+
+func TestLogsICS(t *testing.T) {
+	store := createExportHistory(t)
+
+	writer := getExport(t, LogsICSHandler, store, "/api/v2/logs.ics")
+	responseEqual(t, writer.Code, 200)
+	stringEqual(t, writer.Header().Get("Content-Type"), "text/calendar; charset=utf-8")
+
+	body := writer.Body.String()
+	if !strings.HasPrefix(body, "BEGIN:VCALENDAR\r\nVERSION:2.0\r\n") || !strings.HasSuffix(body, "END:VEVENT\r\nEND:VCALENDAR\r\n") {
+		t.Fatalf("not a calendar:\n%s", body)
+	}
+	events := strings.Split(body, "BEGIN:VEVENT\r\n")[1:]
+	numberEqual(t, len(events), 3)
+
+	stringEqual(t, events[0], strings.Join([]string{
+		"UID:2-garage@garage-server",
+		"DTSTAMP:20170304T081000Z",
+		"DTSTART:20170304T080000Z",
+		"DTEND:20170304T081000Z",
+		"SUMMARY:garage open",
+		"DESCRIPTION:Opened by dillon",
+		"END:VEVENT",
+		"",
+	}, "\r\n"))
+	if !strings.Contains(events[1], "DESCRIPTION:Opened by =HYPERLINK(\"x\")\r\n") {
+		t.Errorf("expected the opening user, got:\n%s", events[1])
+	}
+	if !strings.Contains(events[2], "SUMMARY:garage open (still open)\r\n") || strings.Contains(events[2], "Opened by") {
+		t.Errorf("expected an interval still open, got:\n%s", events[2])
+	}
+}
+
+func TestLogsICSFilters(t *testing.T) {
+	store := createExportHistory(t)
+
+	// The close after to still ends the interval.
+	writer := getExport(t, LogsICSHandler, store, "/api/v2/logs.ics?from=2017-03-04T12:00:00Z&to=2017-03-04T20:00:00Z")
+	body := writer.Body.String()
+	numberEqual(t, strings.Count(body, "BEGIN:VEVENT"), 1)
+	if !strings.Contains(body, "DTEND:20170304T233000Z") {
+		t.Errorf("expected the interval to end at its close, got:\n%s", body)
+	}
+
+	writer = getExport(t, LogsICSHandler, store, "/api/v2/logs.ics?user=dillon")
+	body = writer.Body.String()
+	numberEqual(t, strings.Count(body, "BEGIN:VEVENT"), 1)
+	if !strings.Contains(body, "UID:2-garage@garage-server") {
+		t.Errorf("expected dillon's interval, got:\n%s", body)
+	}
+}
+
+func TestWriteICSLineFolds(t *testing.T) {
+	var buf bytes.Buffer
+	line := "DESCRIPTION:" + strings.Repeat("ä", 50)
+	writeICSLine(&buf, line)
+
+	folded := strings.Split(strings.TrimSuffix(buf.String(), "\r\n"), "\r\n")
+	numberEqual(t, len(folded), 2)
+	if len(folded[0]) > 75 || len(folded[1]) > 75 {
+		t.Errorf("line longer than 75 octets: %q", folded)
+	}
+	stringEqual(t, folded[0]+strings.TrimPrefix(folded[1], " "), line)
+}
+
+func TestExportStoreError(t *testing.T) {
+	store := createExportHistory(t)
+	CorruptTestStore(t, store)
+
+	for _, handler := range []func(*Logger, *EventStore) http.HandlerFunc{LogsCSVHandler, LogsICSHandler} {
+		writer := getExport(t, handler, store, "/api/v2/logs.csv")
+		responseEqual(t, writer.Code, 500)
+		stringEqual(t, decodeAPIError(t, writer).Code, "store_unavailable")
+	}
+}
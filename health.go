@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Outcomes of a readiness check. A warning doesn't make the server unready.
+const (
+	CheckOK      = "ok"
+	CheckWarn    = "warn"
+	CheckFail    = "fail"
+	CheckSkipped = "skipped"
+)
+
+// readinessTimeout is how long a check may take before it fails.
+var readinessTimeout = 2 * time.Second
+
+// checkInterval is how long a gpio, sensor or events result is reused.
+// /readyz is unsigned, and each check maps /dev/mem or syncs the disk.
+var checkInterval = 5 * time.Second
+
+// certificateWarning is how long before it expires a certificate is warned
+// about.
+const certificateWarning = 14 * 24 * time.Hour
+
+// clockFloor is a time the clock can't be before once it is set. A Pi has
+// no real-time clock, so until NTP syncs it starts where it last stopped,
+// and every signed request is then rejected as expired.
+var clockFloor = time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// HealthHandler answers as long as the server is serving at all.
+func HealthHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(`{"status":"ok"}` + "\n"))
+}
+
+// CheckResult is the outcome of one readiness check.
+type CheckResult struct {
+	Name     string  `json:"name"`
+	Status   string  `json:"status"`
+	Message  string  `json:"message,omitempty"`
+	Duration float64 `json:"duration_ms"`
+}
+
+// Readiness is the answer to /readyz: ok only if no check failed.
+type Readiness struct {
+	Status string        `json:"status"`
+	Checks []CheckResult `json:"checks"`
+}
+
+type readinessCheck struct {
+	name  string
+	check func(ctx context.Context) (status string, message string)
+}
+
+// cachedCheck runs check at most once every interval and answers with the
+// last result in between. Callers arriving while it runs wait for it.
+func cachedCheck(name string, interval time.Duration, check func(ctx context.Context) (string, string)) readinessCheck {
+	var mu sync.Mutex
+	var checked time.Time
+	var status, message string
+	var running chan struct{}
+	return readinessCheck{name, func(ctx context.Context) (string, string) {
+		mu.Lock()
+		if !checked.IsZero() && time.Since(checked) < interval {
+			defer mu.Unlock()
+			return status, message
+		}
+		if running == nil {
+			running = make(chan struct{})
+			go func(done chan struct{}) {
+				// Not the caller's context: one that gives up mustn't
+				// leave a failure for everyone after it.
+				ctx, cancel := context.WithTimeout(context.Background(), readinessTimeout)
+				defer cancel()
+				s, m := check(ctx)
+				mu.Lock()
+				status, message, checked, running = s, m, time.Now(), nil
+				mu.Unlock()
+				close(done)
+			}(running)
+		}
+		done := running
+		mu.Unlock()
+
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return CheckFail, "timed out"
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		return status, message
+	}}
+}
+
+// readinessChecks checks everything the server needs to work a door: the
+// relay's GPIO, the reed switch, the event store, the clock signatures are
+// checked against and the TLS certificate.
+func readinessChecks(c RouteConfig) []readinessCheck {
+	return []readinessCheck{
+		cachedCheck("gpio", checkInterval, func(ctx context.Context) (string, string) {
+			if c.CheckGPIO == nil {
+				return CheckSkipped, ""
+			}
+			if err := c.CheckGPIO(ctx); err != nil {
+				return CheckFail, err.Error()
+			}
+			return CheckOK, ""
+		}),
+		// Unsigned callers mustn't learn whether the door is open.
+		cachedCheck("sensor", checkInterval, func(ctx context.Context) (string, string) {
+			state, err := c.DoorStatus(ctx, c.StatusPin)
+			if err != nil {
+				return CheckFail, err.Error()
+			}
+			if state != "open" && state != "closed" {
+				return CheckFail, "unexpected reading"
+			}
+			return CheckOK, ""
+		}),
+		cachedCheck("events", checkInterval, func(context.Context) (string, string) {
+			if err := c.Store.CheckWritable(); err != nil {
+				return CheckFail, err.Error()
+			}
+			return CheckOK, ""
+		}),
+		{"clock", func(context.Context) (string, string) {
+			return checkClock(time.Now(), c.Store)
+		}},
+		{"tls", func(context.Context) (string, string) {
+			if c.Cert == "" {
+				return CheckSkipped, "serving plain HTTP"
+			}
+			return checkCertificate(time.Now(), c.Cert)
+		}},
+	}
+}
+
+// checkClock fails a clock that hasn't been set, or that is behind the last
+// event written.
+func checkClock(now time.Time, store *EventStore) (string, string) {
+	if now.Before(clockFloor) {
+		return CheckFail, fmt.Sprintf("clock reads %s; it has not been set", now.UTC().Format(time.RFC3339))
+	}
+	events, err := store.Query(func(HistoryEvent) bool { return true }, 1)
+	if err == nil && len(events) > 0 && events[0].Time.Sub(now) > time.Minute {
+		return CheckFail, fmt.Sprintf("clock reads %s, before the last event at %s", now.UTC().Format(time.RFC3339), events[0].Time.UTC().Format(time.RFC3339))
+	}
+	return CheckOK, ""
+}
+
+// checkCertificate fails a certificate that isn't valid now, and warns of
+// one that soon won't be.
+func checkCertificate(now time.Time, path string) (string, string) {
+	encoded, err := ioutil.ReadFile(path)
+	if err != nil {
+		return CheckFail, err.Error()
+	}
+	block, _ := pem.Decode(encoded)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return CheckFail, fmt.Sprintf("%s holds no certificate", path)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return CheckFail, err.Error()
+	}
+
+	expires := cert.NotAfter.UTC().Format(time.RFC3339)
+	switch {
+	case now.Before(cert.NotBefore):
+		return CheckFail, fmt.Sprintf("certificate is not valid until %s", cert.NotBefore.UTC().Format(time.RFC3339))
+	case now.After(cert.NotAfter):
+		return CheckFail, fmt.Sprintf("certificate expired at %s", expires)
+	case cert.NotAfter.Sub(now) < certificateWarning:
+		return CheckWarn, fmt.Sprintf("certificate expires at %s", expires)
+	}
+	return CheckOK, fmt.Sprintf("certificate expires at %s", expires)
+}
+
+// runCheck gives up on a check that takes longer than readinessTimeout, so
+// a wedged GPIO lock can't hang the monitor.
+func runCheck(ctx context.Context, check readinessCheck) CheckResult {
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+
+	start := time.Now()
+	result := CheckResult{Name: check.name}
+	done := make(chan struct{})
+	go func() {
+		status, message := check.check(ctx)
+		result.Status, result.Message = status, message
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return CheckResult{Name: check.name, Status: CheckFail, Message: "timed out", Duration: float64(readinessTimeout.Microseconds()) / 1000}
+	}
+	result.Duration = float64(time.Since(start).Microseconds()) / 1000
+	return result
+}
+
+// ReadinessHandler runs every check and answers 503 if any failed. Only a
+// signed request is told why: messages can name files and errors, and
+// monitors only need the status.
+func ReadinessHandler(checks []readinessCheck, logger *Logger) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := requestLogger(logger, req)
+		signed := authenticate(req) == nil
+		readiness := Readiness{Status: CheckOK}
+		for _, check := range checks {
+			result := runCheck(req.Context(), check)
+			if result.Status == CheckFail {
+				readiness.Status = CheckFail
+				log.Warn("Not ready", Field{"check", result.Name}, Field{"error", result.Message})
+			}
+			if !signed {
+				result.Message = ""
+			}
+			readiness.Checks = append(readiness.Checks, result)
+		}
+
+		message, err := json.Marshal(readiness)
+		if err != nil {
+			log.Error("Could not encode response", Field{"error", err})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if readiness.Status == CheckFail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		w.Write(message)
+	})
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func getReadiness(t *testing.T, router http.Handler) (int, Readiness) {
+	req, err := http.NewRequest("GET", "/readyz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, req)
+
+	var readiness Readiness
+	if err := json.Unmarshal(writer.Body.Bytes(), &readiness); err != nil {
+		t.Fatal(err)
+	}
+	return writer.Code, readiness
+}
+
+func checkStatuses(readiness Readiness) map[string]string {
+	statuses := map[string]string{}
+	for _, check := range readiness.Checks {
+		statuses[check.Name] = check.Status
+	}
+	return statuses
+}
+
+func writeTestCertificate(t *testing.T, notBefore time.Time, notAfter time.Time) string {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "garage.example.com"},
+		NotBefore:    notBefore,
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(t.TempDir(), "garage.cert")
+	if err := ioutil.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHealth(t *testing.T) {
+	req, err := http.NewRequest("GET", "/healthz", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := httptest.NewRecorder()
+	CreateTestRouter(t, false, "error", true).ServeHTTP(writer, req)
+	responseEqual(t, writer.Code, 200)
+	stringEqual(t, writer.Body.String(), "{\"status\":\"ok\"}\n")
+}
+
+func TestReadiness(t *testing.T) {
+	config := CreateTestRouteConfig(t, false, "closed", false)
+	config.Cert = writeTestCertificate(t, time.Now().Add(-time.Hour), time.Now().Add(90*24*time.Hour))
+
+	code, readiness := getReadiness(t, NewRouter(config))
+	responseEqual(t, code, 200)
+	stringEqual(t, readiness.Status, CheckOK)
+	numberEqual(t, len(readiness.Checks), 5)
+	for _, check := range readiness.Checks {
+		stringEqual(t, check.Status, CheckOK)
+	}
+	// Unsigned callers can't tell whether the door is open.
+	stringEqual(t, readiness.Checks[1].Message, "")
+}
+
+func TestReadinessCachesHardwareChecks(t *testing.T) {
+	config := CreateTestRouteConfig(t, false, "closed", false)
+	var mu sync.Mutex
+	reads := 0
+	config.DoorStatus = func(context.Context, int) (string, error) {
+		mu.Lock()
+		defer mu.Unlock()
+		reads++
+		return "closed", nil
+	}
+	router := NewRouter(config)
+
+	for i := 0; i < 3; i++ {
+		code, _ := getReadiness(t, router)
+		responseEqual(t, code, 200)
+	}
+	mu.Lock()
+	numberEqual(t, reads, 1)
+	mu.Unlock()
+}
+
+func TestReadinessFailures(t *testing.T) {
+	config := CreateTestRouteConfig(t, false, "error", true)
+	config.Cert = writeTestCertificate(t, time.Now().Add(-time.Hour), time.Now().Add(24*time.Hour))
+	os.Remove(config.Store.path)
+
+	code, readiness := getReadiness(t, NewRouter(config))
+	responseEqual(t, code, 503)
+	stringEqual(t, readiness.Status, CheckFail)
+	statuses := checkStatuses(readiness)
+	stringEqual(t, statuses["gpio"], CheckFail)
+	stringEqual(t, statuses["sensor"], CheckFail)
+	stringEqual(t, statuses["events"], CheckFail)
+	stringEqual(t, statuses["clock"], CheckOK)
+	// A certificate about to expire warns without failing.
+	stringEqual(t, statuses["tls"], CheckWarn)
+	// Unsigned callers aren't told why.
+	for _, check := range readiness.Checks {
+		stringEqual(t, check.Message, "")
+	}
+
+	writer := httptest.NewRecorder()
+	NewRouter(config).ServeHTTP(writer, signedRequest(t, "GET", "/readyz", SharedSecret))
+	responseEqual(t, writer.Code, 503)
+	json.Unmarshal(writer.Body.Bytes(), &readiness)
+	for _, check := range readiness.Checks {
+		if check.Message == "" && check.Name != "clock" {
+			t.Errorf("expected a signed request to be told why %s is %s", check.Name, check.Status)
+		}
+	}
+}
+
+func TestReadinessSkipsPlainHTTP(t *testing.T) {
+	config := CreateTestRouteConfig(t, false, "open", false)
+	config.CheckGPIO = nil
+
+	code, readiness := getReadiness(t, NewRouter(config))
+	responseEqual(t, code, 200)
+	statuses := checkStatuses(readiness)
+	stringEqual(t, statuses["gpio"], CheckSkipped)
+	stringEqual(t, statuses["tls"], CheckSkipped)
+}
+
+func TestCheckClock(t *testing.T) {
+	store := CreateTestStore(t)
+	now := time.Date(2026, 6, 1, 12, 0, 0, 0, time.UTC)
+
+	status, _ := checkClock(now, store)
+	stringEqual(t, status, CheckOK)
+
+	status, message := checkClock(time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), store)
+	stringEqual(t, status, CheckFail)
+	stringEqual(t, message, "clock reads 1970-01-01T00:00:00Z; it has not been set")
+
+	store.Append(HistoryEvent{Time: now.Add(time.Hour), Type: EventStateChanged, Door: "garage", Detail: "open"})
+	status, message = checkClock(now, store)
+	stringEqual(t, status, CheckFail)
+	stringEqual(t, message, "clock reads 2026-06-01T12:00:00Z, before the last event at 2026-06-01T13:00:00Z")
+}
+
+func TestCheckCertificate(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		notBefore time.Time
+		notAfter  time.Time
+		expected  string
+	}{
+		{now.Add(-time.Hour), now.Add(30 * 24 * time.Hour), CheckOK},
+		{now.Add(-time.Hour), now.Add(13 * 24 * time.Hour), CheckWarn},
+		{now.Add(-48 * time.Hour), now.Add(-24 * time.Hour), CheckFail},
+		{now.Add(time.Hour), now.Add(30 * 24 * time.Hour), CheckFail},
+	}
+	for i, test := range tests {
+		status, message := checkCertificate(now, writeTestCertificate(t, test.notBefore, test.notAfter))
+		if status != test.expected {
+			t.Errorf("%d: expected %s, got %s (%s)", i, test.expected, status, message)
+		}
+	}
+
+	status, _ := checkCertificate(now, filepath.Join(t.TempDir(), "missing.cert"))
+	stringEqual(t, status, CheckFail)
+}
+
+func TestRunCheckTimeout(t *testing.T) {
+	timeout := readinessTimeout
+	readinessTimeout = 10 * time.Millisecond
+	defer func() { readinessTimeout = timeout }()
+
+	result := runCheck(context.Background(), readinessCheck{"gpio", func(ctx context.Context) (string, string) {
+		time.Sleep(time.Second)
+		return CheckOK, ""
+	}})
+	stringEqual(t, result.Status, CheckFail)
+	stringEqual(t, result.Message, "timed out")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type historyContext struct {
+	store        *EventStore
+	door         string
+	logger       *Logger
+	authFailures *authFailures
+}
+
+const historyKey contextKey = "history"
+
+// HistoryHandler lets every handler below it record events with
+// recordEvent. With a nil store nothing is recorded.
+func HistoryHandler(store *EventStore, door string, logger *Logger, h http.Handler) http.Handler {
+	failures := &authFailures{pending: make(map[string]*HistoryEvent)}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if store != nil {
+			history := &historyContext{store: store, door: door, logger: logger, authFailures: failures}
+			req = req.WithContext(context.WithValue(req.Context(), historyKey, history))
+		}
+		h.ServeHTTP(w, req)
+	})
+}
+
+func sourceIP(req *http.Request) string {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return host
+}
+
+// recordEvent stores an event on behalf of req. The user is whatever the
+// client sent in the user header; it is not covered by the signature.
+func recordEvent(req *http.Request, eventType string, outcome string, detail string) {
+	history, ok := req.Context().Value(historyKey).(*historyContext)
+	if !ok {
+		return
+	}
+
+	_, err := history.store.Append(HistoryEvent{
+		Type:     eventType,
+		User:     strings.TrimSpace(req.Header.Get("user")),
+		Door:     history.door,
+		SourceIP: sourceIP(req),
+		Outcome:  outcome,
+		Detail:   detail,
+	})
+	if err != nil {
+		requestLogger(history.logger, req).Error("Could not record event", Field{"type", eventType}, Field{"error", err})
+	}
+}
+
+// authFailureWindow is how often auth failures from one address are
+// recorded.
+var authFailureWindow = time.Minute
+
+// authFailures records the first auth failure from an address as it
+// happens, then counts the rest into one event at the end of each window,
+// so a client hammering the server can't fill the store with them.
+type authFailures struct {
+	mu sync.Mutex
+	// pending holds the failures counted for each address in its current
+	// window, or nil if there are none yet.
+	pending map[string]*HistoryEvent
+}
+
+// recordAuthFailure stores an auth failure on behalf of req, or counts it
+// if one from the same address was stored within authFailureWindow.
+func recordAuthFailure(req *http.Request, err error) {
+	history, ok := req.Context().Value(historyKey).(*historyContext)
+	if !ok {
+		return
+	}
+	failures := history.authFailures
+	ip := sourceIP(req)
+
+	failures.mu.Lock()
+	if counted, open := failures.pending[ip]; open {
+		if counted == nil {
+			counted = &HistoryEvent{Type: EventAuthFailure, Door: history.door, SourceIP: ip, Outcome: OutcomeDenied}
+			failures.pending[ip] = counted
+		}
+		counted.User = strings.TrimSpace(req.Header.Get("user"))
+		counted.Detail = err.Error()
+		counted.Count++
+		failures.mu.Unlock()
+		return
+	}
+	failures.pending[ip] = nil
+	time.AfterFunc(authFailureWindow, func() { failures.flush(history, ip) })
+	failures.mu.Unlock()
+
+	recordEvent(req, EventAuthFailure, OutcomeDenied, err.Error())
+}
+
+// flush stores the failures counted from ip in the window just ended. If
+// there were any, another window starts.
+func (f *authFailures) flush(history *historyContext, ip string) {
+	f.mu.Lock()
+	counted := f.pending[ip]
+	if counted == nil {
+		delete(f.pending, ip)
+		f.mu.Unlock()
+		return
+	}
+	f.pending[ip] = nil
+	time.AfterFunc(authFailureWindow, func() { f.flush(history, ip) })
+	f.mu.Unlock()
+
+	if _, err := history.store.Append(*counted); err != nil {
+		history.logger.Error("Could not record event", Field{"type", EventAuthFailure}, Field{"error", err})
+	}
+}
+
+// RecordStateChanges stores every change watcher sees. It hooks the watcher
+// rather than subscribing to the hub, whose replay buffer a burst of log
+// records can push state events out of. Call it before the watcher runs.
+func RecordStateChanges(watcher *DoorWatcher, store *EventStore, door string, logger *Logger) {
+	watcher.OnChange(func(state DoorState) {
+		_, err := store.Append(HistoryEvent{Type: EventStateChanged, Door: door, Outcome: OutcomeSuccess, Detail: state.Status})
+		if err != nil {
+			logger.Error("Could not record event", Field{"type", EventStateChanged}, Field{"error", err})
+		}
+	})
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/brutella/hap"
+	"github.com/brutella/hap/accessory"
+	"github.com/brutella/hap/characteristic"
+	"github.com/brutella/hap/service"
+)
+
+// homeKitPinKey is where the setup code is kept in the pairing store, so it
+// stays the same across restarts.
+const homeKitPinKey = "garage-server.pin"
+
+// homeKitSettleTimeout is how long a door has to reach the state HomeKit
+// asked for before it is reported obstructed.
+var homeKitSettleTimeout = 30 * time.Second
+
+var validSetupCode = regexp.MustCompile(`^[0-9]{8}$`)
+
+// HomeKit refuses setup codes this easy to guess.
+var trivialSetupCodes = map[string]bool{
+	"00000000": true, "11111111": true, "22222222": true, "33333333": true,
+	"44444444": true, "55555555": true, "66666666": true, "77777777": true,
+	"88888888": true, "99999999": true, "12345678": true, "87654321": true,
+}
+
+// newSetupCode picks a random eight digit setup code HomeKit accepts.
+func newSetupCode() (string, error) {
+	for {
+		var b [4]byte
+		if _, err := rand.Read(b[:]); err != nil {
+			return "", err
+		}
+		code := fmt.Sprintf("%08d", binary.BigEndian.Uint32(b[:])%100000000)
+		if !trivialSetupCodes[code] {
+			return code, nil
+		}
+	}
+}
+
+// formatSetupCode formats a setup code the way the Home app asks for it.
+func formatSetupCode(code string) string {
+	return code[:3] + "-" + code[3:5] + "-" + code[5:]
+}
+
+// homeKitSetupCode reads the setup code from store, picking one on first
+// run.
+func homeKitSetupCode(store hap.Store) (string, error) {
+	if code, err := store.Get(homeKitPinKey); err == nil && validSetupCode.Match(code) && !trivialSetupCodes[string(code)] {
+		return string(code), nil
+	}
+	code, err := newSetupCode()
+	if err != nil {
+		return "", err
+	}
+	return code, store.Set(homeKitPinKey, []byte(code))
+}
+
+// homeKitTarget is the target state matching a reed switch status.
+func homeKitTarget(status string) int {
+	if status == "open" {
+		return characteristic.TargetDoorStateOpen
+	}
+	return characteristic.TargetDoorStateClosed
+}
+
+// homeKitDoorState maps the reed switch's status to HomeKit's current door
+// state. A door that hasn't reached its target yet is opening or closing.
+func homeKitDoorState(status string, target int) int {
+	switch {
+	case status == "open" && target == characteristic.TargetDoorStateClosed:
+		return characteristic.CurrentDoorStateClosing
+	case status == "open":
+		return characteristic.CurrentDoorStateOpen
+	case target == characteristic.TargetDoorStateOpen:
+		return characteristic.CurrentDoorStateOpening
+	}
+	return characteristic.CurrentDoorStateClosed
+}
+
+// HomeKitBridge serves the door as a HomeKit garage door opener over HAP.
+// Pairings are kept in a directory, so the door stays paired across
+// restarts.
+type HomeKitBridge struct {
+	route  RouteConfig
+	door   *service.GarageDoorOpener
+	server *hap.Server
+	pin    string
+
+	mu     sync.Mutex
+	settle *time.Timer
+}
+
+// NewHomeKitBridge serves the door c describes on addr, or a free port if
+// addr is empty, keeping pairings in dir.
+func NewHomeKitBridge(dir string, addr string, c RouteConfig) (*HomeKitBridge, error) {
+	store := hap.NewFsStore(dir)
+	pin, err := homeKitSetupCode(store)
+	if err != nil {
+		return nil, err
+	}
+
+	a := accessory.New(accessory.Info{
+		Name:         c.Door,
+		SerialNumber: mqttSlug(c.Door),
+		Manufacturer: "garage-server",
+		Model:        "Raspberry Pi",
+		Firmware:     Version,
+	}, accessory.TypeGarageDoorOpener)
+	door := service.NewGarageDoorOpener()
+	a.AddS(door.S)
+
+	server, err := hap.NewServer(store, a)
+	if err != nil {
+		return nil, err
+	}
+	server.Pin = pin
+	server.Addr = addr
+
+	b := &HomeKitBridge{route: c, door: door, server: server, pin: pin}
+	door.TargetDoorState.OnValueRemoteUpdate(b.setTarget)
+	return b, nil
+}
+
+// SetupCode is the code to pair with in the Home app.
+func (b *HomeKitBridge) SetupCode() string {
+	return formatSetupCode(b.pin)
+}
+
+// Run serves HAP and follows the door's state until ctx is done.
+func (b *HomeKitBridge) Run(ctx context.Context) error {
+	b.sync()
+	served := make(chan error, 1)
+	go func() { served <- b.server.ListenAndServe(ctx) }()
+
+	_, events := b.route.Hub.Subscribe("")
+	defer func() { b.route.Hub.Unsubscribe(events) }()
+	for {
+		select {
+		case err := <-served:
+			return err
+		case event, open := <-events:
+			if !open {
+				_, events = b.route.Hub.Subscribe("")
+				continue
+			}
+			if state, ok := event.Data.(DoorState); ok && event.Type == "state" {
+				b.setStatus(state.Status)
+			}
+		}
+	}
+}
+
+// setStatus follows a change the reed switch saw, whoever moved the door.
+func (b *HomeKitBridge) setStatus(status string) {
+	b.report(status, false)
+}
+
+// report shows the door at status, and whether something stopped it.
+func (b *HomeKitBridge) report(status string, obstructed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.settle != nil {
+		b.settle.Stop()
+		b.settle = nil
+	}
+	target := homeKitTarget(status)
+	b.door.TargetDoorState.SetValue(target)
+	b.door.CurrentDoorState.SetValue(homeKitDoorState(status, target))
+	b.door.ObstructionDetected.SetValue(obstructed)
+}
+
+// sync reads the reed switch and reports what it says.
+func (b *HomeKitBridge) sync() {
+	status, err := b.route.DoorStatus(context.Background(), b.route.StatusPin)
+	if err != nil {
+		b.route.Logger.Error("Could not read door status for HomeKit", Field{"error", err})
+		return
+	}
+	b.setStatus(status)
+}
+
+// setTarget runs the command a HomeKit controller sent by setting the
+// target state, with the same checks and history as /api/v2/open and
+// /api/v2/close.
+func (b *HomeKitBridge) setTarget(target int) {
+	command := "open"
+	if target == characteristic.TargetDoorStateClosed {
+		command = "close"
+	}
+
+	c := b.route
+	log := c.Logger.With(Field{"user", "homekit"})
+	record := recordCommandAs(c.Store, c.Door, "homekit", log)
+	result := runControlCommand(context.Background(), c.Control, record, controlCommand{Command: command}, c.DoorStatus, c.ToggleSwitch, log, c.PinNumber, c.StatusPin, c.SleepTimeout)
+	if !result.OK {
+		// Put the target back, so the Home app doesn't show the door
+		// moving.
+		b.sync()
+		return
+	}
+	log.Info("HomeKit command", Field{"command", command}, Field{"status", result.Status})
+	// Already there, as opposed to sent there or already on the way.
+	if result.Status == "already "+result.DoorStatus {
+		b.setStatus(result.DoorStatus)
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.door.TargetDoorState.SetValue(target)
+	b.door.CurrentDoorState.SetValue(homeKitDoorState(result.DoorStatus, target))
+	if b.settle != nil {
+		b.settle.Stop()
+	}
+	b.settle = time.AfterFunc(homeKitSettleTimeout, func() { b.settled(target) })
+}
+
+// settled checks a door that was told to move some time ago. If it didn't
+// get there, something stopped it: it is reported obstructed where it is.
+func (b *HomeKitBridge) settled(target int) {
+	status, err := b.route.DoorStatus(context.Background(), b.route.StatusPin)
+	if err != nil {
+		return
+	}
+	if homeKitTarget(status) == target {
+		b.setStatus(status)
+		return
+	}
+	b.route.Logger.Warn("Door did not reach the state HomeKit asked for", Field{"status", status})
+	b.report(status, true)
+}
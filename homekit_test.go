@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/brutella/hap/characteristic"
+)
+
+func TestSetupCode(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		code, err := newSetupCode()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !validSetupCode.MatchString(code) || trivialSetupCodes[code] {
+			t.Fatalf("invalid setup code %s", code)
+		}
+	}
+	stringEqual(t, formatSetupCode("03145154"), "031-45-154")
+}
+
+func TestHomeKitSetupCodePersists(t *testing.T) {
+	dir := t.TempDir()
+	config := CreateTestRouteConfig(t, false, "closed", false)
+
+	first, err := NewHomeKitBridge(dir, "", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := NewHomeKitBridge(dir, "", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stringEqual(t, second.SetupCode(), first.SetupCode())
+	numberEqual(t, len(first.SetupCode()), 10)
+}
+
+func TestHomeKitDoorState(t *testing.T) {
+	tests := []struct {
+		status   string
+		target   int
+		expected int
+	}{
+		{"open", characteristic.TargetDoorStateOpen, characteristic.CurrentDoorStateOpen},
+		{"closed", characteristic.TargetDoorStateClosed, characteristic.CurrentDoorStateClosed},
+		{"closed", characteristic.TargetDoorStateOpen, characteristic.CurrentDoorStateOpening},
+		{"open", characteristic.TargetDoorStateClosed, characteristic.CurrentDoorStateClosing},
+	}
+	for _, test := range tests {
+		if got := homeKitDoorState(test.status, test.target); got != test.expected {
+			t.Errorf("%s towards %d: expected %d, got %d", test.status, test.target, test.expected, got)
+		}
+	}
+}
+
+// homeKitTestDoor is a door whose reed switch reads status and whose relay
+// counts toggles.
+type homeKitTestDoor struct {
+	mu      sync.Mutex
+	status  string
+	toggles int
+	fail    bool
+}
+
+func (d *homeKitTestDoor) set(status string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status = status
+}
+
+func (d *homeKitTestDoor) toggled() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.toggles
+}
+
+func (d *homeKitTestDoor) configure(config *RouteConfig) {
+	config.DoorStatus = func(context.Context, int) (string, error) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		return d.status, nil
+	}
+	config.ToggleSwitch = func(context.Context, int, int) error {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if d.fail {
+			return errors.New("open /dev/mem: no such file or directory")
+		}
+		d.toggles++
+		return nil
+	}
+}
+
+func expectHomeKitState(t *testing.T, b *HomeKitBridge, current int, target int) {
+	t.Helper()
+	numberEqual(t, b.door.CurrentDoorState.Value(), current)
+	numberEqual(t, b.door.TargetDoorState.Value(), target)
+}
+
+func TestHomeKitCommands(t *testing.T) {
+	door := &homeKitTestDoor{status: "closed"}
+	config := CreateTestRouteConfig(t, false, "closed", false)
+	door.configure(&config)
+	b, err := NewHomeKitBridge(t.TempDir(), "", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.sync()
+	expectHomeKitState(t, b, characteristic.CurrentDoorStateClosed, characteristic.TargetDoorStateClosed)
+
+	b.setTarget(characteristic.TargetDoorStateOpen)
+	expectHomeKitState(t, b, characteristic.CurrentDoorStateOpening, characteristic.TargetDoorStateOpen)
+	numberEqual(t, door.toggled(), 1)
+	events, err := config.Store.Query(func(event HistoryEvent) bool { return event.User == "homekit" }, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, len(events), 1)
+	stringEqual(t, events[0].Detail+" "+events[0].Outcome, "open success")
+
+	// The reed switch sees the door open.
+	door.set("open")
+	b.setStatus("open")
+	expectHomeKitState(t, b, characteristic.CurrentDoorStateOpen, characteristic.TargetDoorStateOpen)
+
+	// Opening an open door doesn't pulse the relay.
+	b.setTarget(characteristic.TargetDoorStateOpen)
+	numberEqual(t, door.toggled(), 1)
+
+	// Someone closes it with the remote.
+	b.setStatus("closed")
+	expectHomeKitState(t, b, characteristic.CurrentDoorStateClosed, characteristic.TargetDoorStateClosed)
+}
+
+func TestHomeKitRelayFailure(t *testing.T) {
+	door := &homeKitTestDoor{status: "open", fail: true}
+	config := CreateTestRouteConfig(t, false, "open", false)
+	door.configure(&config)
+	b, err := NewHomeKitBridge(t.TempDir(), "", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.sync()
+
+	b.setTarget(characteristic.TargetDoorStateClosed)
+	expectHomeKitState(t, b, characteristic.CurrentDoorStateOpen, characteristic.TargetDoorStateOpen)
+	events, err := config.Store.Query(func(event HistoryEvent) bool { return event.User == "homekit" }, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stringEqual(t, events[0].Outcome, OutcomeFailure)
+}
+
+func TestHomeKitObstruction(t *testing.T) {
+	timeout := homeKitSettleTimeout
+	homeKitSettleTimeout = 10 * time.Millisecond
+	defer func() { homeKitSettleTimeout = timeout }()
+
+	door := &homeKitTestDoor{status: "open"}
+	config := CreateTestRouteConfig(t, false, "open", false)
+	door.configure(&config)
+	b, err := NewHomeKitBridge(t.TempDir(), "", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.sync()
+
+	// The door reverses and never closes.
+	b.setTarget(characteristic.TargetDoorStateClosed)
+	expectHomeKitState(t, b, characteristic.CurrentDoorStateClosing, characteristic.TargetDoorStateClosed)
+	deadline := time.Now().Add(time.Second)
+	for !b.door.ObstructionDetected.Value() {
+		if time.Now().After(deadline) {
+			t.Fatal("expected the door to be reported obstructed")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	expectHomeKitState(t, b, characteristic.CurrentDoorStateOpen, characteristic.TargetDoorStateOpen)
+
+	b.setStatus("closed")
+	if b.door.ObstructionDetected.Value() {
+		t.Error("expected the obstruction to clear once the door moved")
+	}
+}
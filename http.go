@@ -1,75 +1,131 @@
 package main
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
-	"os"
 	"strconv"
 	"time"
 )
 
-func apiLogHandler(event string) {
-	fmt.Fprintln(os.Stderr, event, "-", time.Now())
-}
-
-func VersionHandler(logger func(string)) http.HandlerFunc {
+func VersionHandler(info ServerInfo, logger *Logger) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		logger("Version")
-		var jsonResp struct {
-			Text string `json:"version"`
-		}
-		jsonResp.Text = Version
-		message, err := json.Marshal(jsonResp)
+		log := requestLogger(logger, req)
+		log.Info("Version")
+		info.Uptime = int64(time.Since(startTime).Seconds())
+		message, err := json.Marshal(info)
 		if err != nil {
-			logger(fmt.Sprintf("%s", err))
+			log.Error("Could not encode response", Field{"error", err})
 		}
+		w.Header().Set("Content-Type", "application/json")
 		w.Write(message)
 	})
 }
 
-func CreateVersionHandler(logger func(string)) http.HandlerFunc {
-	return AuthenticatedHandler(VersionHandler(logger))
+func CreateVersionHandler(info ServerInfo, logger *Logger) http.HandlerFunc {
+	return AuthenticatedHandler(VersionHandler(info, logger))
+}
+
+// maxStatusWait caps how long a long-polling /status request is held open.
+const maxStatusWait = 60 * time.Second
+
+func parseStatusWait(wait string) (time.Duration, error) {
+	if seconds, err := strconv.Atoi(wait); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(wait)
+}
+
+// readDoorStatus reads the sensor, or long-polls the watcher when the request
+// has wait or since parameters.
+func readDoorStatus(req *http.Request, doorStatus func(context.Context, int) (string, error), statusPin int, watcher *DoorWatcher) (string, *uint64, *APIError) {
+	query := req.URL.Query()
+	if watcher != nil && (query.Get("wait") != "" || query.Get("since") != "") {
+		var wait time.Duration
+		if query.Get("wait") != "" {
+			var err error
+			wait, err = parseStatusWait(query.Get("wait"))
+			if err != nil || wait < 0 {
+				return "", nil, &APIError{Status: 400, Code: "invalid_wait", Message: fmt.Sprintf("Invalid wait '%s'", query.Get("wait"))}
+			}
+			if wait > maxStatusWait {
+				wait = maxStatusWait
+			}
+		}
+
+		_, since := watcher.State()
+		if query.Get("since") != "" {
+			var err error
+			since, err = strconv.ParseUint(query.Get("since"), 10, 64)
+			if err != nil {
+				return "", nil, &APIError{Status: 400, Code: "invalid_since", Message: fmt.Sprintf("Invalid since '%s'", query.Get("since"))}
+			}
+		}
+
+		status, version := watcher.Wait(since, wait, req.Context().Done())
+		if status != "" {
+			return status, &version, nil
+		}
+		// The watcher hasn't read the sensor yet, so fall through to a
+		// direct read.
+	}
+
+	status, err := doorStatus(req.Context(), statusPin)
+	if err != nil {
+		return "", nil, &APIError{Status: 422, Code: "sensor_unavailable", Message: fmt.Sprintf("Could not read pin '%d' on Raspberry Pi", statusPin)}
+	}
+
+	if watcher != nil {
+		_, version := watcher.State()
+		return status, &version, nil
+	}
+	return status, nil, nil
 }
 
-func DoorStatusHandler(doorStatus func(int) (string, error), logger func(string), statusPin int) http.HandlerFunc {
+func DoorStatusHandler(doorStatus func(context.Context, int) (string, error), logger *Logger, statusPin int, watcher *DoorWatcher) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
 		var jsonResp struct {
-			Text string `json:"doorStatus"`
+			Text    string  `json:"doorStatus"`
+			Version *uint64 `json:"version,omitempty"`
 		}
 
-		status, err := doorStatus(statusPin)
-		if err != nil {
-			errMessage := fmt.Sprintf("Could not read pin '%d' on Raspberry Pi", statusPin)
-			logger(errMessage)
-			jsonResp.Text = errMessage
-			w.WriteHeader(422)
+		log := requestLogger(logger, req)
+		status, version, apiErr := readDoorStatus(req, doorStatus, statusPin, watcher)
+		if apiErr != nil {
+			logAPIError(log, apiErr)
+			status = apiErr.Message
+			w.WriteHeader(apiErr.Status)
 		}
 
 		jsonResp.Text = status
+		jsonResp.Version = version
 		message, err := json.Marshal(jsonResp)
 		if err != nil {
-			logger(fmt.Sprintf("%s", err))
+			log.Error("Could not encode response", Field{"error", err})
 		}
 		w.Write(message)
 	})
 }
 
-func CreateDoorStatusHandler(doorStatus func(int) (string, error), logger func(string), statusPin int) http.HandlerFunc {
-	return AuthenticatedHandler(DoorStatusHandler(doorStatus, logger, statusPin))
+func CreateDoorStatusHandler(doorStatus func(context.Context, int) (string, error), logger *Logger, statusPin int, watcher *DoorWatcher) http.HandlerFunc {
+	return AuthenticatedHandler(DoorStatusHandler(doorStatus, logger, statusPin, watcher))
 }
 
-func RelayHandle(toggleSwitch func(int, int) error, logger func(string), pinNumber int, sleepTimeout int) http.HandlerFunc {
+func RelayHandle(toggleSwitch func(context.Context, int, int) error, logger *Logger, pinNumber int, sleepTimeout int) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger("TOGGLE DOOR")
-		err := toggleSwitch(pinNumber, sleepTimeout)
+		log := requestLogger(logger, r)
+		log.Info("TOGGLE DOOR")
+		err := toggleSwitch(r.Context(), pinNumber, sleepTimeout)
 		if err != nil {
-			errMessage := "Could not write to pin"
-			logger(errMessage)
+			log.Error("Could not write to pin", Field{"pin", pinNumber}, Field{"error", err})
+			recordEvent(r, EventCommandIssued, OutcomeFailure, "toggle")
 			w.WriteHeader(500)
 			return
 		}
+		recordEvent(r, EventCommandIssued, OutcomeSuccess, "toggle")
 
 		var resp struct {
 			Status string `json:"status"`
@@ -77,57 +133,100 @@ func RelayHandle(toggleSwitch func(int, int) error, logger func(string), pinNumb
 		resp.Status = "signal received"
 		message, err := json.Marshal(resp)
 		if err != nil {
-			logger(fmt.Sprintf("%s", err))
+			log.Error("Could not encode response", Field{"error", err})
 		}
 		w.Write(message)
 	})
 }
 
-func CreateRelayHandle(toggleSwitch func(int, int) error, logger func(string), pinNumber int, sleepTimeout int) http.HandlerFunc {
+func CreateRelayHandle(toggleSwitch func(context.Context, int, int) error, logger *Logger, pinNumber int, sleepTimeout int) http.HandlerFunc {
 	return AuthenticatedHandler(RelayHandle(toggleSwitch, logger, pinNumber, sleepTimeout))
 }
 
-func LogsHandler(logger func(string), logFile string) http.HandlerFunc {
+func LogsHandler(logger *Logger, store *EventStore) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		logger("Logs")
-		logs := ParseLogs(logFile)
+		log := requestLogger(logger, req)
+		log.Info("Logs")
+		logs, apiErr := queryLogs(store, req)
+		if apiErr != nil {
+			logAPIError(log, apiErr)
+			writeAPIError(w, req, apiErr)
+			return
+		}
 		entries, err := json.Marshal(logs)
 		if err != nil {
-			logger(fmt.Sprintf("%s", err))
+			log.Error("Could not encode response", Field{"error", err})
 		}
 		w.Write(entries)
 	})
 }
 
-func CreateLogsHandler(logger func(string), logFile string) http.HandlerFunc {
-	return AuthenticatedHandler(LogsHandler(logger, logFile))
+func CreateLogsHandler(logger *Logger, store *EventStore) http.HandlerFunc {
+	return AuthenticatedHandler(LogsHandler(logger, store))
 }
 
-func AuthenticatedHandler(f http.HandlerFunc) http.HandlerFunc {
+func StatsHandler(logger *Logger, store *EventStore) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
-		signature := req.Header.Get("signature")
-		timestamp := req.Header.Get("timestamp")
-		decodedSignature, err := base64.URLEncoding.DecodeString(signature)
-		if err != nil {
-			w.WriteHeader(http.StatusForbidden)
+		log := requestLogger(logger, req)
+		log.Info("Stats")
+		stats, apiErr := queryStats(store, req)
+		if apiErr != nil {
+			logAPIError(log, apiErr)
+			writeAPIError(w, req, apiErr)
 			return
 		}
+		body, err := json.Marshal(stats)
+		if err != nil {
+			log.Error("Could not encode response", Field{"error", err})
+		}
+		w.Write(body)
+	})
+}
 
-		verified := VerifySignature([]byte(timestamp), decodedSignature)
-		if verified {
-			// Verify time
-			i, err := strconv.ParseInt(timestamp, 10, 64)
-			if err != nil {
-				w.WriteHeader(http.StatusForbidden)
-				return
-			}
+func CreateStatsHandler(logger *Logger, store *EventStore) http.HandlerFunc {
+	return AuthenticatedHandler(StatsHandler(logger, store))
+}
 
-			_, err = VerifyTime(i)
-			if err != nil {
-				w.WriteHeader(http.StatusForbidden)
-				return
-			}
-		} else {
+var (
+	errMalformedSignature = errors.New("Signature is not base64 encoded")
+	errInvalidSignature   = errors.New("Signature does not match")
+	errInvalidTimestamp   = errors.New("Timestamp is not a unix time")
+	errExpiredTimestamp   = errors.New("Timestamp is too far in the past")
+)
+
+// authenticate checks the signature and timestamp headers and reports why a
+// request was rejected.
+func authenticate(req *http.Request) error {
+	signature := req.Header.Get("signature")
+	timestamp := req.Header.Get("timestamp")
+	decodedSignature, err := base64.URLEncoding.DecodeString(signature)
+	if err != nil {
+		return errMalformedSignature
+	}
+
+	if !VerifySignature([]byte(timestamp), decodedSignature) {
+		return errInvalidSignature
+	}
+
+	// Verify time
+	i, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return errInvalidTimestamp
+	}
+
+	_, err = VerifyTime(i)
+	if err != nil {
+		return errExpiredTimestamp
+	}
+
+	return nil
+}
+
+func AuthenticatedHandler(f http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if err := traced(req.Context(), "authenticate", func() error { return authenticate(req) }); err != nil {
+			recordAuthFailure(req, err)
+			countAuthFailure(req, err)
 			w.WriteHeader(http.StatusForbidden)
 			return
 		}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"crypto/hmac"
 	"crypto/sha512"
 	"encoding/base64"
@@ -9,10 +10,8 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/http/httptest"
-	"os"
 	"testing"
 	"time"
 )
@@ -35,8 +34,8 @@ func numberEqual(t *testing.T, a int, b int) {
 	}
 }
 
-func CreateDummyStatus(state string) func(int) (string, error) {
-	return func(i int) (s string, e error) {
+func CreateDummyStatus(state string) func(context.Context, int) (string, error) {
+	return func(ctx context.Context, i int) (s string, e error) {
 		if state == "error" {
 			e = errors.New("unprocessable entity")
 		}
@@ -44,8 +43,8 @@ func CreateDummyStatus(state string) func(int) (string, error) {
 	}
 }
 
-func CreateDummyRelay(bad bool) func(int, int) error {
-	return func(i int, ii int) (e error) {
+func CreateDummyRelay(bad bool) func(context.Context, int, int) error {
+	return func(ctx context.Context, i int, ii int) (e error) {
 		if bad {
 			e = errors.New("open /dev/mem: no such file or directory")
 		}
@@ -53,6 +52,15 @@ func CreateDummyRelay(bad bool) func(int, int) error {
 	}
 }
 
+func CreateDummyGPIOCheck(bad bool) func(context.Context) error {
+	return func(context.Context) error {
+		if bad {
+			return errors.New("open /dev/mem: permission denied")
+		}
+		return nil
+	}
+}
+
 func CreateSignature(body []byte, secret string) string {
 	mac := hmac.New(sha512.New, []byte(secret))
 	mac.Write(body)
@@ -65,7 +73,7 @@ func CreateTimestamp(offset int64) string {
 	return fmt.Sprintf("%d", validTime)
 }
 
-func DummyLogger(s string) {}
+var DummyLogger = NewTextLogger(ioutil.Discard, LevelDebug)
 
 func TestVersion(t *testing.T) {
 	writer := httptest.NewRecorder()
@@ -78,7 +86,7 @@ func TestVersion(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	AppVersion := CreateVersionHandler(DummyLogger)
+	AppVersion := CreateVersionHandler(serverInfo(RouteConfig{Door: "garage"}), DummyLogger)
 	AppVersion(writer, req)
 	responseEqual(t, writer.Code, 200)
 
@@ -104,7 +112,7 @@ func TestUnverifiedSignatureOnVersion(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	AppVersion := CreateVersionHandler(DummyLogger)
+	AppVersion := CreateVersionHandler(serverInfo(RouteConfig{Door: "garage"}), DummyLogger)
 	AppVersion(writer, req)
 	responseEqual(t, writer.Code, 403)
 }
@@ -120,7 +128,7 @@ func TestExpiredTimestampOnVersion(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	AppVersion := CreateVersionHandler(DummyLogger)
+	AppVersion := CreateVersionHandler(serverInfo(RouteConfig{Door: "garage"}), DummyLogger)
 	AppVersion(writer, req)
 	responseEqual(t, writer.Code, 403)
 }
@@ -136,7 +144,7 @@ func TestOpenOnStatus(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	Status := CreateDoorStatusHandler(CreateDummyStatus("open"), DummyLogger, 0)
+	Status := CreateDoorStatusHandler(CreateDummyStatus("open"), DummyLogger, 0, nil)
 	Status(writer, req)
 
 	responseEqual(t, writer.Code, 200)
@@ -162,7 +170,7 @@ func TestClosedOnStatus(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	Status := CreateDoorStatusHandler(CreateDummyStatus("closed"), DummyLogger, 0)
+	Status := CreateDoorStatusHandler(CreateDummyStatus("closed"), DummyLogger, 0, nil)
 	Status(writer, req)
 
 	responseEqual(t, writer.Code, 200)
@@ -189,10 +197,11 @@ func TestErrorOnStatus(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	Status := CreateDoorStatusHandler(CreateDummyStatus("error"), DummyLogger, 0)
+	Status := CreateDoorStatusHandler(CreateDummyStatus("error"), DummyLogger, 0, nil)
 	Status(writer, req)
 
 	responseEqual(t, writer.Code, 422)
+	stringEqual(t, writer.Body.String(), `{"doorStatus":"Could not read pin '0' on Raspberry Pi"}`)
 }
 
 func TestExpiredTimestampOnStatus(t *testing.T) {
@@ -206,7 +215,7 @@ func TestExpiredTimestampOnStatus(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	Status := CreateDoorStatusHandler(CreateDummyStatus("open"), DummyLogger, 0)
+	Status := CreateDoorStatusHandler(CreateDummyStatus("open"), DummyLogger, 0, nil)
 	Status(writer, req)
 	responseEqual(t, writer.Code, 403)
 }
@@ -222,12 +231,92 @@ func TestUnverifiedSignatureOnStatus(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	Status := CreateDoorStatusHandler(CreateDummyStatus("error"), DummyLogger, 0)
+	Status := CreateDoorStatusHandler(CreateDummyStatus("error"), DummyLogger, 0, nil)
 	Status(writer, req)
 
 	responseEqual(t, writer.Code, 403)
 }
 
+func statusRequest(t *testing.T, url string) *http.Request {
+	validTimestamp := CreateTimestamp(0)
+	req, err := http.NewRequest("GET", url, nil)
+	req.Header.Add("signature", CreateSignature([]byte(validTimestamp), SharedSecret))
+	req.Header.Add("timestamp", validTimestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return req
+}
+
+func TestLongPollOnStatus(t *testing.T) {
+	writer := httptest.NewRecorder()
+	state := "closed"
+	watcher := NewDoorWatcher(func(context.Context, int) (string, error) { return state, nil }, DummyLogger, 0, NewEventHub(10))
+	watcher.Poll()
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		state = "open"
+		watcher.Poll()
+	}()
+
+	Status := CreateDoorStatusHandler(CreateDummyStatus("closed"), DummyLogger, 0, watcher)
+	Status(writer, statusRequest(t, "/status?wait=5s&since=1"))
+	responseEqual(t, writer.Code, 200)
+
+	var resp struct {
+		Status  string `json:"doorStatus"`
+		Version uint64 `json:"version"`
+	}
+	decoder := json.NewDecoder(writer.Body)
+	if err := decoder.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	stringEqual(t, resp.Status, "open")
+	numberEqual(t, int(resp.Version), 2)
+}
+
+func TestLongPollTimeoutOnStatus(t *testing.T) {
+	writer := httptest.NewRecorder()
+	watcher := NewDoorWatcher(CreateDummyStatus("closed"), DummyLogger, 0, NewEventHub(10))
+	watcher.Poll()
+
+	Status := CreateDoorStatusHandler(CreateDummyStatus("closed"), DummyLogger, 0, watcher)
+	Status(writer, statusRequest(t, "/status?wait=10ms"))
+	responseEqual(t, writer.Code, 200)
+
+	var resp struct {
+		Status  string `json:"doorStatus"`
+		Version uint64 `json:"version"`
+	}
+	decoder := json.NewDecoder(writer.Body)
+	if err := decoder.Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	stringEqual(t, resp.Status, "closed")
+	numberEqual(t, int(resp.Version), 1)
+}
+
+func TestStaleVersionOnStatus(t *testing.T) {
+	writer := httptest.NewRecorder()
+	watcher := NewDoorWatcher(CreateDummyStatus("open"), DummyLogger, 0, NewEventHub(10))
+	watcher.Poll()
+
+	Status := CreateDoorStatusHandler(CreateDummyStatus("open"), DummyLogger, 0, watcher)
+	Status(writer, statusRequest(t, "/status?wait=30s&since=0"))
+	responseEqual(t, writer.Code, 200)
+	stringEqual(t, writer.Body.String(), `{"doorStatus":"open","version":1}`)
+}
+
+func TestInvalidWaitOnStatus(t *testing.T) {
+	writer := httptest.NewRecorder()
+	watcher := NewDoorWatcher(CreateDummyStatus("open"), DummyLogger, 0, NewEventHub(10))
+
+	Status := CreateDoorStatusHandler(CreateDummyStatus("open"), DummyLogger, 0, watcher)
+	Status(writer, statusRequest(t, "/status?wait=soon"))
+	responseEqual(t, writer.Code, 400)
+}
+
 func TestSuccessfulToggleRelay(t *testing.T) {
 	writer := httptest.NewRecorder()
 	validTimestamp := CreateTimestamp(0)
@@ -318,29 +407,28 @@ func TestLogs(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	file := `Version - 2016-04-26 22:42:43.254676358 -0500 CDT
-TOGGLE DOOR - 2016-05-24 17:07:43.384659988 -0500 CDT
-Could not read pin '10' on Raspberry Pi - 2016-05-26 22:42:44.713070359 -0500 CDT
-TOGGLE DOOR - 2016-05-25 9:03:43.384659988 -0500 CDT
-Version - 2016-05-26 22:43:15.450148727 -0500 CDT
-TOGGLE DOOR - 2016-05-26 23:03:43.384659988 -0500 CDT`
-
-	content := []byte(file)
-	tmpfile, err := ioutil.TempFile("", "test_log_file")
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	defer os.Remove(tmpfile.Name())
-
-	if _, err := tmpfile.Write(content); err != nil {
-		log.Fatal(err)
-	}
-	if err := tmpfile.Close(); err != nil {
-		log.Fatal(err)
+	store := CreateTestStore(t)
+	at := func(s string) time.Time {
+		parsed, err := time.ParseInLocation("2006-01-02 15:04", s, time.Local)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return parsed
+	}
+	events := []HistoryEvent{
+		{Time: at("2016-05-24 17:07"), Type: EventCommandIssued, Outcome: OutcomeSuccess, Detail: "toggle"},
+		{Time: at("2016-05-26 22:42"), Type: EventAuthFailure, Outcome: OutcomeDenied, Detail: "Signature does not match"},
+		{Time: at("2016-05-25 09:03"), Type: EventCommandIssued, Outcome: OutcomeSuccess, Detail: "toggle"},
+		{Time: at("2016-05-26 22:50"), Type: EventStateChanged, Outcome: OutcomeSuccess, Detail: "open"},
+		{Time: at("2016-05-26 23:03"), Type: EventCommandIssued, User: "dillon", Outcome: OutcomeSuccess, Detail: "toggle"},
+	}
+	for _, event := range events {
+		if _, err := store.Append(event); err != nil {
+			t.Fatal(err)
+		}
 	}
 
-	AppVersion := CreateLogsHandler(DummyLogger, tmpfile.Name())
+	AppVersion := CreateLogsHandler(DummyLogger, store)
 	AppVersion(writer, req)
 	responseEqual(t, writer.Code, 200)
 
@@ -354,6 +442,7 @@ TOGGLE DOOR - 2016-05-26 23:03:43.384659988 -0500 CDT`
 	stringEqual(t, logs.Entries[0].Date, "Thu May 26 2016")
 	stringEqual(t, logs.Entries[0].Time, "11:03 PM")
 	stringEqual(t, logs.Entries[0].Type, "Toggle")
+	stringEqual(t, logs.Entries[0].User, "dillon")
 }
 
 func TestUnverifiedSignatureOnLogs(t *testing.T) {
@@ -367,7 +456,7 @@ func TestUnverifiedSignatureOnLogs(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	AppVersion := CreateLogsHandler(DummyLogger, "file")
+	AppVersion := CreateLogsHandler(DummyLogger, nil)
 	AppVersion(writer, req)
 	responseEqual(t, writer.Code, 403)
 }
@@ -383,7 +472,7 @@ func TestExpiredTimestampOnLogs(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	AppVersion := CreateLogsHandler(DummyLogger, "file")
+	AppVersion := CreateLogsHandler(DummyLogger, nil)
 	AppVersion(writer, req)
 	responseEqual(t, writer.Code, 403)
 }
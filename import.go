@@ -0,0 +1,121 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+)
+
+func importKey(event HistoryEvent) string {
+	return fmt.Sprintf("%d|%s|%s", event.Time.UnixNano(), event.Type, event.Detail)
+}
+
+type ImportResult struct {
+	Imported   int
+	Duplicates int
+	Malformed  []string
+}
+
+// ImportLegacyLogs copies every event in a text log and its rotated
+// segments into store, merged in among the events already there by time.
+// Events already imported from an earlier run are skipped, and malformed
+// lines are reported rather than aborting the import.
+func ImportLegacyLogs(store *EventStore, logFile string) (ImportResult, error) {
+	var result ImportResult
+
+	seen := make(map[string]bool)
+	existing, err := store.Query(func(event HistoryEvent) bool {
+		return event.Source == SourceImport
+	}, 0)
+	if err != nil {
+		return result, err
+	}
+	for _, event := range existing {
+		seen[importKey(event)] = true
+	}
+
+	segments, err := logSegments(logFile)
+	if err != nil {
+		return result, err
+	}
+	var imported []HistoryEvent
+	for _, segment := range segments {
+		events, malformed, err := parseLegacySegment(segment)
+		for _, lineErr := range malformed {
+			result.Malformed = append(result.Malformed, lineErr.Error())
+		}
+		if os.IsNotExist(err) && segment != logFile {
+			// Pruned since it was listed.
+			continue
+		}
+		if err != nil {
+			return result, err
+		}
+
+		for _, event := range events {
+			event.Source = SourceImport
+			key := importKey(event)
+			if seen[key] {
+				result.Duplicates++
+				continue
+			}
+			imported = append(imported, event)
+			seen[key] = true
+		}
+	}
+	if err := store.Merge(imported); err != nil {
+		return result, err
+	}
+	result.Imported = len(imported)
+	return result, nil
+}
+
+// parseLegacySegment reads the old format lines in one segment of a log.
+// Lines in the structured formats were written alongside the event store,
+// so they are skipped.
+func parseLegacySegment(path string) ([]HistoryEvent, []*LogLineError, error) {
+	file, err := openLogSegment(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	return parseServerLog(file, path, true)
+}
+
+// runImportLogs implements `garage-server import-logs [-events path] [-audit-key path] <file>`.
+func runImportLogs(args []string) int {
+	importFlags := flag.NewFlagSet("import-logs", flag.ExitOnError)
+	importFlags.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage:  %s import-logs [options] <file>\n", os.Args[0])
+		importFlags.PrintDefaults()
+	}
+	importFlags.StringVar(&options.events, "events", defaultEventStore, "Path of the event store to import into")
+	importFlags.StringVar(&options.auditKey, "audit-key", "", "Path of the server's audit key (default: the event store's path with .key appended)")
+	importFlags.Parse(args)
+	if importFlags.NArg() != 1 {
+		importFlags.Usage()
+		return 2
+	}
+	logFile := importFlags.Arg(0)
+
+	store, err := openEventStore(options.events)
+	if err == ErrStoreInUse {
+		fmt.Fprintf(os.Stderr, "Could not open event store: %s; stop it before importing\n", err)
+		return 1
+	} else if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not open event store:", err)
+		return 1
+	}
+	defer store.Close()
+
+	result, err := ImportLegacyLogs(store, logFile)
+	for _, malformed := range result.Malformed {
+		fmt.Fprintln(os.Stderr, "Skipped", malformed)
+	}
+	fmt.Fprintf(os.Stderr, "Imported %d events (%d already imported, %d malformed lines skipped)\n", result.Imported, result.Duplicates, len(result.Malformed))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const legacyLogFixture = `Version - 2016-04-26 22:42:43.254676358 -0500 CDT
+TOGGLE DOOR - 2016-05-24 17:07:43.384659988 -0500 CDT
+Could not read pin '10' on Raspberry Pi - 2016-05-26 22:42:44.713070359 -0500 CDT
+TOGGLE DOOR - 2016-05-25 9:03:43.384659988 -0500 CDT
+TOGGLE DOOR
+Logs - yesterday
+TOGGLE DOOR - 2017-02-26 10:01:02.5 -0600 CST m=+3600.000000001
+Could not write to pin - 2017-02-26 10:01:02.6 -0600 CST m=+3600.100000001
+
+Invalid wait 'soon' - 2017-02-27 08:00:00.000000001 -0600 CST`
+
+// writeLegacyLog writes contents to a log file and returns its path.
+func writeLegacyLog(t *testing.T, contents string) string {
+	path := filepath.Join(t.TempDir(), "garage-server.log")
+	if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestImportLegacyLogs(t *testing.T) {
+	store := CreateTestStore(t)
+	logFile := writeLegacyLog(t, legacyLogFixture)
+
+	result, err := ImportLegacyLogs(store, logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, result.Imported, 6)
+	numberEqual(t, result.Duplicates, 0)
+	numberEqual(t, len(result.Malformed), 2)
+	stringEqual(t, result.Malformed[0], logFile+":5: missing ' - ' separator")
+	stringEqual(t, result.Malformed[1], logFile+":6: bad timestamp 'yesterday'")
+
+	events, err := store.Query(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, len(events), 6)
+
+	stringEqual(t, events[0].Type, EventMessage)
+	stringEqual(t, events[0].Detail, "Invalid wait 'soon'")
+
+	stringEqual(t, events[1].Type, EventCommandIssued)
+	stringEqual(t, events[1].Outcome, OutcomeFailure)
+	stringEqual(t, events[1].Time.Format("2006-01-02 15:04:05.0 -0700"), "2017-02-26 10:01:02.5 -0600")
+
+	stringEqual(t, events[2].Type, EventError)
+	stringEqual(t, events[3].Time.Format("15:04"), "09:03")
+	stringEqual(t, events[4].Outcome, OutcomeSuccess)
+	stringEqual(t, events[5].Type, EventRequest)
+	stringEqual(t, events[5].Detail, "version")
+	stringEqual(t, events[5].Source, SourceImport)
+}
+
+func TestImportLegacyLogsTwice(t *testing.T) {
+	store := CreateTestStore(t)
+	ImportLegacyLogs(store, writeLegacyLog(t, legacyLogFixture))
+
+	more := legacyLogFixture + "\nTOGGLE DOOR - 2017-03-01 07:30:00.123456789 -0600 CST"
+	result, err := ImportLegacyLogs(store, writeLegacyLog(t, more))
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, result.Imported, 1)
+	numberEqual(t, result.Duplicates, 6)
+
+	events, _ := store.Query(nil, 0)
+	numberEqual(t, len(events), 7)
+}
+
+func TestImportLegacyLogsByTime(t *testing.T) {
+	store := CreateTestStore(t)
+	store.Append(HistoryEvent{Time: time.Date(2016, 5, 25, 0, 0, 0, 0, time.UTC), Type: EventStateChanged, Outcome: OutcomeSuccess, Detail: "open"})
+	store.Append(HistoryEvent{Type: EventCommandIssued, User: "dillon", Outcome: OutcomeSuccess, Detail: "toggle"})
+
+	if _, err := ImportLegacyLogs(store, writeLegacyLog(t, legacyLogFixture)); err != nil {
+		t.Fatal(err)
+	}
+	events, _ := store.Query(nil, 0)
+	numberEqual(t, len(events), 8)
+	numberEqual(t, int(events[0].ID), 8)
+	stringEqual(t, events[0].User, "dillon")
+	stringEqual(t, events[5].Type, EventStateChanged)
+	numberEqual(t, int(events[5].ID), 3)
+	for i := 1; i < len(events); i++ {
+		if events[i].Time.After(events[i-1].Time) {
+			t.Errorf("event %d is newer than event %d", events[i].ID, events[i-1].ID)
+		}
+	}
+	if report, _ := VerifyAudit(store.path, testAuditKey); !report.Verified {
+		t.Errorf("expected the merged chain to verify, got '%s'", report.Error)
+	}
+
+	// New events carry on from the merged store.
+	event, _ := store.Append(HistoryEvent{Type: EventCommandIssued, Outcome: OutcomeSuccess, Detail: "toggle"})
+	numberEqual(t, int(event.ID), 9)
+	if report, _ := VerifyAudit(store.path, testAuditKey); !report.Verified {
+		t.Errorf("expected the chain to verify after an append, got '%s'", report.Error)
+	}
+}
+
+func TestImportLegacyLogsRefusesTamperedStore(t *testing.T) {
+	store := CreateTestStore(t)
+	store.Append(HistoryEvent{Type: EventCommandIssued, User: "dillon", Outcome: OutcomeSuccess, Detail: "toggle"})
+	editAuditStore(t, store.path, func(lines []string) []string {
+		lines[0] = strings.Replace(lines[0], "dillon", "dyllon", 1)
+		return lines
+	})
+
+	_, err := ImportLegacyLogs(store, writeLegacyLog(t, legacyLogFixture))
+	if err == nil || err.Error() != "audit failed after 1 events: event 1 does not match its hash" {
+		t.Fatalf("expected the import to refuse a tampered store, got %v", err)
+	}
+}
+
+func TestRunImportLogsCompressed(t *testing.T) {
+	dir := t.TempDir()
+	logFile := filepath.Join(dir, "garage-server.log.20170301-000000.000.gz")
+	file, err := os.Create(logFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(file)
+	zw.Write([]byte(legacyLogFixture))
+	zw.Close()
+	file.Close()
+
+	events := filepath.Join(dir, "events.jsonl")
+	numberEqual(t, runImportLogs([]string{"-events", events, logFile}), 0)
+	store, err := openEventStore(events)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	imported, _ := store.Query(nil, 0)
+	numberEqual(t, len(imported), 6)
+
+	// Not while the store is open.
+	numberEqual(t, runImportLogs([]string{"-events", events, logFile}), 1)
+}
+
+func TestImportLegacyLogsAcrossSegments(t *testing.T) {
+	path := writeLegacyLog(t, "TOGGLE DOOR - 2016-07-06 23:03:43.384659988 -0500 CDT\n")
+	old, err := os.Create(path + ".20160601-000000.000.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := gzip.NewWriter(old)
+	zw.Write([]byte("TOGGLE DOOR - 2016-05-24 17:07:43.384659988 -0500 CDT\n"))
+	zw.Close()
+	old.Close()
+
+	// Lines in the newer formats are already in the store.
+	recent := "Version - 2016-06-05 09:00:00.12 -0500 CDT\n" +
+		"2017-03-04T18:21:07.512-06:00 INFO TOGGLE DOOR door=garage remote_ip=192.168.1.20 user=dillon\n"
+	if err := ioutil.WriteFile(path+".20160606-000000.000", []byte(recent), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	store := CreateTestStore(t)
+	result, err := ImportLegacyLogs(store, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, result.Imported, 3)
+	numberEqual(t, len(result.Malformed), 0)
+	events, _ := store.Query(nil, 0)
+	numberEqual(t, len(events), 3)
+	stringEqual(t, events[0].Time.Format("2006-01-02"), "2016-07-06")
+	stringEqual(t, events[1].Type, EventRequest)
+	stringEqual(t, events[2].Time.Format("2006-01-02"), "2016-05-24")
+}
+
+func TestImportLegacyLogsMissingFile(t *testing.T) {
+	_, err := ImportLegacyLogs(CreateTestStore(t), filepath.Join(t.TempDir(), "missing.log"))
+	if !os.IsNotExist(err) {
+		t.Fatalf("expected an error for a missing log file, got %v", err)
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// journalSocket is where systemd-journald listens for its native protocol.
+const journalSocket = "/run/systemd/journal/socket"
+
+// NewJournaldSink sends records to the journal listening on socket. Each
+// field becomes a journal field of the same name in upper case, so
+// `journalctl REMOTE_IP=192.168.1.20` finds a client's requests.
+func NewJournaldSink(socket string) LogSink {
+	return newNetSink("unixgram", socket, formatJournal)
+}
+
+// formatJournal renders a record in the journal's native datagram format.
+func formatJournal(record Record) []byte {
+	var buf bytes.Buffer
+	writeJournalField(&buf, "MESSAGE", record.Message)
+	writeJournalField(&buf, "PRIORITY", strconv.Itoa(syslogSeverity[record.Level]))
+	writeJournalField(&buf, "SYSLOG_IDENTIFIER", syslogAppName)
+	for _, field := range record.Fields {
+		writeJournalField(&buf, journalFieldName(field.Key), fmt.Sprint(fieldValue(field.Value)))
+	}
+	return buf.Bytes()
+}
+
+// writeJournalField writes NAME=value, or for a value with a newline in it,
+// the name and the value's length as a little endian uint64 ahead of it.
+func writeJournalField(buf *bytes.Buffer, name string, value string) {
+	buf.WriteString(name)
+	if strings.Contains(value, "\n") {
+		buf.WriteByte('\n')
+		binary.Write(buf, binary.LittleEndian, uint64(len(value)))
+	} else {
+		buf.WriteByte('=')
+	}
+	buf.WriteString(value)
+	buf.WriteByte('\n')
+}
+
+// journalFieldName turns a key into a name the journal accepts: upper case
+// letters, digits and underscores, not starting with an underscore, which
+// is reserved for fields the journal adds itself.
+func journalFieldName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	name = strings.TrimLeft(name, "_")
+	if name == "" || (name[0] >= '0' && name[0] <= '9') {
+		name = "FIELD_" + name
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestJournaldSink(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "socket")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	record := testRecord()
+	record.Fields = append(record.Fields, Field{"remote_ip", "192.168.1.20"}, Field{"error", "line one\nline two"}, Field{"_uid", 0})
+	if err := NewJournaldSink(path).WriteRecord(record); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var multiline bytes.Buffer
+	multiline.WriteString("ERROR\n")
+	binary.Write(&multiline, binary.LittleEndian, uint64(len("line one\nline two")))
+	multiline.WriteString("line one\nline two\n")
+
+	expected := "MESSAGE=Invalid wait 'soon'\n" +
+		"PRIORITY=4\n" +
+		"SYSLOG_IDENTIFIER=garage-server\n" +
+		"DOOR=garage\n" +
+		"PATH=/status?x=\"]\n" +
+		"STATUS=400\n" +
+		"REMOTE_IP=192.168.1.20\n" +
+		multiline.String() +
+		"UID=0\n"
+	stringEqual(t, string(buf[:n]), expected)
+}
+
+func TestJournalFieldName(t *testing.T) {
+	stringEqual(t, journalFieldName("latency_ms"), "LATENCY_MS")
+	stringEqual(t, journalFieldName("request-id"), "REQUEST_ID")
+	stringEqual(t, journalFieldName("__cursor"), "CURSOR")
+	stringEqual(t, journalFieldName("2fa"), "FIELD_2FA")
+}
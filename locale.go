@@ -0,0 +1,121 @@
+package main
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// LogLocale renders the display date and time of a log entry. The date
+// pattern's {weekday}, {day}, {month} and {year} are filled in from the
+// abbreviated names below, and clock is a time.Format layout.
+type LogLocale struct {
+	days   [7]string
+	months [12]string
+	date   string
+	clock  string
+}
+
+var englishDays = [7]string{"Sun", "Mon", "Tue", "Wed", "Thu", "Fri", "Sat"}
+var englishMonths = [12]string{"Jan", "Feb", "Mar", "Apr", "May", "Jun", "Jul", "Aug", "Sep", "Oct", "Nov", "Dec"}
+
+// defaultLogLocale is how /logs has always formatted entries.
+var defaultLogLocale = &LogLocale{
+	days:   englishDays,
+	months: englishMonths,
+	date:   "{weekday} {month} {day} {year}",
+	clock:  "3:04 PM",
+}
+
+// logLocales are keyed by lower case language tag. A tag with a region falls
+// back to its language, so "de-AT" uses "de".
+var logLocales = map[string]*LogLocale{
+	"en":    defaultLogLocale,
+	"en-us": defaultLogLocale,
+	"en-gb": {
+		days:   englishDays,
+		months: englishMonths,
+		date:   "{weekday} {day} {month} {year}",
+		clock:  "15:04",
+	},
+	"de": {
+		days:   [7]string{"So", "Mo", "Di", "Mi", "Do", "Fr", "Sa"},
+		months: [12]string{"Jan", "Feb", "Mär", "Apr", "Mai", "Jun", "Jul", "Aug", "Sep", "Okt", "Nov", "Dez"},
+		date:   "{weekday}, {day}. {month} {year}",
+		clock:  "15:04",
+	},
+	"es": {
+		days:   [7]string{"dom", "lun", "mar", "mié", "jue", "vie", "sáb"},
+		months: [12]string{"ene", "feb", "mar", "abr", "may", "jun", "jul", "ago", "sept", "oct", "nov", "dic"},
+		date:   "{weekday} {day} {month} {year}",
+		clock:  "15:04",
+	},
+	"fr": {
+		days:   [7]string{"dim.", "lun.", "mar.", "mer.", "jeu.", "ven.", "sam."},
+		months: [12]string{"janv.", "févr.", "mars", "avr.", "mai", "juin", "juil.", "août", "sept.", "oct.", "nov.", "déc."},
+		date:   "{weekday} {day} {month} {year}",
+		clock:  "15:04",
+	},
+}
+
+// findLogLocale looks up a language tag such as "en-GB" or "de".
+func findLogLocale(tag string) (*LogLocale, bool) {
+	tag = strings.ToLower(strings.Replace(strings.TrimSpace(tag), "_", "-", -1))
+	if locale, ok := logLocales[tag]; ok {
+		return locale, true
+	}
+	if i := strings.Index(tag, "-"); i > 0 {
+		locale, ok := logLocales[tag[:i]]
+		return locale, ok
+	}
+	return nil, false
+}
+
+// acceptedLogLocale picks the supported locale the client prefers most from
+// an Accept-Language header, or the default if there is none.
+func acceptedLogLocale(header string) *LogLocale {
+	type language struct {
+		tag     string
+		quality float64
+	}
+	var languages []language
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		lang := language{tag: strings.TrimSpace(fields[0]), quality: 1}
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if q, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					lang.quality = q
+				}
+			}
+		}
+		if lang.tag != "" && lang.quality > 0 {
+			languages = append(languages, lang)
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool {
+		return languages[i].quality > languages[j].quality
+	})
+
+	for _, lang := range languages {
+		if locale, ok := findLogLocale(lang.tag); ok {
+			return locale
+		}
+	}
+	return defaultLogLocale
+}
+
+func (l *LogLocale) formatDate(t time.Time) string {
+	return strings.NewReplacer(
+		"{weekday}", l.days[t.Weekday()],
+		"{day}", strconv.Itoa(t.Day()),
+		"{month}", l.months[t.Month()-1],
+		"{year}", strconv.Itoa(t.Year()),
+	).Replace(l.date)
+}
+
+func (l *LogLocale) formatClock(t time.Time) string {
+	return t.Format(l.clock)
+}
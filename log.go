@@ -2,54 +2,317 @@ package main
 
 import (
 	"bufio"
-	"os"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"regexp"
+	"strconv"
 	"strings"
 	"time"
 )
 
 type Log struct {
-	Date string `json:"date"`
-	Time string `json:"time"`
-	Type string `json:"type"`
+	Date      string `json:"date"`
+	Time      string `json:"time"`
+	Timestamp string `json:"timestamp"`
+	Type      string `json:"type"`
+	Event     string `json:"event,omitempty"`
+	User      string `json:"user,omitempty"`
+	Door      string `json:"door,omitempty"`
+	Outcome   string `json:"outcome,omitempty"`
 }
 
 type Logs struct {
-	Entries []Log `json:"entries"`
+	Entries    []Log        `json:"entries"`
+	NextCursor string       `json:"next_cursor,omitempty"`
+	Audit      *AuditReport `json:"audit,omitempty"`
 }
 
-func ParseDateTime(dateTime string) (formattedDate string, formattedTime string) {
-	layout := "2006-01-02 15:04:05.000000000 -0700 MST"
-	t, _ := time.Parse(layout, dateTime)
-	formattedTime = t.Format("3:04 PM")
-	formattedDate = t.Format("Mon Jan 2 2006")
-	return formattedDate, formattedTime
+// ParseDateTime formats a timestamp from the text log as a log entry's date
+// and time, in the log's own time zone.
+func ParseDateTime(dateTime string) (formattedDate string, formattedTime string, err error) {
+	t, err := parseLegacyTime(dateTime)
+	if err != nil {
+		return "", "", err
+	}
+	formattedDate, formattedTime = formatLogTime(t)
+	return formattedDate, formattedTime, nil
+}
+
+func formatLogTime(t time.Time) (formattedDate string, formattedTime string) {
+	return defaultLogLocale.formatDate(t), defaultLogLocale.formatClock(t)
+}
+
+// LogFormat controls the display fields of a log entry. A nil Location keeps
+// each time in the zone it was recorded in, and a nil Locale formats them
+// the way /logs always has.
+type LogFormat struct {
+	Location *time.Location
+	Locale   *LogLocale
+}
+
+// LogFromEvent formats an event the way /logs has always presented entries
+// parsed from the text log, so a toggle command still has type "Toggle".
+// Timestamp is the same time in RFC 3339.
+func LogFromEvent(event HistoryEvent, format LogFormat) Log {
+	t := event.Time
+	if format.Location != nil {
+		t = t.In(format.Location)
+	}
+	locale := format.Locale
+	if locale == nil {
+		locale = defaultLogLocale
+	}
+	return Log{
+		Date:      locale.formatDate(t),
+		Time:      locale.formatClock(t),
+		Timestamp: t.Format(time.RFC3339),
+		Type:      strings.Title(event.Detail),
+		Event:     event.Type,
+		User:      event.User,
+		Door:      event.Door,
+		Outcome:   event.Outcome,
+	}
 }
 
 func ParseLogType(logType string) string {
 	return strings.Title(strings.ToLower(strings.Split(logType, " ")[0]))
 }
 
-func ParseLogs(logFile string) Logs {
-	file, _ := os.Open(logFile)
-	scanner := bufio.NewScanner(file)
-	var lines []string
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "TOGGLE DOOR") {
-			lines = append(lines, line)
+// The plain-text log apiLogHandler writes: "EVENT - time.Now()".
+const legacyTimeLayout = "2006-01-02 15:04:05 -0700 MST"
+
+// monotonicSuffix matches the " m=+1.234" reading time.Time.String appends
+// since Go 1.9.
+var monotonicSuffix = regexp.MustCompile(` m=[+-][0-9.]+$`)
+
+var readPinFailure = regexp.MustCompile(`^Could not read pin '\d+' on Raspberry Pi$`)
+
+// parseLegacyTime parses a time.Now() as printed by apiLogHandler. Any
+// number of fractional second digits is accepted, as is a single digit hour.
+func parseLegacyTime(timestamp string) (time.Time, error) {
+	t, err := time.Parse(legacyTimeLayout, monotonicSuffix.ReplaceAllString(timestamp, ""))
+	if err != nil {
+		return t, fmt.Errorf("bad timestamp '%s'", timestamp)
+	}
+	return t, nil
+}
+
+// parseLegacyLogLine splits a line into its message and timestamp.
+func parseLegacyLogLine(line string) (string, time.Time, error) {
+	i := strings.LastIndex(line, " - ")
+	if i < 0 {
+		return "", time.Time{}, errors.New("missing ' - ' separator")
+	}
+	message := strings.TrimSpace(line[:i])
+	if message == "" {
+		return "", time.Time{}, errors.New("missing event")
+	}
+
+	timestamp := strings.TrimSpace(line[i+3:])
+	t, err := parseLegacyTime(timestamp)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return message, t, nil
+}
+
+// logLine is one line of the server log.
+type logLine struct {
+	time    time.Time
+	level   string
+	message string
+	fields  map[string]string
+	legacy  bool
+}
+
+// textLogField finds where the fields start in a text log line.
+var textLogField = regexp.MustCompile(` [a-z_]+=`)
+
+// parseLogLine reads a line written by the structured logger, as text or
+// JSON, or by older versions as "EVENT - time".
+func parseLogLine(line string) (logLine, error) {
+	if strings.HasPrefix(line, "{") {
+		return parseJSONLogLine(line)
+	}
+	if i := strings.Index(line, " "); i > 0 {
+		if t, err := time.Parse(logTimeLayout, line[:i]); err == nil {
+			return parseTextLogLine(t, line[i+1:])
+		}
+	}
+	message, t, err := parseLegacyLogLine(line)
+	return logLine{time: t, message: message, legacy: true}, err
+}
+
+func parseTextLogLine(t time.Time, rest string) (logLine, error) {
+	entry := logLine{time: t, fields: make(map[string]string)}
+
+	i := strings.Index(rest, " ")
+	if i < 0 {
+		return entry, errors.New("missing event")
+	}
+	level, err := ParseLevel(rest[:i])
+	if err != nil {
+		return entry, err
+	}
+	entry.level = level.String()
+	rest = rest[i+1:]
+
+	fields := ""
+	if quoted, err := strconv.QuotedPrefix(rest); err == nil && strings.HasPrefix(rest, `"`) {
+		rest, fields = quoted, strings.TrimPrefix(rest[len(quoted):], " ")
+		rest, _ = strconv.Unquote(rest)
+	} else if loc := textLogField.FindStringIndex(rest); loc != nil {
+		rest, fields = rest[:loc[0]], rest[loc[0]+1:]
+	}
+	entry.message = strings.TrimSpace(rest)
+	if entry.message == "" {
+		return entry, errors.New("missing event")
+	}
+
+	for fields != "" {
+		eq := strings.Index(fields, "=")
+		if eq < 0 {
+			return entry, fmt.Errorf("bad field '%s'", fields)
+		}
+		key, value := fields[:eq], fields[eq+1:]
+		if strings.HasPrefix(value, `"`) {
+			quoted, err := strconv.QuotedPrefix(value)
+			if err != nil {
+				return entry, fmt.Errorf("bad value for '%s'", key)
+			}
+			fields = value[len(quoted):]
+			value, _ = strconv.Unquote(quoted)
+		} else {
+			end := strings.Index(value, " ")
+			if end < 0 {
+				end = len(value)
+			}
+			value, fields = value[:end], value[end:]
 		}
+		entry.fields[key] = value
+		fields = strings.TrimPrefix(fields, " ")
+	}
+	return entry, nil
+}
+
+func parseJSONLogLine(line string) (logLine, error) {
+	entry := logLine{fields: make(map[string]string)}
+
+	var record map[string]interface{}
+	if err := json.Unmarshal([]byte(line), &record); err != nil {
+		return entry, err
+	}
+	for key, value := range record {
+		entry.fields[key] = fmt.Sprint(value)
 	}
 
-	entries := []Log{}
-	for _, line := range lines {
-		logSlice := strings.Split(line, " - ")
-		logType := ParseLogType(logSlice[0])
-		logDate, logTime := ParseDateTime(logSlice[1])
-		log := Log{Date: logDate, Time: logTime, Type: logType}
-		entries = append(entries, log)
+	t, err := time.Parse(logTimeLayout, entry.fields["time"])
+	if err != nil {
+		return entry, fmt.Errorf("bad timestamp '%s'", entry.fields["time"])
+	}
+	entry.time = t
+	entry.level = entry.fields["level"]
+	entry.message = entry.fields["message"]
+	if entry.message == "" {
+		return entry, errors.New("missing event")
+	}
+	for _, key := range []string{"time", "level", "message"} {
+		delete(entry.fields, key)
 	}
+	return entry, nil
+}
+
+// legacyLogEvent maps a text log message to a typed event.
+func legacyLogEvent(message string, t time.Time) HistoryEvent {
+	event := HistoryEvent{Time: t, Outcome: OutcomeSuccess}
+	switch {
+	case message == "TOGGLE DOOR":
+		event.Type = EventCommandIssued
+		event.Detail = "toggle"
+	case message == "Version" || message == "Logs" || message == "Events" || message == "Control":
+		event.Type = EventRequest
+		event.Detail = strings.ToLower(message)
+	case readPinFailure.MatchString(message) || message == "Could not write to pin":
+		event.Type = EventError
+		event.Outcome = OutcomeFailure
+		event.Detail = message
+	default:
+		event.Type = EventMessage
+		event.Detail = message
+	}
+	return event
+}
+
+// LogLineError is a line of a text log that couldn't be parsed.
+type LogLineError struct {
+	File string
+	Line int
+	Err  error
+}
 
-	return Logs{Entries: ReverseEntries(entries)}
+func (e *LogLineError) Error() string {
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Err)
+}
+
+// ParseServerLog reads every event in a server log, oldest first, whether it
+// was written as text or JSON or by a version that logged "EVENT - time".
+// Lines that can't be parsed are skipped and returned with their line
+// numbers; the error is only for a failed read.
+func ParseServerLog(r io.Reader, name string) ([]HistoryEvent, []*LogLineError, error) {
+	return parseServerLog(r, name, false)
+}
+
+// parseServerLog is ParseServerLog, optionally skipping every line that
+// isn't in the "EVENT - time" format.
+func parseServerLog(r io.Reader, name string, legacyOnly bool) ([]HistoryEvent, []*LogLineError, error) {
+	var events []HistoryEvent
+	var malformed []*LogLineError
+
+	scanner := bufio.NewScanner(r)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		entry, err := parseLogLine(line)
+		if err != nil {
+			malformed = append(malformed, &LogLineError{File: name, Line: lineNumber, Err: err})
+			continue
+		}
+		if legacyOnly && !entry.legacy {
+			continue
+		}
+		// Every request gets an access line, which would repeat the
+		// line its handler logged.
+		if entry.message == "Request" && entry.fields["status"] != "" {
+			continue
+		}
+
+		// A relay failure is logged right after the toggle it belongs to.
+		if entry.message == "Could not write to pin" && len(events) > 0 {
+			last := &events[len(events)-1]
+			if last.Type == EventCommandIssued && entry.time.Sub(last.Time) < time.Second {
+				last.Outcome = OutcomeFailure
+				continue
+			}
+		}
+
+		event := legacyLogEvent(entry.message, entry.time)
+		if entry.level == LevelError.String() && event.Type == EventMessage {
+			event.Type = EventError
+			event.Outcome = OutcomeFailure
+		}
+		event.User = entry.fields["user"]
+		event.Door = entry.fields["door"]
+		event.SourceIP = entry.fields["remote_ip"]
+		events = append(events, event)
+	}
+	return events, malformed, scanner.Err()
 }
 
 func ReverseEntries(entries []Log) []Log {
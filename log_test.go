@@ -1,6 +1,9 @@
 package main
 
-import "testing"
+import (
+	"strings"
+	"testing"
+)
 
 func TestReverseEntries(t *testing.T) {
 	log1 := Log{Date: "Mon Jun", Time: "10:00 AM", Type: "Toggle1"}
@@ -20,7 +23,67 @@ func TestParseLogType(t *testing.T) {
 
 func TestParseDateTime(t *testing.T) {
 	givenTime := "2016-07-06 23:03:43.384659988 -0500 CDT"
-	date, time := ParseDateTime(givenTime)
+	date, time, err := ParseDateTime(givenTime)
+	if err != nil {
+		t.Fatal(err)
+	}
 	stringEqual(t, date, "Wed Jul 6 2016")
 	stringEqual(t, time, "11:03 PM")
 }
+
+func TestParseDateTimeShortFormats(t *testing.T) {
+	date, time, err := ParseDateTime("2016-05-25 9:03:43.5 -0500 CDT")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stringEqual(t, date, "Wed May 25 2016")
+	stringEqual(t, time, "9:03 AM")
+
+	_, time, err = ParseDateTime("2017-02-26 10:01:02 -0600 CST m=+3600.000000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stringEqual(t, time, "10:01 AM")
+}
+
+func TestParseDateTimeError(t *testing.T) {
+	_, _, err := ParseDateTime("yesterday")
+	if err == nil {
+		t.Fatal("Expected an error for an unparseable time")
+	}
+	stringEqual(t, err.Error(), "bad timestamp 'yesterday'")
+}
+
+func TestParseServerLogFormats(t *testing.T) {
+	log := `2017-03-04T18:21:07.512-06:00 INFO TOGGLE DOOR door=garage remote_ip=192.168.1.20 request_id=4f1c user=dillon
+2017-03-04T18:21:07.615-06:00 INFO Request door=garage method=POST path=/api/v2/toggle status=200 latency_ms=103.2
+2017-03-04T18:21:08.000-06:00 ERROR Could not record event door=garage type=command_issued error="disk full"
+2017-03-04T18:21:09.000-06:00 LOUD Hello
+{"time":"2017-03-04T18:22:00.000-06:00","level":"warn","message":"Invalid wait 'soon'","code":"invalid_wait","door":"garage"}
+{"time":"yesterday","level":"info","message":"Version"}
+Version - 2016-04-26 22:42:43.254676358 -0500 CDT`
+
+	events, malformed, err := ParseServerLog(strings.NewReader(log), "garage-server.log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, len(malformed), 2)
+	stringEqual(t, malformed[0].Error(), "garage-server.log:4: unknown log level 'LOUD'")
+	stringEqual(t, malformed[1].Error(), "garage-server.log:6: bad timestamp 'yesterday'")
+
+	numberEqual(t, len(events), 4)
+	stringEqual(t, events[0].Type, EventCommandIssued)
+	stringEqual(t, events[0].User, "dillon")
+	stringEqual(t, events[0].Door, "garage")
+	stringEqual(t, events[0].SourceIP, "192.168.1.20")
+
+	stringEqual(t, events[1].Type, EventError)
+	stringEqual(t, events[1].Outcome, OutcomeFailure)
+	stringEqual(t, events[1].Detail, "Could not record event")
+
+	stringEqual(t, events[2].Type, EventMessage)
+	stringEqual(t, events[2].Detail, "Invalid wait 'soon'")
+
+	stringEqual(t, events[3].Type, EventRequest)
+	stringEqual(t, events[3].Detail, "version")
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level '%s'", name)
+}
+
+// Field is a key/value pair attached to a log record.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Record is a single log message as it is written out.
+type Record struct {
+	Time    time.Time
+	Level   Level
+	Message string
+	Fields  []Field
+}
+
+// A LogSink is somewhere log records are written: a stream, syslog or the
+// journal.
+type LogSink interface {
+	WriteRecord(Record) error
+}
+
+type streamSink struct {
+	mu     sync.Mutex
+	w      io.Writer
+	encode func(*bytes.Buffer, Record)
+}
+
+// NewTextSink writes records to w as lines of
+// "time LEVEL message key=value ...".
+func NewTextSink(w io.Writer) LogSink {
+	return &streamSink{w: w, encode: encodeText}
+}
+
+// NewJSONSink writes records to w as one JSON object per line.
+func NewJSONSink(w io.Writer) LogSink {
+	return &streamSink{w: w, encode: encodeJSON}
+}
+
+func (s *streamSink) WriteRecord(record Record) error {
+	var buf bytes.Buffer
+	s.encode(&buf, record)
+	buf.WriteByte('\n')
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.w.Write(buf.Bytes())
+	return err
+}
+
+type logOutput struct {
+	level Level
+	sinks []LogSink
+}
+
+// Logger writes leveled records with key/value fields. Loggers derived with
+// With and WithHook share their parent's output.
+type Logger struct {
+	output *logOutput
+	fields []Field
+	hooks  []func(Record)
+}
+
+// NewLogger writes records at level and above to every sink.
+func NewLogger(level Level, sinks ...LogSink) *Logger {
+	return &Logger{output: &logOutput{level: level, sinks: sinks}}
+}
+
+// NewTextLogger writes records at level and above to w as text.
+func NewTextLogger(w io.Writer, level Level) *Logger {
+	return NewLogger(level, NewTextSink(w))
+}
+
+// NewJSONLogger writes records at level and above to w as JSON.
+func NewJSONLogger(w io.Writer, level Level) *Logger {
+	return NewLogger(level, NewJSONSink(w))
+}
+
+// With returns a logger that adds fields to every record.
+func (l *Logger) With(fields ...Field) *Logger {
+	child := *l
+	child.fields = append(append([]Field{}, l.fields...), fields...)
+	return &child
+}
+
+// WithHook returns a logger that also passes every record it writes to f.
+func (l *Logger) WithHook(f func(Record)) *Logger {
+	child := *l
+	child.hooks = append(append([]func(Record){}, l.hooks...), f)
+	return &child
+}
+
+func (l *Logger) Log(level Level, message string, fields ...Field) {
+	if level < l.output.level {
+		return
+	}
+	record := Record{
+		Time:    time.Now(),
+		Level:   level,
+		Message: message,
+		Fields:  append(append([]Field{}, l.fields...), fields...),
+	}
+
+	// There is nowhere to report a sink failing; the network sinks
+	// reconnect on the next record.
+	for _, sink := range l.output.sinks {
+		sink.WriteRecord(record)
+	}
+	for _, hook := range l.hooks {
+		hook(record)
+	}
+}
+
+func (l *Logger) Debug(message string, fields ...Field) { l.Log(LevelDebug, message, fields...) }
+func (l *Logger) Info(message string, fields ...Field)  { l.Log(LevelInfo, message, fields...) }
+func (l *Logger) Warn(message string, fields ...Field)  { l.Log(LevelWarn, message, fields...) }
+func (l *Logger) Error(message string, fields ...Field) { l.Log(LevelError, message, fields...) }
+
+const logTimeLayout = "2006-01-02T15:04:05.000Z07:00"
+
+func fieldValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case error:
+		return v.Error()
+	case time.Duration:
+		return v.String()
+	}
+	return value
+}
+
+// hasControl reports whether s has a character that could end the line it
+// is written on or hide what follows.
+func hasControl(s string) bool {
+	return strings.IndexFunc(s, func(r rune) bool { return r != ' ' && !unicode.IsPrint(r) }) >= 0
+}
+
+func encodeText(buf *bytes.Buffer, record Record) {
+	buf.WriteString(record.Time.Format(logTimeLayout))
+	buf.WriteByte(' ')
+	buf.WriteString(strings.ToUpper(record.Level.String()))
+	buf.WriteByte(' ')
+	// Messages can carry request input, which mustn't be able to start a
+	// line of its own or pass for fields.
+	message := record.Message
+	if strings.HasPrefix(message, `"`) || hasControl(message) || textLogField.MatchString(message) {
+		message = strconv.Quote(message)
+	}
+	buf.WriteString(message)
+	for _, field := range record.Fields {
+		value := fmt.Sprint(fieldValue(field.Value))
+		if value == "" || strings.ContainsAny(value, " \"=") || hasControl(value) {
+			value = strconv.Quote(value)
+		}
+		fmt.Fprintf(buf, " %s=%s", field.Key, value)
+	}
+}
+
+func encodeJSON(buf *bytes.Buffer, record Record) {
+	writeJSONField := func(key string, value interface{}) {
+		encoded, err := json.Marshal(value)
+		if err != nil {
+			encoded, _ = json.Marshal(fmt.Sprint(value))
+		}
+		if buf.Len() > 1 {
+			buf.WriteByte(',')
+		}
+		encodedKey, _ := json.Marshal(key)
+		buf.Write(encodedKey)
+		buf.WriteByte(':')
+		buf.Write(encoded)
+	}
+
+	buf.WriteByte('{')
+	writeJSONField("time", record.Time.Format(logTimeLayout))
+	writeJSONField("level", record.Level.String())
+	writeJSONField("message", record.Message)
+	for _, field := range record.Fields {
+		writeJSONField(field.Key, fieldValue(field.Value))
+	}
+	buf.WriteByte('}')
+}
+
+// logAPIError logs the error a request is answered with, as a warning when
+// it is the client's fault.
+func logAPIError(logger *Logger, apiErr *APIError) {
+	level := LevelWarn
+	if apiErr.Status >= 500 {
+		level = LevelError
+	}
+	logger.Log(level, apiErr.Message, Field{"code", apiErr.Code})
+}
+
+// requestLogger adds the fields identifying req to logger.
+func requestLogger(logger *Logger, req *http.Request) *Logger {
+	fields := []Field{{"remote_ip", sourceIP(req)}}
+	if id := requestID(req); id != "" {
+		fields = append(fields, Field{"request_id", id})
+	}
+	if user := req.Header.Get("user"); user != "" {
+		fields = append(fields, Field{"user", user})
+	}
+	if span := SpanFromContext(req.Context()); span != nil {
+		fields = append(fields, Field{"trace_id", span.TraceID()}, Field{"span_id", span.SpanID()})
+	}
+	return logger.With(fields...)
+}
+
+// statusRecorder remembers the status a handler wrote. It passes through
+// flushing for event streams and hijacking for the control channel.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if r.status == 0 {
+		r.status = status
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+func (r *statusRecorder) Flush() {
+	if flusher, ok := r.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (r *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := r.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	if r.status == 0 {
+		r.status = http.StatusSwitchingProtocols
+	}
+	return hijacker.Hijack()
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// requestLogMessage is the message of the line logged for every request.
+const requestLogMessage = "Request"
+
+// RequestLogHandler logs every request once it has been served, with its
+// status and how long it took.
+func RequestLogHandler(logger *Logger, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(recorder, req)
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		level := LevelInfo
+		if status >= 500 {
+			level = LevelError
+		} else if status >= 400 {
+			level = LevelWarn
+		}
+		requestLogger(logger, req).Log(level, requestLogMessage,
+			Field{"method", req.Method},
+			Field{"path", req.URL.Path},
+			Field{"status", status},
+			Field{"latency_ms", float64(time.Since(start).Microseconds()) / 1000},
+		)
+	})
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTextLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewTextLogger(&buf, LevelInfo).With(Field{"door", "garage"})
+
+	logger.Debug("Too quiet")
+	logger.Info("TOGGLE DOOR", Field{"user", "dillon"})
+	logger.Error("Could not write to pin", Field{"pin", 25}, Field{"error", errors.New("gpio busy")})
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	numberEqual(t, len(lines), 2)
+	if !strings.HasSuffix(lines[0], " INFO TOGGLE DOOR door=garage user=dillon") {
+		t.Fatalf("Unexpected log line %q", lines[0])
+	}
+	if !strings.HasSuffix(lines[1], ` ERROR Could not write to pin door=garage pin=25 error="gpio busy"`) {
+		t.Fatalf("Unexpected log line %q", lines[1])
+	}
+}
+
+func TestTextLoggerQuotesMessages(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewTextLogger(&buf, LevelInfo)
+
+	forged := "Invalid wait '\n2017-03-04T18:21:07.512-06:00 INFO TOGGLE DOOR user=dillon'"
+	logger.Warn(forged, Field{"code", "invalid_wait"})
+	logger.Warn("Invalid since 'x user=dillon'")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	numberEqual(t, len(lines), 2)
+	for i, message := range []string{forged, "Invalid since 'x user=dillon'"} {
+		entry, err := parseLogLine(lines[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		stringEqual(t, entry.message, message)
+		if _, ok := entry.fields["user"]; ok {
+			t.Errorf("Expected no user field in %q", lines[i])
+		}
+	}
+}
+
+func TestJSONLogger(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewJSONLogger(&buf, LevelDebug).With(Field{"door", "garage"})
+	logger.Warn("Invalid wait 'soon'", Field{"code", "invalid_wait"}, Field{"status", 400})
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatal(err)
+	}
+	stringEqual(t, record["level"].(string), "warn")
+	stringEqual(t, record["message"].(string), "Invalid wait 'soon'")
+	stringEqual(t, record["door"].(string), "garage")
+	stringEqual(t, record["code"].(string), "invalid_wait")
+	numberEqual(t, int(record["status"].(float64)), 400)
+	if _, ok := record["time"].(string); !ok {
+		t.Fatal("Expected a time field")
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	level, err := ParseLevel("WARN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stringEqual(t, level.String(), "warn")
+
+	if _, err := ParseLevel("loud"); err == nil {
+		t.Fatal("Expected an error for an unknown level")
+	}
+}
+
+func TestHubLoggerPublishesRecords(t *testing.T) {
+	hub := NewEventHub(10)
+	var buf bytes.Buffer
+	logger := hub.Logger(NewTextLogger(&buf, LevelInfo))
+	logger.Debug("Filtered")
+	logger.Info("Version")
+
+	replay, events := hub.Subscribe("0")
+	defer hub.Unsubscribe(events)
+	numberEqual(t, len(replay), 1)
+	message, _ := json.Marshal(replay[0].Data)
+	stringEqual(t, string(message), `{"level":"info","message":"Version"}`)
+}
+
+func TestRequestsAreLogged(t *testing.T) {
+	var buf bytes.Buffer
+	c := CreateTestRouteConfig(t, true, "closed", false)
+	c.Logger = NewJSONLogger(&buf, LevelInfo)
+	router := NewRouter(c)
+
+	req := signedRequest(t, "POST", "/api/v2/toggle", SharedSecret)
+	req.RemoteAddr = "192.168.1.20:51234"
+	req.Header.Set("user", "dillon")
+	req.Header.Set("X-Request-ID", "abc123")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	var records []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var record map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, record)
+	}
+	numberEqual(t, len(records), 2)
+
+	stringEqual(t, records[0]["message"].(string), "TOGGLE DOOR")
+	stringEqual(t, records[0]["request_id"].(string), "abc123")
+	stringEqual(t, records[0]["user"].(string), "dillon")
+
+	request := records[1]
+	stringEqual(t, request["message"].(string), "Request")
+	stringEqual(t, request["method"].(string), "POST")
+	stringEqual(t, request["path"].(string), "/api/v2/toggle")
+	stringEqual(t, request["remote_ip"].(string), "192.168.1.20")
+	stringEqual(t, request["request_id"].(string), "abc123")
+	numberEqual(t, int(request["status"].(float64)), 200)
+	if _, ok := request["latency_ms"].(float64); !ok {
+		t.Fatal("Expected a latency_ms field")
+	}
+}
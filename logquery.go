@@ -0,0 +1,179 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultLogLimit = 100
+	maxLogLimit     = 1000
+)
+
+// LogFilter selects a page of events for /logs. Events come newest first;
+// Before is the cursor, and only events with a smaller ID match.
+type LogFilter struct {
+	From   time.Time
+	To     time.Time
+	Types  []string
+	User   string
+	Door   string
+	Before uint64
+	Limit  int
+}
+
+func (f LogFilter) Match(event HistoryEvent) bool {
+	if f.Before != 0 && event.ID >= f.Before {
+		return false
+	}
+	if !f.From.IsZero() && event.Time.Before(f.From) {
+		return false
+	}
+	if !f.To.IsZero() && !event.Time.Before(f.To) {
+		return false
+	}
+	if f.User != "" && event.User != f.User {
+		return false
+	}
+	if f.Door != "" && event.Door != f.Door {
+		return false
+	}
+	for _, eventType := range f.Types {
+		if event.Type == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLogTime accepts an RFC 3339 timestamp or a date in location. A date
+// given for "to" covers the whole day.
+func parseLogTime(value string, endOfDay bool, location *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation("2006-01-02", value, location)
+	if err != nil {
+		return t, err
+	}
+	if endOfDay {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+func invalidLogParameter(name string, value string) *APIError {
+	return &APIError{Status: 400, Code: "invalid_parameter", Message: fmt.Sprintf("Invalid %s '%s'", name, value)}
+}
+
+// ParseLogFilter reads from, to, type, user, door, cursor and limit from the
+// query string. Without a type only commands are listed, as /logs always has.
+// Dates are days in tz, or in local time without it.
+func ParseLogFilter(req *http.Request) (LogFilter, *APIError) {
+	query := req.URL.Query()
+	filter := LogFilter{
+		Types: []string{EventCommandIssued},
+		User:  query.Get("user"),
+		Door:  query.Get("door"),
+		Limit: defaultLogLimit,
+	}
+
+	var err error
+	location := time.Local
+	if tz := query.Get("tz"); tz != "" {
+		if location, err = time.LoadLocation(tz); err != nil {
+			return filter, invalidLogParameter("tz", tz)
+		}
+	}
+	if from := query.Get("from"); from != "" {
+		if filter.From, err = parseLogTime(from, false, location); err != nil {
+			return filter, invalidLogParameter("from", from)
+		}
+	}
+	if to := query.Get("to"); to != "" {
+		if filter.To, err = parseLogTime(to, true, location); err != nil {
+			return filter, invalidLogParameter("to", to)
+		}
+	}
+	if types := query.Get("type"); types != "" {
+		filter.Types = strings.Split(types, ",")
+	}
+	if cursor := query.Get("cursor"); cursor != "" {
+		if filter.Before, err = strconv.ParseUint(cursor, 10, 64); err != nil || filter.Before == 0 {
+			return filter, invalidLogParameter("cursor", cursor)
+		}
+	}
+	if limit := query.Get("limit"); limit != "" {
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil || filter.Limit < 1 {
+			return filter, invalidLogParameter("limit", limit)
+		}
+		if filter.Limit > maxLogLimit {
+			filter.Limit = maxLogLimit
+		}
+	}
+
+	return filter, nil
+}
+
+// ParseLogFormat reads the time zone and locale for display fields from the
+// tz and locale parameters. Without tz each time stays in the zone it was
+// recorded in; the locale falls back to the Accept-Language header.
+func ParseLogFormat(req *http.Request) (LogFormat, *APIError) {
+	query := req.URL.Query()
+	format := LogFormat{Locale: acceptedLogLocale(req.Header.Get("Accept-Language"))}
+
+	if tz := query.Get("tz"); tz != "" {
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			return format, invalidLogParameter("tz", tz)
+		}
+		format.Location = location
+	}
+	if tag := query.Get("locale"); tag != "" {
+		locale, ok := findLogLocale(tag)
+		if !ok {
+			return format, invalidLogParameter("locale", tag)
+		}
+		format.Locale = locale
+	}
+	return format, nil
+}
+
+// queryLogs returns the page of events the request asks for, newest first,
+// with a cursor for the next page when there is one and whether the
+// store's hash chain verified.
+func queryLogs(store *EventStore, req *http.Request) (Logs, *APIError) {
+	filter, apiErr := ParseLogFilter(req)
+	if apiErr != nil {
+		return Logs{}, apiErr
+	}
+	format, apiErr := ParseLogFormat(req)
+	if apiErr != nil {
+		return Logs{}, apiErr
+	}
+
+	// Ask for one extra event to find out whether there is another page.
+	events, err := store.QueryBefore(filter.Before, filter.Match, filter.Limit+1)
+	if err != nil {
+		return Logs{}, &APIError{Status: 500, Code: "store_unavailable", Message: fmt.Sprintf("Could not read event store: %s", err)}
+	}
+
+	audit, err := store.Audit()
+	if err != nil {
+		return Logs{}, &APIError{Status: 500, Code: "store_unavailable", Message: fmt.Sprintf("Could not read event store: %s", err)}
+	}
+
+	logs := Logs{Entries: []Log{}, Audit: &audit}
+	if len(events) > filter.Limit {
+		events = events[:filter.Limit]
+		logs.NextCursor = strconv.FormatUint(events[len(events)-1].ID, 10)
+	}
+	for _, event := range events {
+		logs.Entries = append(logs.Entries, LogFromEvent(event, format))
+	}
+	return logs, nil
+}
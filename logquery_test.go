@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func createLogHistory(t *testing.T) *EventStore {
+	store := CreateTestStore(t)
+	start := time.Date(2017, 3, 1, 8, 0, 0, 0, time.Local)
+	for day := 0; day < 5; day++ {
+		at := start.AddDate(0, 0, day)
+		user := "dillon"
+		if day%2 == 1 {
+			user = "sam"
+		}
+		store.Append(HistoryEvent{Time: at, Type: EventCommandIssued, User: user, Door: "garage", Outcome: OutcomeSuccess, Detail: "toggle"})
+		store.Append(HistoryEvent{Time: at.Add(time.Second), Type: EventStateChanged, Door: "garage", Outcome: OutcomeSuccess, Detail: "open"})
+	}
+	return store
+}
+
+func getLogs(t *testing.T, store *EventStore, query string) (*httptest.ResponseRecorder, Logs) {
+	writer := httptest.NewRecorder()
+	APILogsHandler(DummyLogger, store)(writer, signedRequest(t, "GET", "/api/v2/logs"+query, SharedSecret))
+
+	var logs Logs
+	if writer.Code == 200 {
+		if err := json.NewDecoder(writer.Body).Decode(&logs); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return writer, logs
+}
+
+func TestLogsPagination(t *testing.T) {
+	store := createLogHistory(t)
+
+	_, page := getLogs(t, store, "?limit=2")
+	numberEqual(t, len(page.Entries), 2)
+	stringEqual(t, page.Entries[0].Date, "Sun Mar 5 2017")
+	stringEqual(t, page.NextCursor, "7")
+
+	_, page = getLogs(t, store, "?limit=2&cursor="+page.NextCursor)
+	numberEqual(t, len(page.Entries), 2)
+	stringEqual(t, page.Entries[0].Date, "Fri Mar 3 2017")
+	stringEqual(t, page.NextCursor, "3")
+
+	_, page = getLogs(t, store, "?limit=2&cursor="+page.NextCursor)
+	numberEqual(t, len(page.Entries), 1)
+	stringEqual(t, page.Entries[0].Date, "Wed Mar 1 2017")
+	stringEqual(t, page.NextCursor, "")
+}
+
+func TestLogsFilters(t *testing.T) {
+	store := createLogHistory(t)
+
+	_, logs := getLogs(t, store, "?user=sam")
+	numberEqual(t, len(logs.Entries), 2)
+	stringEqual(t, logs.Entries[0].User, "sam")
+
+	_, logs = getLogs(t, store, "?from=2017-03-02&to=2017-03-03")
+	numberEqual(t, len(logs.Entries), 2)
+	stringEqual(t, logs.Entries[0].Date, "Fri Mar 3 2017")
+	stringEqual(t, logs.Entries[1].Date, "Thu Mar 2 2017")
+
+	_, logs = getLogs(t, store, "?type=state_changed&door=garage&limit=1")
+	numberEqual(t, len(logs.Entries), 1)
+	stringEqual(t, logs.Entries[0].Event, EventStateChanged)
+	stringEqual(t, logs.Entries[0].Type, "Open")
+
+	_, logs = getLogs(t, store, "?type=command_issued,state_changed")
+	numberEqual(t, len(logs.Entries), 10)
+
+	_, logs = getLogs(t, store, "?door=shed")
+	numberEqual(t, len(logs.Entries), 0)
+}
+
+func TestLogsDatesInTimeZone(t *testing.T) {
+	store := CreateTestStore(t)
+	store.Append(HistoryEvent{Time: time.Date(2017, 3, 1, 23, 30, 0, 0, time.UTC), Type: EventCommandIssued, User: "dillon", Door: "garage", Outcome: OutcomeSuccess, Detail: "toggle"})
+
+	// 23:30 UTC is already 2 March in Tokyo.
+	_, logs := getLogs(t, store, "?from=2017-03-02&tz=Asia/Tokyo")
+	numberEqual(t, len(logs.Entries), 1)
+	_, logs = getLogs(t, store, "?from=2017-03-02&tz=UTC")
+	numberEqual(t, len(logs.Entries), 0)
+	_, logs = getLogs(t, store, "?to=2017-03-01&tz=Asia/Tokyo")
+	numberEqual(t, len(logs.Entries), 0)
+}
+
+func TestInvalidLogsParameters(t *testing.T) {
+	store := createLogHistory(t)
+
+	for _, query := range []string{"?from=yesterday", "?to=2017-13-01", "?limit=0", "?cursor=abc", "?tz=Mars/Olympus", "?locale=tlh"} {
+		writer, _ := getLogs(t, store, query)
+		responseEqual(t, writer.Code, 400)
+		stringEqual(t, decodeAPIError(t, writer).Code, "invalid_parameter")
+	}
+}
+
+func TestLogsStoreError(t *testing.T) {
+	store := createLogHistory(t)
+	CorruptTestStore(t, store)
+
+	writer, _ := getLogs(t, store, "")
+	responseEqual(t, writer.Code, 500)
+	apiErr := decodeAPIError(t, writer)
+	stringEqual(t, apiErr.Code, "store_unavailable")
+	stringEqual(t, apiErr.Message, "Could not read event store: "+store.path+":1: invalid character 'x' looking for beginning of value")
+}
+
+func TestLogsTimeZoneAndLocale(t *testing.T) {
+	store := CreateTestStore(t)
+	store.Append(HistoryEvent{Time: time.Date(2017, 3, 4, 23, 30, 0, 0, time.UTC), Type: EventCommandIssued, Outcome: OutcomeSuccess, Detail: "toggle"})
+
+	// Without tz the time stays in the zone it was recorded in.
+	_, logs := getLogs(t, store, "")
+	stringEqual(t, logs.Entries[0].Timestamp, "2017-03-04T23:30:00Z")
+
+	_, logs = getLogs(t, store, "?tz=UTC")
+	stringEqual(t, logs.Entries[0].Date, "Sat Mar 4 2017")
+	stringEqual(t, logs.Entries[0].Time, "11:30 PM")
+	stringEqual(t, logs.Entries[0].Timestamp, "2017-03-04T23:30:00Z")
+
+	_, logs = getLogs(t, store, "?tz=Europe/Berlin&locale=de-DE")
+	stringEqual(t, logs.Entries[0].Date, "So, 5. Mär 2017")
+	stringEqual(t, logs.Entries[0].Time, "00:30")
+	stringEqual(t, logs.Entries[0].Timestamp, "2017-03-05T00:30:00+01:00")
+
+	_, logs = getLogs(t, store, "?tz=America/Chicago&locale=en-GB")
+	stringEqual(t, logs.Entries[0].Date, "Sat 4 Mar 2017")
+	stringEqual(t, logs.Entries[0].Time, "17:30")
+}
+
+func TestLogsAcceptLanguage(t *testing.T) {
+	store := CreateTestStore(t)
+	store.Append(HistoryEvent{Time: time.Date(2017, 3, 4, 9, 5, 0, 0, time.UTC), Type: EventCommandIssued, Outcome: OutcomeSuccess, Detail: "toggle"})
+
+	for header, expected := range map[string]string{
+		"":                         "sáb 4 mar 2017 09:05",
+		"fr-CA, fr;q=0.9":          "sam. 4 mars 2017 09:05",
+		"ja, es;q=0.5, de;q=0.8":   "Sa, 4. Mär 2017 09:05",
+		"ja, *;q=0.1":              "Sat Mar 4 2017 9:05 AM",
+		"en-GB;q=0.2, en-US;q=0.9": "Sat Mar 4 2017 9:05 AM",
+	} {
+		query := "?tz=UTC"
+		if header == "" {
+			// An explicit locale wins over the header.
+			query += "&locale=es"
+			header = "de"
+		}
+		writer := httptest.NewRecorder()
+		req := signedRequest(t, "GET", "/api/v2/logs"+query, SharedSecret)
+		req.Header.Set("Accept-Language", header)
+		APILogsHandler(DummyLogger, store)(writer, req)
+
+		var logs Logs
+		if err := json.NewDecoder(writer.Body).Decode(&logs); err != nil {
+			t.Fatal(err)
+		}
+		stringEqual(t, logs.Entries[0].Date+" "+logs.Entries[0].Time, expected)
+	}
+}
@@ -1,52 +1,230 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"path/filepath"
+	"time"
 
 	"github.com/dillonhafer/garage-server/door"
 )
 
-const Version = "6.0.0"
-
 var options struct {
 	http            string
 	pinNumber       int
 	statusPinNumber int
 	sleepTimeout    int
+	pollInterval    int
+	heartbeat       int
+	sessionTimeout  int
 	cert            string
 	key             string
 	log             string
+	logFormat       string
+	logLevel        string
+	logMaxSize      int
+	logMaxAge       int
+	logKeep         int
+	syslog          string
+	journald        bool
+	events          string
+	auditKey        string
+	door            string
 	version         bool
+	legacyAPI       bool
+	metricsAllow    string
+	otlpEndpoint    string
+	webhooks        string
+
+	mqtt                string
+	mqttCA              string
+	mqttPrefix          string
+	mqttDiscoveryPrefix string
+
+	homekit     string
+	homekitAddr string
+
+	notify string
+	smtp   string
+	smtpCA string
 }
 
 var SharedSecret = os.Getenv("GARAGE_SECRET")
 
+const defaultEventStore = "/var/lib/garage-server/events.jsonl"
+
+// openEventStore opens the store at path chained with the server's audit
+// key, which is created the first time.
+func openEventStore(path string) (*EventStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	keyPath := auditKeyPath(path)
+	key, created, err := LoadAuditKey(keyPath, true)
+	if err != nil {
+		return nil, err
+	}
+
+	var store *EventStore
+	if _, err := os.Stat(auditHeadPath(path)); !created || err != nil || SharedSecret == "" {
+		store, err = OpenEventStore(path, key)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		// The store was chained from GARAGE_SECRET before the server had
+		// a key of its own. It has to pass its audit with that before it
+		// is signed again with the new key.
+		store, err = OpenEventStore(path, legacyAuditKey(SharedSecret))
+		if err == nil {
+			if err = store.Rekey(key); err != nil {
+				store.Close()
+				err = fmt.Errorf("could not sign events with the new audit key: %s", err)
+			}
+		}
+		if err != nil {
+			// Left for the next run to try again.
+			os.Remove(keyPath)
+			return nil, err
+		}
+	}
+
+	if len(store.torn) > 0 {
+		fmt.Fprintf(os.Stderr, "Dropped a partial last line from %s, likely cut short by a crash: %q\n", path, store.torn)
+	}
+	return store, nil
+}
+
+// auditKeyPath is where the audit key for the store at path is kept: the
+// -audit-key file, or the store's path with .key appended.
+func auditKeyPath(path string) string {
+	if options.auditKey != "" {
+		return options.auditKey
+	}
+	return path + ".key"
+}
+
+// logSinks opens the outputs chosen with -log, -syslog and -journald, or
+// stderr if none was.
+func logSinks() ([]LogSink, error) {
+	var streamSink func(io.Writer) LogSink
+	switch options.logFormat {
+	case "text":
+		streamSink = NewTextSink
+	case "json":
+		streamSink = NewJSONSink
+	default:
+		return nil, fmt.Errorf("unknown log format '%s'", options.logFormat)
+	}
+
+	var sinks []LogSink
+	if options.log != "" {
+		logFile, err := OpenRotatingFile(options.log, int64(options.logMaxSize)<<20, time.Duration(options.logMaxAge)*24*time.Hour, options.logKeep)
+		if err != nil {
+			return nil, fmt.Errorf("Could not open log: %s", err)
+		}
+		sinks = append(sinks, streamSink(logFile))
+	}
+	if options.syslog != "" {
+		sink, err := NewSyslogSink(options.syslog)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, sink)
+	}
+	if options.journald {
+		sinks = append(sinks, NewJournaldSink(journalSocket))
+	}
+	if len(sinks) == 0 {
+		sinks = append(sinks, streamSink(os.Stderr))
+	}
+	return sinks, nil
+}
+
 func main() {
 	if len(os.Args) > 1 && os.Args[1] == "update" {
-		CheckForUpdates()
+		updateFlags := flag.NewFlagSet("update", flag.ExitOnError)
+		updateFlags.StringVar(&options.events, "events", defaultEventStore, "Path of the event store to record the update in")
+		updateFlags.StringVar(&options.auditKey, "audit-key", "", "Path of the server's audit key (default: the event store's path with .key appended)")
+		updateFlags.Parse(os.Args[2:])
+
+		// The server usually has the store open, so the update is left for
+		// it to record when it is restarted.
+		record := func(event HistoryEvent) {
+			event.Time = time.Now()
+			store, err := openEventStore(options.events)
+			if err == ErrStoreInUse {
+				err = QueuePendingEvent(options.events, event)
+			} else if err == nil {
+				_, err = store.Append(event)
+				store.Close()
+			}
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Could not record the update:", err)
+			}
+		}
+		CheckForUpdates(record)
 		os.Exit(0)
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "import-logs" {
+		os.Exit(runImportLogs(os.Args[2:]))
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAudit(os.Args[2:]))
+	}
+
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "usage:  %s [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "        %s update [-events path] [-audit-key path]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "        %s import-logs [-events path] [-audit-key path] <file>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "        %s audit verify [-events path] [-audit-key path]\n", os.Args[0])
 		flag.PrintDefaults()
 	}
 
 	flag.IntVar(&options.pinNumber, "pin", 25, "GPIO pin of relay")
 	flag.IntVar(&options.statusPinNumber, "status-pin", 10, "GPIO pin of reed switch")
 	flag.IntVar(&options.sleepTimeout, "sleep", 100, "Time in milliseconds to keep switch closed")
+	flag.IntVar(&options.pollInterval, "poll", 1000, "Time in milliseconds between door status checks")
+	flag.IntVar(&options.heartbeat, "heartbeat", 15, "Time in seconds between heartbeats on idle event streams")
+	flag.IntVar(&options.sessionTimeout, "session-timeout", 60, "Time in minutes a control channel stays authorized")
 	flag.StringVar(&options.http, "http", "", "HTTP listen address (e.g. 127.0.0.1:8225)")
 	flag.StringVar(&options.cert, "cert", "", "SSL certificate path (e.g. /ssl/example.com.cert)")
 	flag.StringVar(&options.key, "key", "", "SSL certificate key (e.g. /ssl/example.com.key)")
-	flag.StringVar(&options.log, "log", "", "Path to read logs from")
+	flag.StringVar(&options.log, "log", "", "Path of the server log, which is rotated and compressed (default stderr)")
+	flag.IntVar(&options.logMaxSize, "log-max-size", 10, "Size in megabytes at which the server log is rotated (0 for no limit)")
+	flag.IntVar(&options.logMaxAge, "log-max-age", 7, "Time in days after which the server log is rotated (0 for no limit)")
+	flag.IntVar(&options.logKeep, "log-keep", 5, "Number of rotated server logs to keep (0 keeps all)")
+	flag.StringVar(&options.logFormat, "log-format", "text", "Format of the server log on stderr or in -log: text or json")
+	flag.StringVar(&options.syslog, "syslog", "", "Log to syslog at udp://host:port, tcp://host:port or unix:///dev/log")
+	flag.BoolVar(&options.journald, "journald", false, "Log to the systemd journal")
+	flag.StringVar(&options.logLevel, "log-level", "info", "Least severe level to log: debug, info, warn or error")
+	flag.StringVar(&options.events, "events", defaultEventStore, "Path of the event store")
+	flag.StringVar(&options.auditKey, "audit-key", "", "Path of the key that signs the event store, created if missing (default: the event store's path with .key appended)")
+	flag.StringVar(&options.door, "door", "garage", "Name of the door recorded in events")
+	flag.StringVar(&options.metricsAllow, "metrics-allow", "", "Comma-separated IP addresses and CIDR ranges allowed to scrape /metrics")
+	flag.StringVar(&options.otlpEndpoint, "otlp-endpoint", os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"), "OpenTelemetry collector to export traces to over OTLP/HTTP (e.g. http://127.0.0.1:4318)")
+	flag.StringVar(&options.mqtt, "mqtt", "", "MQTT broker to publish the door to (e.g. mqtts://garage@broker.local:8883)")
+	flag.StringVar(&options.mqttCA, "mqtt-ca", "", "CA certificate to verify the MQTT broker with (default system roots)")
+	flag.StringVar(&options.mqttPrefix, "mqtt-prefix", "garage", "Prefix of the door's MQTT topics")
+	flag.StringVar(&options.mqttDiscoveryPrefix, "mqtt-discovery-prefix", "homeassistant", "Home Assistant MQTT discovery prefix")
+	flag.StringVar(&options.homekit, "homekit", "", "Directory to keep HomeKit pairings in; serves the door to HomeKit (e.g. /var/lib/garage-server/homekit)")
+	flag.StringVar(&options.homekitAddr, "homekit-addr", "", "HomeKit listen address (default any free port)")
+	flag.StringVar(&options.notify, "notify", "", "JSON file of who to email about what; needs -smtp")
+	flag.StringVar(&options.smtp, "smtp", "", "Mail server to send notifications through (e.g. smtps://garage@mail.example.com:465)")
+	flag.StringVar(&options.smtpCA, "smtp-ca", "", "CA certificate to verify the mail server with (default system roots)")
+	flag.StringVar(&options.webhooks, "webhooks", "", "JSON file of webhook subscriptions to post events to")
+	flag.BoolVar(&options.legacyAPI, "legacy-api", true, "Serve the unversioned routes (/toggle, /status, ...) alongside /api/v2")
 	flag.BoolVar(&options.version, "version", false, "print version and exit")
 	flag.Parse()
 
 	if options.version {
-		fmt.Printf("garage-server v%v\n", Version)
+		fmt.Println(versionString())
 		os.Exit(0)
 	}
 
@@ -55,34 +233,159 @@ func main() {
 		os.Exit(1)
 	}
 
+	// A zero poll would spin, and the heartbeat ticker panics on anything
+	// less than one.
+	if options.pollInterval <= 0 {
+		fmt.Fprintln(os.Stderr, "-poll must be at least 1 millisecond")
+		os.Exit(2)
+	}
+	if options.heartbeat <= 0 {
+		fmt.Fprintln(os.Stderr, "-heartbeat must be at least 1 second")
+		os.Exit(2)
+	}
+
+	level, err := ParseLevel(options.logLevel)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	sinks, err := logSinks()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	baseLogger := NewLogger(level, sinks...)
+
 	serveAddress := "127.0.0.1:8225"
 	if options.http != "" {
 		serveAddress = options.http
 	}
 
-	Relay := CreateRelayHandle(door.ToggleSwitch, apiLogHandler, options.pinNumber, options.sleepTimeout)
-	Status := CreateDoorStatusHandler(door.CheckDoorStatus, apiLogHandler, options.statusPinNumber)
-	AppVersion := CreateVersionHandler(apiLogHandler)
-	Logs := CreateLogsHandler(apiLogHandler, options.log)
+	store, err := openEventStore(options.events)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not open event store:", err)
+		os.Exit(1)
+	}
+
+	metricsAccess, err := metricsAccessFromOptions()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid -metrics-allow:", err)
+		os.Exit(2)
+	}
+	metrics := NewMetrics(Version)
+	doorStatus := metrics.DoorStatus(door.CheckDoorStatus)
 
-	http.HandleFunc("/toggle", Relay)
-	http.HandleFunc("/status", Status)
-	http.HandleFunc("/version", AppVersion)
-	http.HandleFunc("/logs", Logs)
+	hub := NewEventHub(100)
+	logger := hub.Logger(baseLogger.With(Field{"door", options.door}))
+
+	var notifier *Notifier
+	if options.notify != "" {
+		notifier, err = notifierFromOptions(logger)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -notify:", err)
+			os.Exit(2)
+		}
+		store.OnAppend(notifier.Observe)
+		logger = logger.WithHook(notifier.LogHook)
+		go notifier.Run()
+	}
+
+	tracer, err := tracerFromOptions(logger)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Invalid OTEL_EXPORTER_OTLP_HEADERS:", err)
+		os.Exit(2)
+	}
+
+	var webhooks *WebhookDispatcher
+	if options.webhooks != "" {
+		subscriptions, err := LoadWebhookSubscriptions(options.webhooks)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -webhooks:", err)
+			os.Exit(2)
+		}
+		webhooks, err = NewWebhookDispatcher(subscriptions, webhookQueuePath(options.events), logger)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not open webhook queue:", err)
+			os.Exit(1)
+		}
+		store.OnAppend(webhooks.Enqueue)
+		go webhooks.Run()
+	}
+
+	watcher := NewDoorWatcher(doorStatus, logger, options.statusPinNumber, hub)
+	RecordStateChanges(watcher, store, options.door, logger)
+	go watcher.Run(time.Duration(options.pollInterval) * time.Millisecond)
+
+	cert := ""
+	if options.key != "" && options.cert != "" {
+		cert = options.cert
+	}
+
+	config := RouteConfig{
+		Hub:            hub,
+		Watcher:        watcher,
+		DoorStatus:     doorStatus,
+		ToggleSwitch:   metrics.Relay(hub.Relay(door.ToggleSwitch)),
+		CheckGPIO:      door.CheckGPIO,
+		Logger:         logger,
+		Store:          store,
+		Door:           options.door,
+		Control:        NewDoorControl(),
+		PinNumber:      options.pinNumber,
+		StatusPin:      options.statusPinNumber,
+		SleepTimeout:   options.sleepTimeout,
+		Heartbeat:      time.Duration(options.heartbeat) * time.Second,
+		SessionTimeout: time.Duration(options.sessionTimeout) * time.Minute,
+		Legacy:         options.legacyAPI,
+		Metrics:        metrics,
+		MetricsAccess:  metricsAccess,
+		Tracer:         tracer,
+		Cert:           cert,
+		Webhooks:       webhooks,
+		Notifier:       notifier,
+	}
+
+	if options.mqtt != "" {
+		mqttConfig, err := mqttConfigFromOptions()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -mqtt:", err)
+			os.Exit(2)
+		}
+		config.MQTT = NewMQTTBridge(mqttConfig, config)
+		go config.MQTT.Run()
+	}
+
+	if options.homekit != "" {
+		homeKit, err := NewHomeKitBridge(options.homekit, options.homekitAddr, config)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Could not start HomeKit:", err)
+			os.Exit(1)
+		}
+		fmt.Fprintln(os.Stderr, "=> HomeKit setup code:", homeKit.SetupCode())
+		go func() {
+			if err := homeKit.Run(context.Background()); err != nil {
+				logger.Error("HomeKit stopped", Field{"error", err})
+			}
+		}()
+		config.HomeKit = homeKit
+	}
+	handler := NewRouter(config)
 
 	fmt.Fprintln(os.Stderr, "=> Booting Garage Server ", Version)
 	fmt.Fprintln(os.Stderr, "=> Run `garage-server -h` for more startup options")
 	fmt.Fprintln(os.Stderr, "=> Ctrl-C to shutdown server")
 
-	var err error
 	if options.key != "" && options.cert != "" {
 		fmt.Fprintln(os.Stderr, fmt.Sprintf("* Listening on https://%s", serveAddress))
-		err = http.ListenAndServeTLS(serveAddress, options.cert, options.key, nil)
+		err = http.ListenAndServeTLS(serveAddress, options.cert, options.key, handler)
 	} else {
 		fmt.Fprintln(os.Stderr, fmt.Sprintf("* Listening on http://%s", serveAddress))
-		err = http.ListenAndServe(serveAddress, nil)
+		err = http.ListenAndServe(serveAddress, handler)
 	}
 
+	if tracer != nil {
+		tracer.Close()
+	}
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	requestDurationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+	pulseDurationBuckets   = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+)
+
+// histogram counts observations into cumulative buckets, as Prometheus
+// expects them.
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+type requestLabels struct {
+	handler string
+	method  string
+	code    int
+}
+
+// Metrics counts what the server does for /metrics: relay pulses, auth
+// failures, GPIO errors, the door state and how long requests take.
+type Metrics struct {
+	mu             sync.Mutex
+	version        string
+	toggles        uint64
+	authFailures   map[string]uint64
+	gpioErrors     map[string]uint64
+	doorState      string
+	requests       map[requestLabels]*histogram
+	pulseDurations *histogram
+}
+
+func NewMetrics(version string) *Metrics {
+	m := &Metrics{
+		version:        version,
+		authFailures:   map[string]uint64{},
+		gpioErrors:     map[string]uint64{"read": 0, "write": 0},
+		doorState:      "unknown",
+		requests:       map[requestLabels]*histogram{},
+		pulseDurations: newHistogram(pulseDurationBuckets),
+	}
+	// Every reason is listed from the start, so a rate over a counter that
+	// appears mid-range isn't missed.
+	for _, code := range authErrorCodes {
+		m.authFailures[code] = 0
+	}
+	return m
+}
+
+// Relay counts each pulse of toggleSwitch and how long it took, and a
+// failed pulse as a GPIO write error.
+func (m *Metrics) Relay(toggleSwitch func(context.Context, int, int) error) func(context.Context, int, int) error {
+	return func(ctx context.Context, pin int, sleepTimeout int) error {
+		start := time.Now()
+		err := toggleSwitch(ctx, pin, sleepTimeout)
+		elapsed := time.Since(start).Seconds()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if err != nil {
+			m.gpioErrors["write"]++
+			return err
+		}
+		m.toggles++
+		m.pulseDurations.observe(elapsed)
+		return nil
+	}
+}
+
+// DoorStatus keeps the door state gauge up to date with every read of
+// doorStatus, and counts failed reads as GPIO read errors.
+func (m *Metrics) DoorStatus(doorStatus func(context.Context, int) (string, error)) func(context.Context, int) (string, error) {
+	return func(ctx context.Context, pin int) (string, error) {
+		status, err := doorStatus(ctx, pin)
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if err != nil {
+			m.gpioErrors["read"]++
+			m.doorState = "unknown"
+		} else {
+			m.doorState = status
+		}
+		return status, err
+	}
+}
+
+const metricsKey contextKey = "metrics"
+
+// countAuthFailure counts a rejected signature against the metrics of the
+// router serving req, if it has any.
+func countAuthFailure(req *http.Request, err error) {
+	m, ok := req.Context().Value(metricsKey).(*Metrics)
+	if !ok {
+		return
+	}
+	reason, ok := authErrorCodes[err]
+	if !ok {
+		reason = "other"
+	}
+	m.mu.Lock()
+	m.authFailures[reason]++
+	m.mu.Unlock()
+}
+
+var metricsMethods = map[string]bool{"GET": true, "HEAD": true, "POST": true, "PUT": true, "PATCH": true, "DELETE": true, "OPTIONS": true}
+
+// Handler times every request served by h. Requests are labelled with the
+// mux pattern they matched rather than their path, so unknown paths can't
+// add a series each.
+func (m *Metrics) Handler(mux *http.ServeMux, h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		recorder := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(recorder, req.WithContext(context.WithValue(req.Context(), metricsKey, m)))
+
+		labels := requestLabels{handler: "other", method: "other", code: recorder.status}
+		if _, pattern := mux.Handler(req); pattern != "" && pattern != "/api/v2/" {
+			labels.handler = pattern
+		}
+		if metricsMethods[req.Method] {
+			labels.method = req.Method
+		}
+		if labels.code == 0 {
+			labels.code = http.StatusOK
+		}
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		requests, ok := m.requests[labels]
+		if !ok {
+			requests = newHistogram(requestDurationBuckets)
+			m.requests[labels] = requests
+		}
+		requests.observe(time.Since(start).Seconds())
+	})
+}
+
+var metricsLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatMetricsLabels(pairs ...string) string {
+	if len(pairs) == 0 {
+		return ""
+	}
+	var labels []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		labels = append(labels, fmt.Sprintf(`%s="%s"`, pairs[i], metricsLabelEscaper.Replace(pairs[i+1])))
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+func formatMetricsValue(value float64) string {
+	if math.IsInf(value, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func writeMetricsHeader(buf *bytes.Buffer, name string, kind string, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func writeHistogram(buf *bytes.Buffer, name string, h *histogram, labels ...string) {
+	for i, bound := range h.buckets {
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", name, formatMetricsLabels(append(labels, "le", formatMetricsValue(bound))...), h.counts[i])
+	}
+	fmt.Fprintf(buf, "%s_bucket%s %d\n", name, formatMetricsLabels(append(labels, "le", "+Inf")...), h.count)
+	fmt.Fprintf(buf, "%s_sum%s %s\n", name, formatMetricsLabels(labels...), formatMetricsValue(h.sum))
+	fmt.Fprintf(buf, "%s_count%s %d\n", name, formatMetricsLabels(labels...), h.count)
+}
+
+func sortedKeys(counts map[string]uint64) []string {
+	var keys []string
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Render writes the metrics out in the Prometheus text format.
+func (m *Metrics) Render() []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var buf bytes.Buffer
+	writeMetricsHeader(&buf, "garage_build_info", "gauge", "The running version of garage-server.")
+	fmt.Fprintf(&buf, "garage_build_info%s 1\n", formatMetricsLabels("version", m.version))
+
+	writeMetricsHeader(&buf, "garage_toggles_total", "counter", "Relay pulses sent to the door.")
+	fmt.Fprintf(&buf, "garage_toggles_total %d\n", m.toggles)
+
+	writeMetricsHeader(&buf, "garage_auth_failures_total", "counter", "Requests rejected for a bad signature, by reason.")
+	for _, reason := range sortedKeys(m.authFailures) {
+		fmt.Fprintf(&buf, "garage_auth_failures_total%s %d\n", formatMetricsLabels("reason", reason), m.authFailures[reason])
+	}
+
+	writeMetricsHeader(&buf, "garage_gpio_errors_total", "counter", "Failed reads of the reed switch and writes to the relay.")
+	for _, operation := range sortedKeys(m.gpioErrors) {
+		fmt.Fprintf(&buf, "garage_gpio_errors_total%s %d\n", formatMetricsLabels("operation", operation), m.gpioErrors[operation])
+	}
+
+	writeMetricsHeader(&buf, "garage_door_state", "gauge", "1 for the door's last read state.")
+	for _, state := range []string{"closed", "open", "unknown"} {
+		value := 0
+		if m.doorState == state {
+			value = 1
+		}
+		fmt.Fprintf(&buf, "garage_door_state%s %d\n", formatMetricsLabels("state", state), value)
+	}
+
+	writeMetricsHeader(&buf, "garage_relay_pulse_duration_seconds", "histogram", "Time taken to pulse the relay.")
+	writeHistogram(&buf, "garage_relay_pulse_duration_seconds", m.pulseDurations)
+
+	writeMetricsHeader(&buf, "garage_http_request_duration_seconds", "histogram", "Time taken to serve requests, by route, method and status.")
+	var labels []requestLabels
+	for label := range m.requests {
+		labels = append(labels, label)
+	}
+	sort.Slice(labels, func(i, j int) bool {
+		if labels[i].handler != labels[j].handler {
+			return labels[i].handler < labels[j].handler
+		}
+		if labels[i].method != labels[j].method {
+			return labels[i].method < labels[j].method
+		}
+		return labels[i].code < labels[j].code
+	})
+	for _, label := range labels {
+		writeHistogram(&buf, "garage_http_request_duration_seconds", m.requests[label],
+			"handler", label.handler, "method", label.method, "code", strconv.Itoa(label.code))
+	}
+	return buf.Bytes()
+}
+
+// MetricsAccess says who may scrape /metrics: clients sending Token as a
+// bearer token, and clients connecting from Allow. With neither set nobody
+// may.
+type MetricsAccess struct {
+	Token string
+	Allow []*net.IPNet
+}
+
+// ParseMetricsAllow reads a comma-separated list of IP addresses and CIDR
+// ranges.
+func ParseMetricsAllow(list string) ([]*net.IPNet, error) {
+	var allow []*net.IPNet
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address '%s'", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			allow = append(allow, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid range '%s'", entry)
+		}
+		allow = append(allow, network)
+	}
+	return allow, nil
+}
+
+func (a MetricsAccess) allows(req *http.Request) bool {
+	if a.Token != "" {
+		authorization := req.Header.Get("Authorization")
+		token := strings.TrimPrefix(authorization, "Bearer ")
+		if token != authorization && subtle.ConstantTimeCompare([]byte(token), []byte(a.Token)) == 1 {
+			return true
+		}
+	}
+	if ip := net.ParseIP(sourceIP(req)); ip != nil {
+		for _, network := range a.Allow {
+			if network.Contains(ip) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MetricsHandler serves m to the scrapers access lets in. It is guarded
+// separately from the signed API, since Prometheus can't sign requests.
+func MetricsHandler(m *Metrics, access MetricsAccess, logger *Logger) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if !access.allows(req) {
+			apiErr := &APIError{Status: http.StatusForbidden, Code: "metrics_forbidden", Message: "Not allowed to scrape metrics"}
+			if access.Token == "" && len(access.Allow) == 0 {
+				apiErr.Message = "Metrics are disabled; set GARAGE_METRICS_TOKEN or -metrics-allow"
+			}
+			logAPIError(requestLogger(logger, req), apiErr)
+			writeAPIError(w, req, apiErr)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		w.Write(m.Render())
+	})
+}
+
+// metricsAccessFromOptions builds the /metrics access rules from the
+// environment and flags.
+func metricsAccessFromOptions() (MetricsAccess, error) {
+	allow, err := ParseMetricsAllow(options.metricsAllow)
+	if err != nil {
+		return MetricsAccess{}, err
+	}
+	return MetricsAccess{Token: os.Getenv("GARAGE_METRICS_TOKEN"), Allow: allow}, nil
+}
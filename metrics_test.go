@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func scrapeMetrics(t *testing.T, router http.Handler, configure func(*http.Request)) *httptest.ResponseRecorder {
+	req, err := http.NewRequest("GET", "/metrics", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.RemoteAddr = "192.168.1.20:41234"
+	configure(req)
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, req)
+	return writer
+}
+
+func withMetricsToken(token string) func(*http.Request) {
+	return func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+func expectMetric(t *testing.T, body string, line string) {
+	t.Helper()
+	for _, got := range strings.Split(body, "\n") {
+		if got == line {
+			return
+		}
+	}
+	t.Errorf("expected '%s' in:\n%s", line, body)
+}
+
+func TestMetrics(t *testing.T) {
+	config := CreateTestRouteConfig(t, true, "open", false)
+	config.Metrics = NewMetrics("1.2.3")
+	config.DoorStatus = config.Metrics.DoorStatus(config.DoorStatus)
+	config.ToggleSwitch = config.Metrics.Relay(config.ToggleSwitch)
+	router := NewRouter(config)
+
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, signedRequest(t, "POST", "/api/v2/toggle", SharedSecret))
+	responseEqual(t, writer.Code, 200)
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, signedRequest(t, "GET", "/api/v2/status", SharedSecret))
+	responseEqual(t, writer.Code, 200)
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, signedRequest(t, "GET", "/api/v2/status", "Unverified Signature"))
+	responseEqual(t, writer.Code, 403)
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, signedRequest(t, "GET", "/api/v2/nothing-here", SharedSecret))
+	responseEqual(t, writer.Code, 404)
+
+	writer = scrapeMetrics(t, router, withMetricsToken(testMetricsToken))
+	responseEqual(t, writer.Code, 200)
+	stringEqual(t, writer.Header().Get("Content-Type"), "text/plain; version=0.0.4; charset=utf-8")
+	body := writer.Body.String()
+
+	expectMetric(t, body, `garage_build_info{version="1.2.3"} 1`)
+	expectMetric(t, body, "# TYPE garage_toggles_total counter")
+	expectMetric(t, body, "garage_toggles_total 1")
+	expectMetric(t, body, `garage_auth_failures_total{reason="invalid_signature"} 1`)
+	expectMetric(t, body, `garage_auth_failures_total{reason="expired_timestamp"} 0`)
+	expectMetric(t, body, `garage_gpio_errors_total{operation="read"} 0`)
+	expectMetric(t, body, `garage_door_state{state="open"} 1`)
+	expectMetric(t, body, `garage_door_state{state="closed"} 0`)
+	expectMetric(t, body, "# TYPE garage_relay_pulse_duration_seconds histogram")
+	expectMetric(t, body, `garage_relay_pulse_duration_seconds_bucket{le="+Inf"} 1`)
+	expectMetric(t, body, "garage_relay_pulse_duration_seconds_count 1")
+	expectMetric(t, body, `garage_http_request_duration_seconds_count{handler="/api/v2/toggle",method="POST",code="200"} 1`)
+	expectMetric(t, body, `garage_http_request_duration_seconds_bucket{handler="/api/v2/status",method="GET",code="403",le="+Inf"} 1`)
+	// Unknown paths share one series.
+	expectMetric(t, body, `garage_http_request_duration_seconds_count{handler="other",method="GET",code="404"} 1`)
+}
+
+func TestMetricsGPIOErrors(t *testing.T) {
+	metrics := NewMetrics(Version)
+	metrics.DoorStatus(CreateDummyStatus("error"))(context.Background(), 10)
+	metrics.Relay(CreateDummyRelay(true))(context.Background(), 25, 1)
+
+	body := string(metrics.Render())
+	expectMetric(t, body, `garage_gpio_errors_total{operation="read"} 1`)
+	expectMetric(t, body, `garage_gpio_errors_total{operation="write"} 1`)
+	expectMetric(t, body, `garage_door_state{state="unknown"} 1`)
+	expectMetric(t, body, "garage_toggles_total 0")
+}
+
+func TestMetricsAccess(t *testing.T) {
+	allow, err := ParseMetricsAllow("10.0.0.5, 192.168.1.0/24")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		access    MetricsAccess
+		configure func(*http.Request)
+		expected  int
+	}{
+		{MetricsAccess{Token: "secret"}, withMetricsToken("secret"), 200},
+		{MetricsAccess{Token: "secret"}, withMetricsToken("wrong"), 403},
+		{MetricsAccess{Token: "secret"}, func(req *http.Request) { req.Header.Set("Authorization", "secret") }, 403},
+		// The signature that works everywhere else doesn't work here.
+		{MetricsAccess{Token: "secret"}, func(req *http.Request) {
+			*req = *signedRequest(t, "GET", "/metrics", SharedSecret)
+		}, 403},
+		{MetricsAccess{Allow: allow}, func(*http.Request) {}, 200},
+		{MetricsAccess{Allow: allow}, func(req *http.Request) { req.RemoteAddr = "10.0.0.5:9090" }, 200},
+		{MetricsAccess{Allow: allow}, func(req *http.Request) { req.RemoteAddr = "10.0.0.6:9090" }, 403},
+		{MetricsAccess{}, func(*http.Request) {}, 403},
+	}
+
+	for i, test := range tests {
+		config := CreateTestRouteConfig(t, false, "closed", false)
+		config.MetricsAccess = test.access
+		writer := scrapeMetrics(t, NewRouter(config), test.configure)
+		if writer.Code != test.expected {
+			t.Errorf("%d: expected %d, got %d", i, test.expected, writer.Code)
+		}
+		if writer.Code == 403 {
+			stringEqual(t, decodeAPIError(t, writer).Code, "metrics_forbidden")
+		}
+	}
+}
+
+func TestParseMetricsAllow(t *testing.T) {
+	allow, err := ParseMetricsAllow("127.0.0.1,::1,10.0.0.0/8")
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, len(allow), 3)
+	stringEqual(t, allow[0].String(), "127.0.0.1/32")
+	stringEqual(t, allow[1].String(), "::1/128")
+
+	for _, list := range []string{"localhost", "10.0.0.0/33"} {
+		if _, err := ParseMetricsAllow(list); err == nil {
+			t.Errorf("expected '%s' to be rejected", list)
+		}
+	}
+}
@@ -0,0 +1,532 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MQTT 3.1.1 control packet types, in the high nibble of the first byte.
+const (
+	mqttConnect     = 1
+	mqttConnack     = 2
+	mqttPublish     = 3
+	mqttPuback      = 4
+	mqttPubrec      = 5
+	mqttPubrel      = 6
+	mqttPubcomp     = 7
+	mqttSubscribe   = 8
+	mqttSuback      = 9
+	mqttPingreq     = 12
+	mqttPingresp    = 13
+	mqttDisconnect  = 14
+	mqttMaxPacket   = 256 << 10
+	mqttDialTimeout = 10 * time.Second
+)
+
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client identifier rejected",
+	3: "server unavailable",
+	4: "bad user name or password",
+	5: "not authorized",
+}
+
+// Reconnects back off from mqttBackoffMin, doubling to mqttBackoffMax.
+var (
+	mqttBackoffMin = time.Second
+	mqttBackoffMax = time.Minute
+)
+
+// MQTTConfig is where and how the bridge connects.
+type MQTTConfig struct {
+	Address         string
+	TLS             *tls.Config
+	Username        string
+	Password        string
+	ClientID        string
+	Prefix          string
+	DiscoveryPrefix string
+	KeepAlive       time.Duration
+}
+
+// ParseMQTTBroker reads -mqtt: tcp://, mqtt://, ssl://, tls:// or mqtts://
+// with an optional user, e.g. mqtts://garage@broker.local. Secure schemes
+// verify the broker against the system roots, or against ca if it is set.
+func ParseMQTTBroker(broker string, password string, ca string) (MQTTConfig, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return MQTTConfig{}, err
+	}
+	config := MQTTConfig{Address: u.Host, Password: password, KeepAlive: 30 * time.Second}
+	port := "1883"
+	switch u.Scheme {
+	case "tcp", "mqtt":
+	case "ssl", "tls", "mqtts":
+		port = "8883"
+		config.TLS = &tls.Config{ServerName: u.Hostname()}
+		if ca != "" {
+			pem, err := ioutil.ReadFile(ca)
+			if err != nil {
+				return MQTTConfig{}, err
+			}
+			config.TLS.RootCAs = x509.NewCertPool()
+			if !config.TLS.RootCAs.AppendCertsFromPEM(pem) {
+				return MQTTConfig{}, fmt.Errorf("%s holds no certificates", ca)
+			}
+		}
+	default:
+		return MQTTConfig{}, fmt.Errorf("unsupported scheme '%s' in '%s'", u.Scheme, broker)
+	}
+	if u.Hostname() == "" {
+		return MQTTConfig{}, fmt.Errorf("no host in '%s'", broker)
+	}
+	if u.Port() == "" {
+		config.Address = net.JoinHostPort(u.Hostname(), port)
+	}
+	if u.User != nil {
+		config.Username = u.User.Username()
+		if p, ok := u.User.Password(); ok && config.Password == "" {
+			config.Password = p
+		}
+	}
+	return config, nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// mqttPacket frames body behind a fixed header.
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+	n := len(body)
+	for {
+		digit := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			digit |= 0x80
+		}
+		packet = append(packet, digit)
+		if n == 0 {
+			break
+		}
+	}
+	return append(packet, body...)
+}
+
+// readMQTTPacket reads one packet, returning its fixed header byte and body.
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		digit, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(digit&0x7f) * multiplier
+		if digit&0x80 == 0 {
+			break
+		}
+		if i == 3 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		multiplier *= 128
+	}
+	if length > mqttMaxPacket {
+		return 0, nil, fmt.Errorf("packet of %d bytes is too large", length)
+	}
+	body := make([]byte, length)
+	_, err = io.ReadFull(r, body)
+	return header, body, err
+}
+
+func readMQTTString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("truncated string")
+	}
+	n := int(binary.BigEndian.Uint16(b))
+	if len(b) < 2+n {
+		return "", nil, errors.New("truncated string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
+
+func mqttPublishPacket(topic string, payload []byte, retain bool) []byte {
+	header := byte(mqttPublish << 4)
+	if retain {
+		header |= 1
+	}
+	return mqttPacket(header, append(appendMQTTString(nil, topic), payload...))
+}
+
+var mqttTopicUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// mqttSlug makes a door name safe to use as a topic level and object ID.
+func mqttSlug(name string) string {
+	slug := strings.Trim(mqttTopicUnsafe.ReplaceAllString(strings.ToLower(name), "_"), "_")
+	if slug == "" {
+		return "door"
+	}
+	return slug
+}
+
+// MQTTBridge publishes a door's state and availability to an MQTT broker,
+// runs the commands sent to it, and announces it to Home Assistant as a
+// cover.
+type MQTTBridge struct {
+	config MQTTConfig
+	route  RouteConfig
+	slug   string
+	stop   chan struct{}
+	done   chan struct{}
+}
+
+// NewMQTTBridge bridges the door c describes to the broker in config.
+func NewMQTTBridge(config MQTTConfig, c RouteConfig) *MQTTBridge {
+	slug := mqttSlug(c.Door)
+	if config.Prefix == "" {
+		config.Prefix = "garage"
+	}
+	if config.DiscoveryPrefix == "" {
+		config.DiscoveryPrefix = "homeassistant"
+	}
+	if config.ClientID == "" {
+		config.ClientID = "garage-server-" + slug
+	}
+	if config.KeepAlive == 0 {
+		config.KeepAlive = 30 * time.Second
+	}
+	return &MQTTBridge{config: config, route: c, slug: slug, stop: make(chan struct{}), done: make(chan struct{})}
+}
+
+func (b *MQTTBridge) topic(name string) string {
+	return b.config.Prefix + "/" + b.slug + "/" + name
+}
+
+// discovery is the Home Assistant MQTT discovery config for the door.
+func (b *MQTTBridge) discovery() (string, []byte) {
+	id := "garage-server_" + b.slug
+	config := map[string]interface{}{
+		"name":               nil,
+		"unique_id":          id,
+		"object_id":          b.slug,
+		"device_class":       "garage",
+		"command_topic":      b.topic("set"),
+		"state_topic":        b.topic("state"),
+		"availability_topic": b.topic("availability"),
+		"payload_open":       "OPEN",
+		"payload_close":      "CLOSE",
+		"payload_stop":       nil,
+		"state_open":         "open",
+		"state_closed":       "closed",
+		"device": map[string]interface{}{
+			"identifiers":  []string{id},
+			"name":         b.route.Door,
+			"manufacturer": "garage-server",
+			"sw_version":   Version,
+		},
+	}
+	encoded, _ := json.Marshal(config)
+	return b.config.DiscoveryPrefix + "/cover/" + b.slug + "/config", encoded
+}
+
+// Run keeps the bridge connected until Close, reconnecting with backoff
+// whenever the connection drops.
+func (b *MQTTBridge) Run() {
+	defer close(b.done)
+	backoff := mqttBackoffMin
+	for {
+		connected, err := b.session()
+		if err == nil {
+			return
+		}
+		if connected {
+			backoff = mqttBackoffMin
+		}
+		b.route.Logger.Warn("MQTT connection lost", Field{"broker", b.config.Address}, Field{"error", err.Error()}, Field{"retry_in", backoff.String()})
+		select {
+		case <-b.stop:
+			return
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; backoff > mqttBackoffMax {
+			backoff = mqttBackoffMax
+		}
+	}
+}
+
+// Close marks the door offline, disconnects and waits for Run to return.
+func (b *MQTTBridge) Close() {
+	close(b.stop)
+	<-b.done
+}
+
+// mqttConn serializes writes from the session and its reader.
+type mqttConn struct {
+	net.Conn
+	mu sync.Mutex
+}
+
+func (c *mqttConn) send(packet []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.SetWriteDeadline(time.Now().Add(mqttDialTimeout))
+	_, err := c.Write(packet)
+	return err
+}
+
+func (b *MQTTBridge) dial() (*mqttConn, error) {
+	dialer := &net.Dialer{Timeout: mqttDialTimeout}
+	var conn net.Conn
+	var err error
+	if b.config.TLS != nil {
+		conn, err = tls.DialWithDialer(dialer, "tcp", b.config.Address, b.config.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", b.config.Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &mqttConn{Conn: conn}, nil
+}
+
+// connect sends CONNECT, with a will that marks the door offline if the
+// connection drops, and waits for the broker to accept it.
+func (b *MQTTBridge) connect(conn *mqttConn, r *bufio.Reader) error {
+	flags := byte(0x02 | 0x04 | 0x20) // clean session, will, retain will
+	if b.config.Username != "" {
+		flags |= 0x80
+		if b.config.Password != "" {
+			flags |= 0x40
+		}
+	}
+	body := appendMQTTString(nil, "MQTT")
+	keepAlive := int(b.config.KeepAlive / time.Second)
+	body = append(body, 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	body = appendMQTTString(body, b.config.ClientID)
+	body = appendMQTTString(body, b.topic("availability"))
+	body = appendMQTTString(body, "offline")
+	if flags&0x80 != 0 {
+		body = appendMQTTString(body, b.config.Username)
+	}
+	if flags&0x40 != 0 {
+		body = appendMQTTString(body, b.config.Password)
+	}
+	if err := conn.send(mqttPacket(mqttConnect<<4, body)); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(mqttDialTimeout))
+	header, ack, err := readMQTTPacket(r)
+	if err != nil {
+		return err
+	}
+	conn.SetReadDeadline(time.Time{})
+	if header>>4 != mqttConnack || len(ack) != 2 {
+		return fmt.Errorf("expected CONNACK, got packet type %d", header>>4)
+	}
+	if ack[1] != 0 {
+		reason, ok := mqttConnackErrors[ack[1]]
+		if !ok {
+			reason = fmt.Sprintf("return code %d", ack[1])
+		}
+		return fmt.Errorf("broker refused connection: %s", reason)
+	}
+	return nil
+}
+
+// session runs one connection until it drops, returning nil only when the
+// bridge was closed. connected reports whether the broker accepted it.
+func (b *MQTTBridge) session() (connected bool, err error) {
+	conn, err := b.dial()
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if err := b.connect(conn, r); err != nil {
+		return false, err
+	}
+	log := b.route.Logger.With(Field{"broker", b.config.Address})
+	log.Info("Connected to MQTT broker")
+
+	// Subscribe to state changes before reading the state, so none is
+	// missed in between.
+	_, events := b.route.Hub.Subscribe("")
+	defer func() { b.route.Hub.Unsubscribe(events) }()
+
+	subscribe := appendMQTTString([]byte{0, 1}, b.topic("set"))
+	subscribe = append(subscribe, 1)
+	topic, config := b.discovery()
+	for _, packet := range [][]byte{
+		mqttPacket(mqttSubscribe<<4|2, subscribe),
+		mqttPublishPacket(topic, config, true),
+		mqttPublishPacket(b.topic("availability"), []byte("online"), true),
+	} {
+		if err := conn.send(packet); err != nil {
+			return true, err
+		}
+	}
+	if status, err := b.route.DoorStatus(context.Background(), b.route.StatusPin); err == nil {
+		if err := conn.send(mqttPublishPacket(b.topic("state"), []byte(status), true)); err != nil {
+			return true, err
+		}
+	}
+
+	commands := make(chan string, 8)
+	pongs := make(chan struct{}, 1)
+	readErr := make(chan error, 1)
+	go func() { readErr <- b.read(conn, r, commands, pongs, log) }()
+
+	ping := time.NewTicker(b.config.KeepAlive / 2)
+	defer ping.Stop()
+	awaitingPong := false
+
+	for {
+		select {
+		case <-b.stop:
+			conn.send(mqttPublishPacket(b.topic("availability"), []byte("offline"), true))
+			conn.send(mqttPacket(mqttDisconnect<<4, nil))
+			return true, nil
+		case err := <-readErr:
+			return true, err
+		case event, open := <-events:
+			if !open {
+				_, events = b.route.Hub.Subscribe("")
+				continue
+			}
+			if state, ok := event.Data.(DoorState); ok && event.Type == "state" {
+				if err := conn.send(mqttPublishPacket(b.topic("state"), []byte(state.Status), true)); err != nil {
+					return true, err
+				}
+			}
+		case command := <-commands:
+			b.command(command, log)
+		case <-pongs:
+			awaitingPong = false
+		case <-ping.C:
+			if awaitingPong {
+				return true, errors.New("broker stopped answering pings")
+			}
+			if err := conn.send(mqttPacket(mqttPingreq<<4, nil)); err != nil {
+				return true, err
+			}
+			awaitingPong = true
+		}
+	}
+}
+
+// read handles packets from the broker until the connection fails.
+func (b *MQTTBridge) read(conn *mqttConn, r *bufio.Reader, commands chan<- string, pongs chan<- struct{}, log *Logger) error {
+	// The packet IDs of QoS 2 messages acted on but not yet released, so a
+	// redelivery isn't run twice.
+	received := map[string]bool{}
+	for {
+		header, body, err := readMQTTPacket(r)
+		if err != nil {
+			return err
+		}
+		switch header >> 4 {
+		case mqttPublish:
+			topic, rest, err := readMQTTString(body)
+			if err != nil {
+				return err
+			}
+			duplicate := false
+			if qos := header >> 1 & 3; qos > 0 {
+				if qos == 3 {
+					return errors.New("PUBLISH with QoS 3")
+				}
+				if len(rest) < 2 {
+					return errors.New("truncated PUBLISH")
+				}
+				id := string(rest[:2])
+				ack := byte(mqttPuback)
+				if qos == 2 {
+					ack = mqttPubrec
+					duplicate = received[id]
+					received[id] = true
+				}
+				if err := conn.send(mqttPacket(ack<<4, rest[:2])); err != nil {
+					return err
+				}
+				rest = rest[2:]
+			}
+			// Retained commands are stale; only act on ones sent now.
+			if topic == b.topic("set") && header&1 == 0 && !duplicate {
+				select {
+				case commands <- string(rest):
+				default:
+					log.Warn("Dropped MQTT command; still running the last ones")
+				}
+			}
+		case mqttPubrel:
+			if len(body) != 2 {
+				return errors.New("malformed PUBREL")
+			}
+			delete(received, string(body))
+			if err := conn.send(mqttPacket(mqttPubcomp<<4, body)); err != nil {
+				return err
+			}
+		case mqttSuback:
+			if len(body) == 3 && body[2] == 0x80 {
+				log.Error("MQTT broker refused subscription", Field{"topic", b.topic("set")})
+			}
+		case mqttPingresp:
+			select {
+			case pongs <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+// command runs an OPEN, CLOSE or TOGGLE sent to the command topic.
+func (b *MQTTBridge) command(payload string, log *Logger) {
+	command := strings.ToLower(strings.TrimSpace(payload))
+	switch command {
+	case "open", "close", "toggle":
+	default:
+		log.Warn("Unknown MQTT command", Field{"payload", payload})
+		return
+	}
+
+	c := b.route
+	record := recordCommandAs(c.Store, c.Door, "mqtt", log)
+	log = log.With(Field{"user", "mqtt"})
+	result := runControlCommand(context.Background(), c.Control, record, controlCommand{Command: command}, c.DoorStatus, c.ToggleSwitch, log, c.PinNumber, c.StatusPin, c.SleepTimeout)
+	if result.OK {
+		log.Info("MQTT command", Field{"command", command}, Field{"status", result.Status})
+	}
+}
+
+// mqttConfigFromOptions builds the bridge's config from -mqtt and its
+// companion flags, with the password from GARAGE_MQTT_PASSWORD.
+func mqttConfigFromOptions() (MQTTConfig, error) {
+	config, err := ParseMQTTBroker(options.mqtt, os.Getenv("GARAGE_MQTT_PASSWORD"), options.mqttCA)
+	if err != nil {
+		return config, err
+	}
+	config.Prefix = options.mqttPrefix
+	config.DiscoveryPrefix = options.mqttDiscoveryPrefix
+	return config, nil
+}
@@ -0,0 +1,635 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"os"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// What a recipient can be notified of.
+const (
+	NotifyOpen        = "open"
+	NotifyClose       = "close"
+	NotifyLeftOpen    = "left_open"
+	NotifyAuthLockout = "auth_lockout"
+	NotifyError       = "error"
+)
+
+// smtpTimeout bounds a whole conversation with the mail server.
+var smtpTimeout = 30 * time.Second
+
+const notifyTimeFormat = "3:04 PM on Mon Jan 2"
+
+const notifyFooter = "\n\n-- \nSent by garage-server on {{.Host}}"
+
+var defaultNotifyTemplates = map[string]NotifyTemplate{
+	NotifyOpen: {
+		Subject: "{{.Door}} opened",
+		Body:    "The {{.Door}} door opened at {{.Time.Format \"" + notifyTimeFormat + "\"}}." + notifyFooter,
+	},
+	NotifyClose: {
+		Subject: "{{.Door}} closed",
+		Body:    "The {{.Door}} door closed at {{.Time.Format \"" + notifyTimeFormat + "\"}}{{if .OpenFor}}, after being open for {{.OpenFor}}{{end}}." + notifyFooter,
+	},
+	NotifyLeftOpen: {
+		Subject: "{{.Door}} has been open for {{.OpenFor}}",
+		Body:    "The {{.Door}} door opened at {{.OpenedAt.Format \"" + notifyTimeFormat + "\"}} and is still open." + notifyFooter,
+	},
+	NotifyAuthLockout: {
+		Subject: "Failed sign-ins on {{.Door}}",
+		Body:    "{{.Failures}} requests from {{.SourceIP}} failed authentication within {{.Window}}. The last one failed with: {{.Detail}}" + notifyFooter,
+	},
+	NotifyError: {
+		Subject: "{{.Door}}: {{.Detail}}",
+		Body:    "garage-server logged an error at {{.Time.Format \"" + notifyTimeFormat + "\"}}:\n\n{{.Detail}}\n{{range .Fields}}\n{{.Key}}: {{.Value}}{{end}}" + notifyFooter,
+	},
+}
+
+// SMTPConfig is where and how notifications are sent.
+type SMTPConfig struct {
+	Address  string
+	Host     string
+	TLS      *tls.Config
+	Implicit bool
+	Username string
+	Password string
+}
+
+// ParseSMTPServer reads -smtp: smtp:// upgrades with STARTTLS when the
+// server offers it, smtps:// connects with TLS, each with an optional user,
+// e.g. smtps://garage@mail.example.com. The server is verified against the
+// system roots, or against ca if it is set.
+func ParseSMTPServer(server string, password string, ca string) (SMTPConfig, error) {
+	u, err := url.Parse(server)
+	if err != nil {
+		return SMTPConfig{}, err
+	}
+	config := SMTPConfig{Address: u.Host, Host: u.Hostname(), Password: password, TLS: &tls.Config{ServerName: u.Hostname()}}
+	port := "587"
+	switch u.Scheme {
+	case "smtp":
+	case "smtps":
+		port = "465"
+		config.Implicit = true
+	default:
+		return SMTPConfig{}, fmt.Errorf("unsupported scheme '%s' in '%s'", u.Scheme, server)
+	}
+	if u.Hostname() == "" {
+		return SMTPConfig{}, fmt.Errorf("no host in '%s'", server)
+	}
+	if u.Port() == "" {
+		config.Address = net.JoinHostPort(u.Hostname(), port)
+	}
+	if ca != "" {
+		pem, err := ioutil.ReadFile(ca)
+		if err != nil {
+			return SMTPConfig{}, err
+		}
+		config.TLS.RootCAs = x509.NewCertPool()
+		if !config.TLS.RootCAs.AppendCertsFromPEM(pem) {
+			return SMTPConfig{}, fmt.Errorf("%s holds no certificates", ca)
+		}
+	}
+	if u.User != nil {
+		config.Username = u.User.Username()
+		if p, ok := u.User.Password(); ok && config.Password == "" {
+			config.Password = p
+		}
+	}
+	return config, nil
+}
+
+// Send delivers message to every address in to. Credentials are only sent
+// over TLS, or in the clear to a server on localhost.
+func (c SMTPConfig) Send(from string, to []string, message []byte) error {
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	var conn net.Conn
+	var err error
+	if c.Implicit {
+		conn, err = tls.DialWithDialer(dialer, "tcp", c.Address, c.TLS)
+	} else {
+		conn, err = dialer.Dial("tcp", c.Address)
+	}
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	client, err := smtp.NewClient(conn, c.Host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer client.Close()
+
+	if hostname, err := os.Hostname(); err == nil {
+		if err := client.Hello(hostname); err != nil {
+			return err
+		}
+	}
+	if ok, _ := client.Extension("STARTTLS"); ok && !c.Implicit {
+		if err := client.StartTLS(c.TLS); err != nil {
+			return err
+		}
+	}
+	if c.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", c.Username, c.Password, c.Host)); err != nil {
+			return err
+		}
+	}
+	if err := client.Mail(from); err != nil {
+		return err
+	}
+	for _, address := range to {
+		if err := client.Rcpt(address); err != nil {
+			return err
+		}
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(message); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// NotifyTemplate is a text/template for the subject and body of one kind
+// of notification, executed with a Notification.
+type NotifyTemplate struct {
+	Subject string `json:"subject"`
+	Body    string `json:"body"`
+}
+
+// NotifyRecipient is notified of the kinds it lists, or every kind if it
+// lists none.
+type NotifyRecipient struct {
+	Address string   `json:"address"`
+	Events  []string `json:"events"`
+}
+
+func (r NotifyRecipient) wants(kind string) bool {
+	if len(r.Events) == 0 {
+		return true
+	}
+	for _, event := range r.Events {
+		if event == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// NotifyConfig is who is notified of what, read from -notify.
+type NotifyConfig struct {
+	From       string                    `json:"from"`
+	Recipients []NotifyRecipient         `json:"recipients"`
+	Templates  map[string]NotifyTemplate `json:"templates"`
+
+	// LeftOpenMinutes is how long the door can stay open before left_open
+	// is sent.
+	LeftOpenMinutes int `json:"left_open_minutes"`
+
+	// LockoutFailures failed authentications from one address within
+	// LockoutMinutes send auth_lockout.
+	LockoutFailures int `json:"lockout_failures"`
+	LockoutMinutes  int `json:"lockout_minutes"`
+
+	// MaxPerHour is how many emails a recipient gets in any hour.
+	MaxPerHour int `json:"max_per_hour"`
+}
+
+// LoadNotifyConfig reads path, filling in defaults and checking that every
+// address and template is usable.
+func LoadNotifyConfig(path string) (NotifyConfig, error) {
+	config := NotifyConfig{LeftOpenMinutes: 15, LockoutFailures: 5, LockoutMinutes: 10, MaxPerHour: 10}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, &config); err != nil {
+		return config, err
+	}
+
+	if _, err := mail.ParseAddress(config.From); err != nil {
+		return config, fmt.Errorf("invalid from address '%s'", config.From)
+	}
+	if len(config.Recipients) == 0 {
+		return config, fmt.Errorf("no recipients")
+	}
+	for _, r := range config.Recipients {
+		if _, err := mail.ParseAddress(r.Address); err != nil {
+			return config, fmt.Errorf("invalid address '%s'", r.Address)
+		}
+		for _, event := range r.Events {
+			if _, ok := defaultNotifyTemplates[event]; !ok {
+				return config, fmt.Errorf("%s: unknown event '%s'", r.Address, event)
+			}
+		}
+	}
+	for kind := range config.Templates {
+		if _, ok := defaultNotifyTemplates[kind]; !ok {
+			return config, fmt.Errorf("template for unknown event '%s'", kind)
+		}
+	}
+	if config.LeftOpenMinutes < 1 || config.LockoutFailures < 1 || config.LockoutMinutes < 1 || config.MaxPerHour < 1 {
+		return config, fmt.Errorf("left_open_minutes, lockout_failures, lockout_minutes and max_per_hour must be at least 1")
+	}
+	if _, err := compileNotifyTemplates(config.Templates); err != nil {
+		return config, err
+	}
+	return config, nil
+}
+
+// Notification is what templates are executed with. Fields are set as the
+// kind calls for: OpenedAt and OpenFor for close and left_open, SourceIP,
+// Failures and Window for auth_lockout, Detail for auth_lockout and error,
+// Fields for error.
+type Notification struct {
+	Kind     string
+	Door     string
+	Host     string
+	Time     time.Time
+	OpenedAt time.Time
+	OpenFor  time.Duration
+	SourceIP string
+	Failures int
+	Window   time.Duration
+	Detail   string
+	Fields   []Field
+}
+
+type notifyTemplate struct {
+	subject *template.Template
+	body    *template.Template
+}
+
+// compileNotifyTemplates parses the default templates with custom ones in
+// their place, and tries each on a sample notification so a mistake shows
+// up at startup rather than when the door opens.
+func compileNotifyTemplates(custom map[string]NotifyTemplate) (map[string]notifyTemplate, error) {
+	sample := Notification{Door: "garage", Host: "pi", Time: time.Now(), OpenedAt: time.Now(), OpenFor: time.Minute, SourceIP: "192.0.2.1", Failures: 5, Window: time.Minute, Detail: "detail", Fields: []Field{{"error", "detail"}}}
+	templates := make(map[string]notifyTemplate)
+	for kind, t := range defaultNotifyTemplates {
+		if c, ok := custom[kind]; ok {
+			if c.Subject != "" {
+				t.Subject = c.Subject
+			}
+			if c.Body != "" {
+				t.Body = c.Body
+			}
+		}
+		var compiled notifyTemplate
+		var err error
+		if compiled.subject, err = template.New(kind + " subject").Parse(t.Subject); err != nil {
+			return nil, err
+		}
+		if compiled.body, err = template.New(kind + " body").Parse(t.Body); err != nil {
+			return nil, err
+		}
+		sample.Kind = kind
+		if _, _, err := compiled.render(sample); err != nil {
+			return nil, err
+		}
+		templates[kind] = compiled
+	}
+	return templates, nil
+}
+
+// render executes the templates. The subject is folded onto one line.
+func (t notifyTemplate) render(n Notification) (string, string, error) {
+	var subject, body bytes.Buffer
+	if err := t.subject.Execute(&subject, n); err != nil {
+		return "", "", err
+	}
+	if err := t.body.Execute(&body, n); err != nil {
+		return "", "", err
+	}
+	return strings.Join(strings.Fields(subject.String()), " "), body.String(), nil
+}
+
+// notifyMessage formats a plain text email.
+func notifyMessage(from *mail.Address, to *mail.Address, subject string, body string, now time.Time) []byte {
+	var message bytes.Buffer
+	fmt.Fprintf(&message, "From: %s\r\n", from)
+	fmt.Fprintf(&message, "To: %s\r\n", to)
+	fmt.Fprintf(&message, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&message, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&message, "Message-ID: <%s@garage-server>\r\n", newRequestID())
+	fmt.Fprintf(&message, "Auto-Submitted: auto-generated\r\n")
+	fmt.Fprintf(&message, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&message, "Content-Type: text/plain; charset=utf-8\r\n")
+	fmt.Fprintf(&message, "Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	w := quotedprintable.NewWriter(&message)
+	w.Write([]byte(body))
+	w.Close()
+	return message.Bytes()
+}
+
+// notifyLimiter allows each recipient max emails in any window, counting
+// the ones it holds back.
+type notifyLimiter struct {
+	max        int
+	window     time.Duration
+	sent       map[string][]time.Time
+	suppressed map[string]int
+}
+
+func newNotifyLimiter(max int, window time.Duration) *notifyLimiter {
+	return &notifyLimiter{max: max, window: window, sent: make(map[string][]time.Time), suppressed: make(map[string]int)}
+}
+
+// allow says whether to send to address now, and if so how many emails
+// were held back since the last one sent.
+func (l *notifyLimiter) allow(address string, now time.Time) (bool, int) {
+	sent := l.sent[address]
+	for len(sent) > 0 && !sent[0].After(now.Add(-l.window)) {
+		sent = sent[1:]
+	}
+	if len(sent) >= l.max {
+		l.sent[address] = sent
+		l.suppressed[address]++
+		return false, 0
+	}
+	l.sent[address] = append(sent, now)
+	suppressed := l.suppressed[address]
+	delete(l.suppressed, address)
+	return true, suppressed
+}
+
+// Notifier emails recipients when the door opens, closes or is left open,
+// when one address keeps failing to authenticate and when an error is
+// logged.
+type Notifier struct {
+	smtp       SMTPConfig
+	from       *mail.Address
+	recipients []NotifyRecipient
+	templates  map[string]notifyTemplate
+	door       string
+	host       string
+	logger     *Logger
+
+	leftOpen        time.Duration
+	lockoutFailures int
+	lockoutWindow   time.Duration
+	limiter         *notifyLimiter
+
+	events chan HistoryEvent
+	errors chan Record
+	outbox chan Notification
+	stop   chan struct{}
+	done   chan struct{}
+
+	// Run's own state.
+	state    string
+	openedAt time.Time
+	failures map[string][]time.Time
+}
+
+// NewNotifier sends the notifications config asks for about door through
+// the server smtp describes.
+func NewNotifier(smtpConfig SMTPConfig, config NotifyConfig, door string, logger *Logger) (*Notifier, error) {
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return nil, err
+	}
+	templates, err := compileNotifyTemplates(config.Templates)
+	if err != nil {
+		return nil, err
+	}
+	host, _ := os.Hostname()
+	return &Notifier{
+		smtp:            smtpConfig,
+		from:            from,
+		recipients:      config.Recipients,
+		templates:       templates,
+		door:            door,
+		host:            host,
+		logger:          logger,
+		leftOpen:        time.Duration(config.LeftOpenMinutes) * time.Minute,
+		lockoutFailures: config.LockoutFailures,
+		lockoutWindow:   time.Duration(config.LockoutMinutes) * time.Minute,
+		limiter:         newNotifyLimiter(config.MaxPerHour, time.Hour),
+		events:          make(chan HistoryEvent, 64),
+		errors:          make(chan Record, 64),
+		outbox:          make(chan Notification, 64),
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+		failures:        make(map[string][]time.Time),
+	}, nil
+}
+
+// Observe passes a history event to Run. It is meant to be passed to
+// EventStore.OnAppend, so it drops the event rather than block.
+func (n *Notifier) Observe(event HistoryEvent) {
+	select {
+	case n.events <- event:
+	default:
+	}
+}
+
+// LogHook passes errors to Run. It is meant to be passed to
+// Logger.WithHook. The notifier's own failures are logged as warnings, so
+// they don't come back here.
+func (n *Notifier) LogHook(record Record) {
+	if record.Level < LevelError {
+		return
+	}
+	select {
+	case n.errors <- record:
+	default:
+	}
+}
+
+// Run sends notifications until Close. The first door state it sees is
+// what the door was at startup, so it isn't notified, though a door that
+// was open starts the left open timer. Mail is sent from a goroutine of
+// its own, so a slow server can't hold up following the door.
+func (n *Notifier) Run() {
+	defer close(n.done)
+	sent := make(chan struct{})
+	go n.deliver(sent)
+	defer func() { <-sent }()
+	var leftOpen *time.Timer
+	var leftOpenC <-chan time.Time
+	stopLeftOpen := func() {
+		if leftOpen != nil {
+			leftOpen.Stop()
+			leftOpen, leftOpenC = nil, nil
+		}
+	}
+	defer stopLeftOpen()
+
+	for {
+		select {
+		case <-n.stop:
+			return
+		case event := <-n.events:
+			switch event.Type {
+			case EventStateChanged:
+				opened, closed := n.stateChanged(event)
+				if opened {
+					stopLeftOpen()
+					leftOpen = time.NewTimer(n.leftOpen - time.Since(n.openedAt))
+					leftOpenC = leftOpen.C
+				}
+				if closed {
+					stopLeftOpen()
+				}
+			case EventAuthFailure:
+				n.authFailure(event)
+			}
+		case record := <-n.errors:
+			n.notify(Notification{Kind: NotifyError, Time: record.Time, Detail: record.Message, Fields: record.Fields})
+		case <-leftOpenC:
+			leftOpen, leftOpenC = nil, nil
+			now := time.Now()
+			n.notify(Notification{Kind: NotifyLeftOpen, Time: now, OpenedAt: n.openedAt, OpenFor: now.Sub(n.openedAt).Round(time.Minute)})
+		}
+	}
+}
+
+// Close stops sending.
+func (n *Notifier) Close() {
+	close(n.stop)
+	<-n.done
+}
+
+// stateChanged follows the door, notifying of changes after the first, and
+// says whether it opened or closed.
+func (n *Notifier) stateChanged(event HistoryEvent) (opened bool, closed bool) {
+	first := n.state == ""
+	if event.Detail == n.state {
+		return false, false
+	}
+	n.state = event.Detail
+	switch event.Detail {
+	case "open":
+		n.openedAt = event.Time
+		if !first {
+			n.notify(Notification{Kind: NotifyOpen, Time: event.Time})
+		}
+		return true, false
+	case "closed":
+		if !first {
+			openFor := time.Duration(0)
+			if !n.openedAt.IsZero() {
+				openFor = event.Time.Sub(n.openedAt).Round(time.Second)
+			}
+			n.notify(Notification{Kind: NotifyClose, Time: event.Time, OpenedAt: n.openedAt, OpenFor: openFor})
+		}
+		n.openedAt = time.Time{}
+		return false, true
+	}
+	return false, false
+}
+
+// authFailure counts failures from the event's address, notifying once
+// there are enough within the window and starting the count again.
+func (n *Notifier) authFailure(event HistoryEvent) {
+	failures := n.failures[event.SourceIP]
+	for len(failures) > 0 && !failures[0].After(event.Time.Add(-n.lockoutWindow)) {
+		failures = failures[1:]
+	}
+	for i := 0; i == 0 || i < event.Count; i++ {
+		failures = append(failures, event.Time)
+	}
+	if len(failures) < n.lockoutFailures {
+		n.failures[event.SourceIP] = failures
+		return
+	}
+	delete(n.failures, event.SourceIP)
+	n.notify(Notification{Kind: NotifyAuthLockout, Time: event.Time, SourceIP: event.SourceIP, Failures: len(failures), Window: n.lockoutWindow, Detail: event.Detail})
+}
+
+// notify queues a notification for deliver, dropping it if too many are
+// already waiting on the mail server.
+func (n *Notifier) notify(notification Notification) {
+	select {
+	case n.outbox <- notification:
+	default:
+		n.logger.Warn("Notification dropped; too many are waiting to be sent", Field{"kind", notification.Kind})
+	}
+}
+
+// deliver sends queued notifications until Close, which drops any still
+// waiting.
+func (n *Notifier) deliver(done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case <-n.stop:
+			return
+		case notification := <-n.outbox:
+			n.send(notification)
+		}
+	}
+}
+
+// send emails everyone who wants this kind of notification and isn't over
+// the rate limit.
+func (n *Notifier) send(notification Notification) {
+	notification.Door = n.door
+	notification.Host = n.host
+	subject, body, err := n.templates[notification.Kind].render(notification)
+	if err != nil {
+		n.logger.Warn("Could not render notification", Field{"kind", notification.Kind}, Field{"error", err.Error()})
+		return
+	}
+
+	for _, r := range n.recipients {
+		if !r.wants(notification.Kind) {
+			continue
+		}
+		log := n.logger.With(Field{"kind", notification.Kind}, Field{"to", r.Address})
+		ok, suppressed := n.limiter.allow(r.Address, time.Now())
+		if !ok {
+			log.Warn("Notification held back by the rate limit")
+			continue
+		}
+		text := body
+		if suppressed > 0 {
+			text += fmt.Sprintf("\n\n(%d earlier notifications were held back by the rate limit.)", suppressed)
+		}
+
+		to, _ := mail.ParseAddress(r.Address)
+		message := notifyMessage(n.from, to, subject, text, time.Now())
+		if err := n.smtp.Send(n.from.Address, []string{to.Address}, message); err != nil {
+			log.Warn("Could not send notification", Field{"error", err.Error()})
+			continue
+		}
+		log.Info("Notification sent")
+	}
+}
+
+func notifierFromOptions(logger *Logger) (*Notifier, error) {
+	if options.smtp == "" {
+		return nil, fmt.Errorf("-notify needs -smtp")
+	}
+	smtpConfig, err := ParseSMTPServer(options.smtp, os.Getenv("GARAGE_SMTP_PASSWORD"), options.smtpCA)
+	if err != nil {
+		return nil, err
+	}
+	config, err := LoadNotifyConfig(options.notify)
+	if err != nil {
+		return nil, err
+	}
+	return NewNotifier(smtpConfig, config, options.door, logger)
+}
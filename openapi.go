@@ -0,0 +1,17 @@
+package main
+
+import (
+	_ "embed"
+	"net/http"
+)
+
+// openAPISpec describes every route in routes.go. openapi_test.go checks it
+// against the real handlers, so update both together.
+//
+//go:embed openapi.json
+var openAPISpec []byte
+
+func OpenAPIHandler(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPISpec)
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+type specNode map[string]interface{}
+
+func loadOpenAPISpec(t *testing.T) specNode {
+	var spec specNode
+	if err := json.Unmarshal(openAPISpec, &spec); err != nil {
+		t.Fatal(err)
+	}
+	return spec
+}
+
+func (n specNode) child(key string) specNode {
+	child, _ := n[key].(map[string]interface{})
+	return specNode(child)
+}
+
+func resolveRef(spec specNode, node specNode) specNode {
+	ref, ok := node["$ref"].(string)
+	if !ok {
+		return node
+	}
+	resolved := spec
+	for _, key := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+		resolved = resolved.child(key)
+	}
+	return resolveRef(spec, resolved)
+}
+
+func validateSchema(spec specNode, schema specNode, value interface{}, path string) error {
+	schema = resolveRef(spec, schema)
+
+	if enum, ok := schema["enum"].([]interface{}); ok {
+		found := false
+		for _, allowed := range enum {
+			if allowed == value {
+				found = true
+			}
+		}
+		if !found {
+			return fmt.Errorf("%s: %v is not one of %v", path, value, enum)
+		}
+	}
+
+	switch schema["type"] {
+	case "object":
+		object, ok := value.(map[string]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected object, got %T", path, value)
+		}
+		properties := schema.child("properties")
+		if len(properties) == 0 {
+			return nil
+		}
+		for key, field := range object {
+			property, documented := properties[key].(map[string]interface{})
+			if !documented {
+				return fmt.Errorf("%s: undocumented field '%s'", path, key)
+			}
+			if err := validateSchema(spec, specNode(property), field, path+"."+key); err != nil {
+				return err
+			}
+		}
+		required, _ := schema["required"].([]interface{})
+		for _, key := range required {
+			if _, present := object[key.(string)]; !present {
+				return fmt.Errorf("%s: missing required field '%s'", path, key)
+			}
+		}
+	case "array":
+		array, ok := value.([]interface{})
+		if !ok {
+			return fmt.Errorf("%s: expected array, got %T", path, value)
+		}
+		for i, item := range array {
+			if err := validateSchema(spec, schema.child("items"), item, fmt.Sprintf("%s[%d]", path, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		if _, ok := value.(string); !ok {
+			return fmt.Errorf("%s: expected string, got %T", path, value)
+		}
+	case "integer":
+		number, ok := value.(float64)
+		if !ok || number != math.Trunc(number) {
+			return fmt.Errorf("%s: expected integer, got %v", path, value)
+		}
+	case "boolean":
+		if _, ok := value.(bool); !ok {
+			return fmt.Errorf("%s: expected boolean, got %T", path, value)
+		}
+	}
+	return nil
+}
+
+// checkDocumentedResponse fails unless the response status is listed for the
+// operation and a JSON body matches the documented schema.
+func checkDocumentedResponse(t *testing.T, spec specNode, operation specNode, name string, writer *httptest.ResponseRecorder) {
+	response := operation.child("responses").child(fmt.Sprintf("%d", writer.Code))
+	if len(response) == 0 {
+		t.Fatalf("%s: status %d is not documented", name, writer.Code)
+	}
+	response = resolveRef(spec, response)
+
+	schema := response.child("content").child("application/json").child("schema")
+	if len(schema) == 0 {
+		return
+	}
+
+	var body interface{}
+	if err := json.Unmarshal(writer.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%s: %d body is not JSON: %s", name, writer.Code, err)
+	}
+	if err := validateSchema(spec, schema, body, name); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func isStreaming(spec specNode, operation specNode) bool {
+	responses := operation.child("responses")
+	_, upgrades := responses["101"]
+	ok := resolveRef(spec, responses.child("200"))
+	_, streams := ok.child("content")["text/event-stream"]
+	return upgrades || streams
+}
+
+func serveSpecRequest(router http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, req)
+	return writer
+}
+
+// specRequest signs a request to an operation, or sends the metrics token
+// to an operation guarded by that instead. An invalid request gets the
+// wrong signature or token.
+func specRequest(t *testing.T, operation specNode, method string, path string, valid bool) *http.Request {
+	secret, token := SharedSecret, testMetricsToken
+	if !valid {
+		secret, token = "Unverified Signature", "Unverified Token"
+	}
+	req := signedRequest(t, method, path, secret)
+	security, _ := operation["security"].([]interface{})
+	for _, requirement := range security {
+		if _, ok := requirement.(map[string]interface{})["metricsToken"]; ok {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+	return req
+}
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+
+	var documented []string
+	for path := range spec.child("paths") {
+		documented = append(documented, path)
+	}
+	var registered []string
+	for _, r := range routes(RouteConfig{Legacy: true}) {
+		registered = append(registered, r.pattern)
+	}
+	sort.Strings(documented)
+	sort.Strings(registered)
+
+	stringEqual(t, strings.Join(documented, " "), strings.Join(registered, " "))
+}
+
+func TestOpenAPIMatchesHandlers(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+	healthy := CreateTestRouter(t, true, "closed", false)
+	brokenConfig := CreateTestRouteConfig(t, true, "error", true)
+	CorruptTestStore(t, brokenConfig.Store)
+	broken := NewRouter(brokenConfig)
+
+	for path, item := range spec.child("paths") {
+		for method, op := range item.(map[string]interface{}) {
+			operation := specNode(op.(map[string]interface{}))
+			method = strings.ToUpper(method)
+			name := method + " " + path
+			security, secured := operation["security"].([]interface{})
+			secured = !secured || len(security) > 0
+
+			if secured {
+				writer := serveSpecRequest(healthy, specRequest(t, operation, method, path, false))
+				checkDocumentedResponse(t, spec, operation, name, writer)
+				responseEqual(t, writer.Code, 403)
+			}
+
+			if strings.HasPrefix(path, "/api/v2/") {
+				wrongMethod := "DELETE"
+				writer := serveSpecRequest(healthy, specRequest(t, operation, wrongMethod, path, true))
+				checkDocumentedResponse(t, spec, operation, name, writer)
+				responseEqual(t, writer.Code, 405)
+			}
+
+			if isStreaming(spec, operation) {
+				continue
+			}
+
+			writer := serveSpecRequest(healthy, specRequest(t, operation, method, path, true))
+			checkDocumentedResponse(t, spec, operation, name, writer)
+			responseEqual(t, writer.Code, 200)
+
+			writer = serveSpecRequest(broken, specRequest(t, operation, method, path, true))
+			checkDocumentedResponse(t, spec, operation, name, writer)
+		}
+	}
+}
+
+func TestOpenAPIDocumentsLongPollErrors(t *testing.T) {
+	spec := loadOpenAPISpec(t)
+	router := CreateTestRouter(t, true, "closed", false)
+
+	for _, path := range []string{"/api/v2/status", "/status"} {
+		operation := spec.child("paths").child(path).child("get")
+		writer := serveSpecRequest(router, signedRequest(t, "GET", path+"?wait=soon", SharedSecret))
+		checkDocumentedResponse(t, spec, operation, path, writer)
+		responseEqual(t, writer.Code, 400)
+	}
+}
+
+func TestOpenAPIServed(t *testing.T) {
+	req, err := http.NewRequest("GET", "/openapi.json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := serveSpecRequest(CreateTestRouter(t, false, "closed", false), req)
+
+	responseEqual(t, writer.Code, 200)
+	stringEqual(t, writer.Header().Get("Content-Type"), "application/json")
+	spec := loadOpenAPISpec(t)
+	stringEqual(t, spec["openapi"].(string), "3.0.3")
+}
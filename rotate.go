@@ -0,0 +1,249 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// rotatedSuffixLayout names rotated segments, so sorting their names sorts
+// them oldest first.
+const rotatedSuffixLayout = "20060102-150405.000"
+
+// RotatingFile is a log file that is moved aside and gzipped once it grows
+// past MaxSize bytes or has been written to for MaxAge. Only the newest Keep
+// rotated segments are kept. A zero limit disables that limit.
+type RotatingFile struct {
+	Path    string
+	MaxSize int64
+	MaxAge  time.Duration
+	Keep    int
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	opened   time.Time
+	now      func() time.Time
+	rotating sync.WaitGroup
+	// cleanup serializes compressing and pruning old segments.
+	cleanup sync.Mutex
+}
+
+// OpenRotatingFile appends to path, creating it if need be. The age of an
+// existing file counts from when it is opened.
+func OpenRotatingFile(path string, maxSize int64, maxAge time.Duration, keep int) (*RotatingFile, error) {
+	f := &RotatingFile{Path: path, MaxSize: maxSize, MaxAge: maxAge, Keep: keep, now: time.Now}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	if err := os.MkdirAll(filepath.Dir(f.Path), 0755); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(f.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file = file
+	f.size = info.Size()
+	f.opened = f.now()
+	return nil
+}
+
+// Write appends p, rotating first if p would take the file over its limits.
+// Each write is one log record, so records are never split across segments.
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	tooBig := f.MaxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.MaxSize
+	tooOld := f.MaxAge > 0 && f.size > 0 && f.now().Sub(f.opened) >= f.MaxAge
+	if tooBig || tooOld {
+		if err := f.rotate(); err != nil {
+			// The log is what failed, so this goes to stderr. The record
+			// still goes to the old file if it could be reopened.
+			fmt.Fprintln(os.Stderr, "Could not rotate log:", err)
+		}
+	}
+
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// rotate moves the current file aside and starts a new one. Compressing the
+// old segment and pruning happen in the background so logging isn't held
+// up; Close waits for them. If the file can't be moved or the new one
+// opened, the old one is opened again, so the log carries on there.
+func (f *RotatingFile) rotate() error {
+	rotated := f.Path + "." + f.now().Format(rotatedSuffixLayout)
+	err := f.file.Close()
+	if err == nil {
+		if err = os.Rename(f.Path, rotated); err == nil {
+			if err = f.open(); err != nil {
+				os.Rename(rotated, f.Path)
+			}
+		}
+	}
+	if err != nil {
+		if openErr := f.open(); openErr != nil {
+			return fmt.Errorf("%s, then %s", err, openErr)
+		}
+		return err
+	}
+
+	f.rotating.Add(1)
+	go func() {
+		defer f.rotating.Done()
+		f.cleanup.Lock()
+		defer f.cleanup.Unlock()
+		// The log is what failed, so these go to stderr.
+		if err := compressSegment(rotated); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not compress log:", err)
+		}
+		if err := f.prune(); err != nil {
+			fmt.Fprintln(os.Stderr, "Could not prune logs:", err)
+		}
+	}()
+	return nil
+}
+
+// prune deletes all but the newest Keep rotated segments.
+func (f *RotatingFile) prune() error {
+	if f.Keep <= 0 {
+		return nil
+	}
+	segments, err := rotatedSegments(f.Path)
+	if err != nil {
+		return err
+	}
+	for len(segments) > f.Keep {
+		if err := os.Remove(segments[0]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		segments = segments[1:]
+	}
+	return nil
+}
+
+func (f *RotatingFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.rotating.Wait()
+	return f.file.Close()
+}
+
+// compressSegment replaces path with path.gz. A segment pruned before it
+// got compressed is left alone.
+func compressSegment(path string) error {
+	in, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.OpenFile(path+".gz.tmp", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz.tmp")
+		return err
+	}
+	if err := os.Rename(path+".gz.tmp", path+".gz"); err != nil {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// rotatedSegments lists the rotated segments of the log at path, oldest
+// first. A segment caught between rotating and compressing is listed once.
+func rotatedSegments(path string) ([]string, error) {
+	matches, err := filepath.Glob(path + ".*")
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []string
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(match, path+".")
+		stamp := strings.TrimSuffix(suffix, ".gz")
+		if _, err := time.Parse(rotatedSuffixLayout, stamp); err != nil {
+			continue
+		}
+		if suffix == stamp {
+			if _, err := os.Stat(match + ".gz"); err == nil {
+				// Already compressed; the uncompressed copy is about to go.
+				continue
+			}
+		}
+		segments = append(segments, match)
+	}
+	sort.Strings(segments)
+	return segments, nil
+}
+
+// logSegments lists every segment of the log at path, oldest first, ending
+// with path itself.
+func logSegments(path string) ([]string, error) {
+	segments, err := rotatedSegments(path)
+	if err != nil {
+		return nil, err
+	}
+	return append(segments, path), nil
+}
+
+// openLogSegment opens a segment, decompressing it if it is gzipped.
+func openLogSegment(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasSuffix(path, ".gz") {
+		return file, nil
+	}
+	zr, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &gzipSegment{Reader: zr, file: file}, nil
+}
+
+type gzipSegment struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (s *gzipSegment) Close() error {
+	s.Reader.Close()
+	return s.file.Close()
+}
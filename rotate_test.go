@@ -0,0 +1,109 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func readSegment(t *testing.T, path string) string {
+	file, err := openLogSegment(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	contents, err := ioutil.ReadAll(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(contents)
+}
+
+func TestRotatingFileBySize(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "garage-server.log")
+	now := time.Date(2017, 3, 4, 18, 0, 0, 0, time.UTC)
+	f, err := OpenRotatingFile(path, 20, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.now = func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	for _, line := range []string{"one one one\n", "two two two\n", "three three\n", "four four four\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	segments, err := rotatedSegments(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// "one" was rotated out first and pruned.
+	numberEqual(t, len(segments), 2)
+	for _, segment := range segments {
+		if !strings.HasSuffix(segment, ".gz") {
+			t.Fatalf("Expected %s to be compressed", segment)
+		}
+	}
+	stringEqual(t, readSegment(t, segments[0]), "two two two\n")
+	stringEqual(t, readSegment(t, segments[1]), "three three\n")
+	stringEqual(t, readSegment(t, path), "four four four\n")
+}
+
+func TestRotatingFileByAge(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "garage-server.log")
+	now := time.Date(2017, 3, 4, 18, 0, 0, 0, time.UTC)
+	f, err := OpenRotatingFile(path, 0, 24*time.Hour, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.now = func() time.Time { return now }
+	f.opened = now
+
+	f.Write([]byte("monday\n"))
+	now = now.Add(23 * time.Hour)
+	f.Write([]byte("still monday\n"))
+	now = now.Add(time.Hour)
+	f.Write([]byte("tuesday\n"))
+	f.Close()
+
+	segments, err := rotatedSegments(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, len(segments), 1)
+	stringEqual(t, filepath.Base(segments[0]), "garage-server.log.20170305-180000.000.gz")
+	stringEqual(t, readSegment(t, segments[0]), "monday\nstill monday\n")
+	stringEqual(t, readSegment(t, path), "tuesday\n")
+}
+
+func TestRotatingFileFailedRename(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "garage-server.log")
+	now := time.Date(2017, 3, 4, 18, 0, 0, 0, time.UTC)
+	f, err := OpenRotatingFile(path, 20, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.now = func() time.Time { return now }
+	// A directory where the segment would go makes the rename fail.
+	if err := os.Mkdir(path+"."+now.Format(rotatedSuffixLayout), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, line := range []string{"one one one\n", "two two two\n"} {
+		if _, err := f.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	f.Close()
+	stringEqual(t, readSegment(t, path), "one one one\ntwo two two\n")
+}
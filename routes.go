@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// RouteConfig holds everything the HTTP routes are built from.
+type RouteConfig struct {
+	Hub          *EventHub
+	Watcher      *DoorWatcher
+	DoorStatus   func(context.Context, int) (string, error)
+	ToggleSwitch func(context.Context, int, int) error
+	CheckGPIO    func(context.Context) error
+	Logger       *Logger
+	Store        *EventStore
+	Door         string
+
+	// Control serializes the commands sent to the door over HTTP, the
+	// control channel, MQTT and HomeKit.
+	Control *DoorControl
+
+	// Metrics is counted by every route and served at /metrics to the
+	// scrapers MetricsAccess lets in.
+	Metrics       *Metrics
+	MetricsAccess MetricsAccess
+
+	// Tracer, if set, exports a span for every request, its handler, its
+	// authentication and the door operations it runs.
+	Tracer *Tracer
+
+	// Cert is the TLS certificate served, checked by /readyz for expiry.
+	Cert string
+
+	// Webhooks, if set, posts events to subscribers. Its delivery log is
+	// served at /api/v2/webhooks/deliveries.
+	Webhooks *WebhookDispatcher
+
+	// Notifier, MQTT and HomeKit are set when the server emails, bridges to
+	// an MQTT broker or serves HomeKit, for /version to report.
+	Notifier *Notifier
+	MQTT     *MQTTBridge
+	HomeKit  *HomeKitBridge
+
+	PinNumber      int
+	StatusPin      int
+	SleepTimeout   int
+	Heartbeat      time.Duration
+	SessionTimeout time.Duration
+
+	// Legacy serves the original unversioned routes, which accept any
+	// method and answer errors with bare status codes.
+	Legacy bool
+}
+
+type route struct {
+	pattern string
+	handler http.HandlerFunc
+}
+
+func routes(c RouteConfig) []route {
+	var r []route
+	info := serverInfo(c)
+
+	if c.Legacy {
+		r = append(r,
+			route{"/toggle", CreateRelayHandle(c.ToggleSwitch, c.Logger, c.PinNumber, c.SleepTimeout)},
+			route{"/status", CreateDoorStatusHandler(c.DoorStatus, c.Logger, c.StatusPin, c.Watcher)},
+			route{"/version", CreateVersionHandler(info, c.Logger)},
+			route{"/logs", CreateLogsHandler(c.Logger, c.Store)},
+			route{"/logs.csv", AuthenticatedHandler(LogsCSVHandler(c.Logger, c.Store))},
+			route{"/logs.ics", AuthenticatedHandler(LogsICSHandler(c.Logger, c.Store))},
+			route{"/stats", CreateStatsHandler(c.Logger, c.Store)},
+			route{"/events", CreateEventsHandler(c.Hub, c.Logger, c.Heartbeat)},
+			route{"/control", CreateControlHandler(c.Hub, c.Control, c.DoorStatus, c.ToggleSwitch, c.Logger, c.PinNumber, c.StatusPin, c.SleepTimeout, c.SessionTimeout)},
+		)
+	}
+
+	r = append(r,
+		route{"/openapi.json", RequireMethod("GET", OpenAPIHandler)},
+		route{"/healthz", RequireMethod("GET", HealthHandler)},
+		route{"/readyz", RequireMethod("GET", ReadinessHandler(readinessChecks(c), c.Logger))},
+		route{"/metrics", RequireMethod("GET", MetricsHandler(c.Metrics, c.MetricsAccess, c.Logger))},
+		route{"/api/v2/version", RequireMethod("GET", APIAuthenticatedHandler(VersionHandler(info, c.Logger)))},
+		route{"/api/v2/status", RequireMethod("GET", APIAuthenticatedHandler(APIStatusHandler(c.DoorStatus, c.Logger, c.StatusPin, c.Watcher)))},
+		route{"/api/v2/logs", RequireMethod("GET", APIAuthenticatedHandler(APILogsHandler(c.Logger, c.Store)))},
+		route{"/api/v2/logs.csv", RequireMethod("GET", APIAuthenticatedHandler(LogsCSVHandler(c.Logger, c.Store)))},
+		route{"/api/v2/logs.ics", RequireMethod("GET", APIAuthenticatedHandler(LogsICSHandler(c.Logger, c.Store)))},
+		route{"/api/v2/stats", RequireMethod("GET", APIAuthenticatedHandler(APIStatsHandler(c.Logger, c.Store)))},
+		route{"/api/v2/events", RequireMethod("GET", APIAuthenticatedHandler(EventsHandler(c.Hub, c.Logger, c.Heartbeat)))},
+		route{"/api/v2/webhooks/deliveries", RequireMethod("GET", APIAuthenticatedHandler(WebhookDeliveriesHandler(c.Webhooks, c.Logger)))},
+		route{"/api/v2/control", RequireMethod("GET", signatureFromQuery(APIAuthenticatedHandler(ControlHandler(c.Hub, c.Control, c.DoorStatus, c.ToggleSwitch, c.Logger, c.PinNumber, c.StatusPin, c.SleepTimeout, c.SessionTimeout))))},
+	)
+	for _, command := range []string{"toggle", "open", "close"} {
+		r = append(r, route{"/api/v2/" + command, RequireMethod("POST", APIAuthenticatedHandler(APICommandHandler(command, c.Control, c.DoorStatus, c.ToggleSwitch, c.Logger, c.PinNumber, c.StatusPin, c.SleepTimeout)))})
+	}
+
+	return r
+}
+
+// NewRouter serves every route, tagging requests with an ID, tracing and
+// timing them and letting handlers record events to c.Store.
+func NewRouter(c RouteConfig) http.Handler {
+	if c.Metrics == nil {
+		c.Metrics = NewMetrics(Version)
+	}
+	if c.Control == nil {
+		c.Control = NewDoorControl()
+	}
+	c.DoorStatus = TraceDoorStatus(c.DoorStatus)
+	c.ToggleSwitch = TraceToggleSwitch(c.ToggleSwitch)
+	mux := http.NewServeMux()
+	for _, r := range routes(c) {
+		mux.HandleFunc(r.pattern, traceRoute(r.pattern, r.handler))
+	}
+	mux.HandleFunc("/api/v2/", APINotFoundHandler)
+	return RequestIDHandler(TraceHandler(c.Tracer, mux, c.Metrics.Handler(mux, RequestLogHandler(c.Logger, HistoryHandler(c.Store, c.Door, c.Logger, mux)))))
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+)
+
+// StatsFilter selects the range /stats covers and the zone its days, weeks
+// and hours are counted in.
+type StatsFilter struct {
+	From     time.Time
+	To       time.Time
+	Door     string
+	Location *time.Location
+}
+
+func (f StatsFilter) Match(event HistoryEvent) bool {
+	if event.Time.Before(f.From) || !event.Time.Before(f.To) {
+		return false
+	}
+	if f.Door != "" && event.Door != f.Door {
+		return false
+	}
+	return event.Type == EventStateChanged || event.Type == EventCommandIssued
+}
+
+// ParseStatsFilter reads from, to, door and tz from the query string. The
+// range defaults to the last 30 days, and dates are days in tz.
+func ParseStatsFilter(req *http.Request) (StatsFilter, *APIError) {
+	query := req.URL.Query()
+	filter := StatsFilter{Door: query.Get("door"), Location: time.Local}
+
+	if tz := query.Get("tz"); tz != "" {
+		location, err := time.LoadLocation(tz)
+		if err != nil {
+			return filter, invalidLogParameter("tz", tz)
+		}
+		filter.Location = location
+	}
+
+	var err error
+	filter.To = time.Now()
+	if to := query.Get("to"); to != "" {
+		if filter.To, err = parseLogTime(to, true, filter.Location); err != nil {
+			return filter, invalidLogParameter("to", to)
+		}
+	}
+	filter.From = filter.To.AddDate(0, 0, -defaultStatsDays)
+	if from := query.Get("from"); from != "" {
+		if filter.From, err = parseLogTime(from, false, filter.Location); err != nil {
+			return filter, invalidLogParameter("from", from)
+		}
+	}
+
+	if !filter.From.Before(filter.To) {
+		return filter, &APIError{Status: 400, Code: "invalid_parameter", Message: "Invalid range; from must be before to"}
+	}
+	if filter.To.Sub(filter.From) > maxStatsDays*24*time.Hour {
+		return filter, &APIError{Status: 400, Code: "invalid_parameter", Message: fmt.Sprintf("Invalid range; at most %d days can be asked for", maxStatsDays)}
+	}
+	return filter, nil
+}
+
+// StatsBucket counts the times the door opened in the day or week starting
+// on Date.
+type StatsBucket struct {
+	Date   string `json:"date"`
+	Cycles int    `json:"cycles"`
+}
+
+// Stats summarises how the door was used over a range of its history. A
+// cycle is the door opening; the durations only cover cycles that closed
+// again within the range.
+type Stats struct {
+	From                string         `json:"from"`
+	To                  string         `json:"to"`
+	Cycles              int            `json:"cycles"`
+	Days                []StatsBucket  `json:"days"`
+	Weeks               []StatsBucket  `json:"weeks"`
+	AverageOpenDuration float64        `json:"average_open_seconds"`
+	MaxOpenDuration     float64        `json:"max_open_seconds"`
+	Hours               []int          `json:"hours"`
+	Users               map[string]int `json:"users"`
+}
+
+// startOfWeek returns the Monday of day's week.
+func startOfWeek(day time.Time) time.Time {
+	return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+}
+
+// ComputeStats summarises events, oldest first, over the filter's range.
+// Users counts the successful commands sent with a user header.
+func ComputeStats(events []HistoryEvent, filter StatsFilter) Stats {
+	location := filter.Location
+	stats := Stats{
+		From:  filter.From.In(location).Format(time.RFC3339),
+		To:    filter.To.In(location).Format(time.RFC3339),
+		Days:  []StatsBucket{},
+		Weeks: []StatsBucket{},
+		Hours: make([]int, 24),
+		Users: map[string]int{},
+	}
+
+	// Every day and week in the range gets a bucket, so gaps show as zero.
+	days := map[string]int{}
+	weeks := map[string]int{}
+	from := filter.From.In(location)
+	for day := time.Date(from.Year(), from.Month(), from.Day(), 0, 0, 0, 0, location); day.Before(filter.To); day = day.AddDate(0, 0, 1) {
+		days[day.Format("2006-01-02")] = len(stats.Days)
+		stats.Days = append(stats.Days, StatsBucket{Date: day.Format("2006-01-02")})
+		week := startOfWeek(day).Format("2006-01-02")
+		if _, ok := weeks[week]; !ok {
+			weeks[week] = len(stats.Weeks)
+			stats.Weeks = append(stats.Weeks, StatsBucket{Date: week})
+		}
+	}
+
+	for _, event := range events {
+		if event.Type == EventCommandIssued && event.Outcome == OutcomeSuccess && event.User != "" {
+			stats.Users[event.User]++
+		}
+	}
+
+	var total time.Duration
+	closed := 0
+	for _, interval := range doorIntervals(events) {
+		at := interval.Opened.Time.In(location)
+		stats.Cycles++
+		stats.Days[days[at.Format("2006-01-02")]].Cycles++
+		stats.Weeks[weeks[startOfWeek(at).Format("2006-01-02")]].Cycles++
+		stats.Hours[at.Hour()]++
+
+		if interval.Closed.ID != 0 {
+			duration := interval.Closed.Time.Sub(interval.Opened.Time)
+			total += duration
+			closed++
+			if duration.Seconds() > stats.MaxOpenDuration {
+				stats.MaxOpenDuration = duration.Seconds()
+			}
+		}
+	}
+	if closed > 0 {
+		stats.AverageOpenDuration = total.Seconds() / float64(closed)
+	}
+	return stats
+}
+
+// openedByWindow is how soon after a command the door has to open for the
+// command's user to be credited with opening it.
+const openedByWindow = time.Minute
+
+// doorInterval is one time a door was open. Closed has no ID while the door
+// is still open, and User is who sent the command that opened it, if anyone
+// did.
+type doorInterval struct {
+	Opened HistoryEvent
+	Closed HistoryEvent
+	User   string
+}
+
+// doorIntervals pairs each door opening in events, oldest first, with the
+// close that follows it. The watcher records the state again on restart, so
+// only a change from closed opens an interval, and a close with no opening
+// before it is ignored.
+func doorIntervals(events []HistoryEvent) []doorInterval {
+	intervals := []doorInterval{}
+	open := map[string]int{}
+	commands := map[string]HistoryEvent{}
+	for _, event := range events {
+		switch event.Type {
+		case EventCommandIssued:
+			if event.Outcome == OutcomeSuccess && event.Detail != "close" && event.Detail != "status" {
+				commands[event.Door] = event
+			}
+		case EventStateChanged:
+			i, isOpen := open[event.Door]
+			switch {
+			case event.Detail == "open" && !isOpen:
+				interval := doorInterval{Opened: event}
+				if command, ok := commands[event.Door]; ok {
+					since := event.Time.Sub(command.Time)
+					if since >= 0 && since <= openedByWindow {
+						interval.User = command.User
+					}
+				}
+				delete(commands, event.Door)
+				open[event.Door] = len(intervals)
+				intervals = append(intervals, interval)
+			case event.Detail == "closed" && isOpen:
+				intervals[i].Closed = event
+				delete(open, event.Door)
+			}
+		}
+	}
+	return intervals
+}
+
+// queryStats reads the range the request asks for from store and
+// summarises it.
+func queryStats(store *EventStore, req *http.Request) (Stats, *APIError) {
+	filter, apiErr := ParseStatsFilter(req)
+	if apiErr != nil {
+		return Stats{}, apiErr
+	}
+
+	events, err := store.QuerySince(filter.From, filter.Match)
+	if err != nil {
+		return Stats{}, &APIError{Status: 500, Code: "store_unavailable", Message: fmt.Sprintf("Could not read event store: %s", err)}
+	}
+	ReverseEvents(events)
+	return ComputeStats(events, filter), nil
+}
+
+// ReverseEvents puts events from a query oldest first.
+func ReverseEvents(events []HistoryEvent) {
+	for i, j := 0, len(events)-1; i < j; i, j = i+1, j-1 {
+		events[i], events[j] = events[j], events[i]
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func createStatsHistory(t *testing.T) *EventStore {
+	store := CreateTestStore(t)
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2017, 3, day, hour, minute, 0, 0, time.UTC)
+	}
+	state := func(t time.Time, state string) {
+		store.Append(HistoryEvent{Time: t, Type: EventStateChanged, Door: "garage", Outcome: OutcomeSuccess, Detail: state})
+	}
+	command := func(t time.Time, user string, outcome string) {
+		store.Append(HistoryEvent{Time: t, Type: EventCommandIssued, User: user, Door: "garage", Outcome: outcome, Detail: "toggle"})
+	}
+
+	// Opened before the range, so neither this cycle nor its close counts.
+	state(time.Date(2017, 2, 28, 23, 50, 0, 0, time.UTC), "open")
+	state(at(1, 0, 10), "closed")
+
+	command(at(1, 8, 0), "dillon", OutcomeSuccess)
+	state(at(1, 8, 0), "open")
+	state(at(1, 8, 2), "open")
+	state(at(1, 8, 10), "closed")
+	command(at(1, 18, 0), "sam", OutcomeSuccess)
+	state(at(1, 18, 0), "open")
+	state(at(1, 18, 2), "closed")
+	command(at(6, 8, 0), "dillon", OutcomeSuccess)
+	command(at(6, 8, 1), "dillon", OutcomeFailure)
+	command(at(6, 8, 1), "", OutcomeSuccess)
+	state(at(6, 8, 0), "open")
+	state(at(6, 8, 30), "closed")
+	store.Append(HistoryEvent{Time: at(6, 9, 0), Type: EventStateChanged, Door: "shed", Outcome: OutcomeSuccess, Detail: "open"})
+	// Still open when the range ends.
+	state(at(7, 22, 0), "open")
+	return store
+}
+
+func getStats(t *testing.T, store *EventStore, query string) (*httptest.ResponseRecorder, Stats) {
+	writer := httptest.NewRecorder()
+	APIStatsHandler(DummyLogger, store)(writer, signedRequest(t, "GET", "/api/v2/stats"+query, SharedSecret))
+
+	var stats Stats
+	if writer.Code == 200 {
+		if err := json.NewDecoder(writer.Body).Decode(&stats); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return writer, stats
+}
+
+func TestStats(t *testing.T) {
+	store := createStatsHistory(t)
+
+	writer, stats := getStats(t, store, "?from=2017-03-01&to=2017-03-07&door=garage&tz=UTC")
+	responseEqual(t, writer.Code, 200)
+	stringEqual(t, stats.From, "2017-03-01T00:00:00Z")
+	stringEqual(t, stats.To, "2017-03-08T00:00:00Z")
+	numberEqual(t, stats.Cycles, 4)
+
+	numberEqual(t, len(stats.Days), 7)
+	stringEqual(t, stats.Days[0].Date, "2017-03-01")
+	numberEqual(t, stats.Days[0].Cycles, 2)
+	numberEqual(t, stats.Days[1].Cycles, 0)
+	numberEqual(t, stats.Days[5].Cycles, 1)
+	numberEqual(t, stats.Days[6].Cycles, 1)
+
+	numberEqual(t, len(stats.Weeks), 2)
+	stringEqual(t, stats.Weeks[0].Date, "2017-02-27")
+	numberEqual(t, stats.Weeks[0].Cycles, 2)
+	stringEqual(t, stats.Weeks[1].Date, "2017-03-06")
+	numberEqual(t, stats.Weeks[1].Cycles, 2)
+
+	// 10, 2 and 30 minutes; the last cycle never closed.
+	numberEqual(t, int(stats.AverageOpenDuration), 840)
+	numberEqual(t, int(stats.MaxOpenDuration), 1800)
+
+	numberEqual(t, len(stats.Hours), 24)
+	numberEqual(t, stats.Hours[8], 2)
+	numberEqual(t, stats.Hours[18], 1)
+	numberEqual(t, stats.Hours[22], 1)
+
+	numberEqual(t, len(stats.Users), 2)
+	numberEqual(t, stats.Users["dillon"], 2)
+	numberEqual(t, stats.Users["sam"], 1)
+}
+
+func TestStatsTimeZone(t *testing.T) {
+	store := createStatsHistory(t)
+
+	// 23:50 UTC on 28 February is 1 March in Berlin.
+	_, stats := getStats(t, store, "?from=2017-03-01&to=2017-03-07&door=garage&tz=Europe/Berlin")
+	stringEqual(t, stats.From, "2017-03-01T00:00:00+01:00")
+	numberEqual(t, stats.Cycles, 5)
+	numberEqual(t, stats.Days[0].Cycles, 3)
+	numberEqual(t, stats.Hours[0], 1)
+	numberEqual(t, stats.Hours[9], 2)
+	numberEqual(t, stats.Hours[23], 1)
+}
+
+func TestStatsDefaultRange(t *testing.T) {
+	store := CreateTestStore(t)
+	store.Append(HistoryEvent{Time: time.Now().AddDate(0, 0, -40), Type: EventStateChanged, Outcome: OutcomeSuccess, Detail: "open"})
+	store.Append(HistoryEvent{Time: time.Now().Add(-time.Hour), Type: EventStateChanged, Outcome: OutcomeSuccess, Detail: "open"})
+
+	writer, stats := getStats(t, store, "")
+	responseEqual(t, writer.Code, 200)
+	numberEqual(t, stats.Cycles, 1)
+	numberEqual(t, len(stats.Days), 31)
+}
+
+func TestStatsInvalidParameters(t *testing.T) {
+	store := CreateTestStore(t)
+
+	for _, query := range []string{
+		"?from=yesterday",
+		"?to=2017-13-01",
+		"?tz=Mars/Olympus",
+		"?from=2017-03-02&to=2017-03-01",
+		"?from=2016-01-01&to=2017-03-01",
+	} {
+		writer, _ := getStats(t, store, query)
+		responseEqual(t, writer.Code, 400)
+		stringEqual(t, decodeAPIError(t, writer).Code, "invalid_parameter")
+	}
+}
+
+func TestStatsStoreError(t *testing.T) {
+	store := CreateTestStore(t)
+	store.Append(HistoryEvent{Type: EventStateChanged, Outcome: OutcomeSuccess, Detail: "open"})
+	CorruptTestStore(t, store)
+
+	writer, _ := getStats(t, store, "")
+	responseEqual(t, writer.Code, 500)
+	stringEqual(t, decodeAPIError(t, writer).Code, "store_unavailable")
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	EventCommandIssued = "command_issued"
+	EventStateChanged  = "state_changed"
+	EventAuthFailure   = "auth_failure"
+	EventUpdateApplied = "update_applied"
+
+	// Only imported from the legacy text log.
+	EventRequest = "request"
+	EventError   = "error"
+	EventMessage = "message"
+)
+
+// SourceImport marks events copied from the legacy text log by import-logs.
+const SourceImport = "import"
+
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+	OutcomeDenied  = "denied"
+)
+
+// HistoryEvent is one entry in the event store. Detail depends on the type:
+// the command name, the new door state, the auth failure reason or the
+// version installed by an update. Count is set on an event that stands for
+// several, such as repeated auth failures from one address; its detail is
+// the last one's.
+type HistoryEvent struct {
+	ID       uint64    `json:"id"`
+	Time     time.Time `json:"time"`
+	Type     string    `json:"type"`
+	User     string    `json:"user,omitempty"`
+	Door     string    `json:"door,omitempty"`
+	SourceIP string    `json:"source_ip,omitempty"`
+	Outcome  string    `json:"outcome"`
+	Detail   string    `json:"detail,omitempty"`
+	Count    int       `json:"count,omitempty"`
+	Source   string    `json:"source,omitempty"`
+	Hash     string    `json:"hash,omitempty"`
+}
+
+// storeCheckpointInterval is how many events apart checkpoints are kept.
+const storeCheckpointInterval = 256
+
+// A storeCheckpoint records where an event ends in the file, so a query for
+// events before a cursor can start reading there instead of at the end.
+type storeCheckpoint struct {
+	id     uint64
+	offset int64
+	line   int
+}
+
+// EventStore is an append-only file of JSON encoded events, one per line.
+// IDs increase through the file, so it is read newest first by reading it
+// backwards. With an audit key each event is chained to the one before it
+// by a keyed hash; see VerifyAudit.
+type EventStore struct {
+	mu          sync.Mutex
+	path        string
+	file        *os.File
+	key         []byte
+	lastID      uint64
+	lastHash    string
+	size        int64
+	lines       int
+	checkpoints []storeCheckpoint
+
+	// audit caches the last verification until the files change.
+	audit      *AuditReport
+	auditFiles auditFiles
+
+	onAppend []func(HistoryEvent)
+
+	// torn is a partial last line cut off when the store was opened.
+	torn []byte
+}
+
+// ErrStoreInUse is returned for a store another process has open, which
+// is usually the server.
+var ErrStoreInUse = errors.New("the event store is in use by a running server")
+
+// lockStore takes how, an flock operation, on file without waiting for it.
+func lockStore(file *os.File, how int) error {
+	err := syscall.Flock(int(file.Fd()), how|syscall.LOCK_NB)
+	if err == syscall.EWOULDBLOCK {
+		return ErrStoreInUse
+	}
+	return err
+}
+
+// OpenEventStore opens the store at path, creating it if need be, and
+// holds an exclusive lock on it until it is closed. Events are signed with
+// key, or written unsigned if it is nil.
+func OpenEventStore(path string, key []byte) (*EventStore, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockStore(file, syscall.LOCK_EX); err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	store := &EventStore{path: path, file: file, key: key}
+	if store.torn, err = truncateTornLine(file); err != nil {
+		file.Close()
+		return nil, err
+	}
+	err = store.scan(func(event HistoryEvent, length int) bool {
+		store.advance(event.ID, length)
+		store.lastHash = event.Hash
+		return true
+	})
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// A keyed store always has a head. Writing one as soon as the store is
+	// created or first keyed marks where signing started, so stripping
+	// every hash and deleting the head can't pass for a store that was
+	// never signed.
+	if key != nil && store.lastHash == "" {
+		if _, err := os.Stat(auditHeadPath(path)); os.IsNotExist(err) {
+			err = writeAuditHead(path, key, store.lastID, "")
+			if err != nil {
+				file.Close()
+				return nil, err
+			}
+		}
+	}
+
+	if err := store.appendPending(); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return store, nil
+}
+
+// truncateTornLine cuts off a last line that doesn't end in a newline and
+// returns it. Append writes whole lines, so such a line was cut short by a
+// crash or power cut before it was ever recorded in the head file. Damage
+// anywhere else is left for scan to fail on.
+func truncateTornLine(file *os.File) ([]byte, error) {
+	info, err := file.Stat()
+	if err != nil || info.Size() == 0 {
+		return nil, err
+	}
+	last := make([]byte, 1)
+	if _, err := file.ReadAt(last, info.Size()-1); err != nil {
+		return nil, err
+	}
+	if last[0] == '\n' {
+		return nil, nil
+	}
+
+	var torn []byte
+	err = readLinesBackward(file, info.Size(), tailBlockSize, func(line []byte) bool {
+		torn = line
+		return false
+	})
+	if err == nil {
+		err = file.Truncate(info.Size() - int64(len(torn)))
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	return torn, err
+}
+
+func pendingEventsPath(path string) string {
+	return path + ".pending"
+}
+
+// QueuePendingEvent leaves event for the server to append to the store at
+// path the next time it opens it, for when another process has it open.
+func QueuePendingEvent(path string, event HistoryEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(pendingEventsPath(path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// appendPending appends the events queued with QueuePendingEvent, in the
+// order they were queued, and empties the queue.
+func (s *EventStore) appendPending() error {
+	file, err := os.OpenFile(pendingEventsPath(s.path), os.O_RDWR, 0)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX); err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var event HistoryEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("%s:%d: %s", pendingEventsPath(s.path), line, err)
+		}
+		if _, err := s.Append(event); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return file.Truncate(0)
+}
+
+// OnAppend calls f with every event appended from now on, in order, once
+// it is on disk. f runs with the store locked, so it mustn't use the store
+// or block.
+func (s *EventStore) OnAppend(f func(HistoryEvent)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.onAppend = append(s.onAppend, f)
+}
+
+func (s *EventStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
+
+// Append assigns the event the next ID, and the current time if it has
+// none, and writes it to disk before returning.
+func (s *EventStore) Append(event HistoryEvent) (HistoryEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	event.ID = s.lastID + 1
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	event.Hash = ""
+	if s.key != nil {
+		hash, err := chainHash(s.key, s.lastHash, event)
+		if err != nil {
+			return event, err
+		}
+		event.Hash = hash
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		return event, err
+	}
+	verified := s.key != nil && s.audit != nil && s.audit.Verified &&
+		s.auditFiles == statAuditFiles(s.path)
+	if _, err := s.file.Write(append(line, '\n')); err != nil {
+		return event, err
+	}
+	if err := s.file.Sync(); err != nil {
+		return event, err
+	}
+
+	s.advance(event.ID, len(line))
+	s.lastHash = event.Hash
+	for _, f := range s.onAppend {
+		f(event)
+	}
+	if s.key != nil {
+		if err := writeAuditHead(s.path, s.key, event.ID, event.Hash); err != nil {
+			return event, err
+		}
+	}
+
+	// An append of our own extends a verified chain, so it needn't be
+	// checked again from the start.
+	if verified {
+		s.audit.Events++
+		s.auditFiles = statAuditFiles(s.path)
+	} else {
+		s.audit = nil
+	}
+	return event, nil
+}
+
+// Merge adds events to the store in time order among those already in it,
+// where Append would put them all at the end. Every event is renumbered
+// and the chain is signed again, so a keyed store must pass its audit
+// first. The store is rewritten, which is only safe because no other
+// process can have it open.
+func (s *EventStore) Merge(events []HistoryEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(events) == 0 {
+		return nil
+	}
+
+	existing, err := s.verifiedEvents()
+	if err != nil {
+		return err
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Time.Before(events[j].Time)
+	})
+	merged := make([]HistoryEvent, 0, len(existing)+len(events))
+	for _, event := range existing {
+		for len(events) > 0 && events[0].Time.Before(event.Time) {
+			merged = append(merged, events[0])
+			events = events[1:]
+		}
+		merged = append(merged, event)
+	}
+	merged = append(merged, events...)
+	return s.rewrite(merged)
+}
+
+// Rekey signs the whole chain again with key, once it has passed its audit
+// with the current one.
+func (s *EventStore) Rekey(key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, err := s.verifiedEvents()
+	if err != nil {
+		return err
+	}
+	s.key = key
+	return s.rewrite(existing)
+}
+
+// verifiedEvents reads every event, oldest first, after checking a keyed
+// store passes its audit, so rewriting it can't hide tampering.
+func (s *EventStore) verifiedEvents() ([]HistoryEvent, error) {
+	if s.key != nil {
+		report, err := VerifyAudit(s.path, s.key)
+		if err != nil {
+			return nil, err
+		}
+		if !report.Verified {
+			return nil, fmt.Errorf("audit failed after %d events: %s", report.Events, report.Error)
+		}
+	}
+
+	var events []HistoryEvent
+	err := s.scan(func(event HistoryEvent, length int) bool {
+		events = append(events, event)
+		return true
+	})
+	return events, err
+}
+
+// rewrite replaces the store with events, numbered from 1 and chained with
+// the store's key.
+func (s *EventStore) rewrite(events []HistoryEvent) error {
+	// The new file is locked before it replaces the old one, so no other
+	// process can open it in between.
+	tmp := s.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_RDWR|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := lockStore(file, syscall.LOCK_EX); err != nil {
+		file.Close()
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	lastHash := ""
+	for i := range events {
+		event := &events[i]
+		event.ID = uint64(i + 1)
+		event.Hash = ""
+		if s.key != nil {
+			if event.Hash, err = chainHash(s.key, lastHash, *event); err != nil {
+				break
+			}
+		}
+		lastHash = event.Hash
+		var line []byte
+		if line, err = json.Marshal(event); err != nil {
+			break
+		}
+		writer.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, s.path)
+	}
+	if err != nil {
+		file.Close()
+		os.Remove(tmp)
+		return err
+	}
+
+	s.file.Close()
+	s.file = file
+	s.lastID, s.lastHash, s.size, s.lines, s.checkpoints, s.audit = 0, "", 0, 0, nil, nil
+	err = s.scan(func(event HistoryEvent, length int) bool {
+		s.advance(event.ID, length)
+		s.lastHash = event.Hash
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if s.key != nil {
+		return writeAuditHead(s.path, s.key, s.lastID, s.lastHash)
+	}
+	return nil
+}
+
+// CheckWritable checks that events can still be written, without writing
+// one: the store must still be on disk and synced, and its directory must
+// take new files, as the audit head is renamed into it.
+func (s *EventStore) CheckWritable() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, err := os.Stat(s.path); err != nil {
+		return err
+	}
+	if err := s.file.Sync(); err != nil {
+		return err
+	}
+	probe, err := ioutil.TempFile(filepath.Dir(s.path), ".readyz-")
+	if err != nil {
+		return err
+	}
+	err = probe.Close()
+	if removeErr := os.Remove(probe.Name()); err == nil {
+		err = removeErr
+	}
+	return err
+}
+
+// auditFiles identifies a version of the store and its head file, so a
+// change made behind the store's back is verified again.
+type auditFiles struct {
+	size, headSize         int64
+	modified, headModified time.Time
+}
+
+func statAuditFiles(path string) auditFiles {
+	var files auditFiles
+	if info, err := os.Stat(path); err == nil {
+		files.size, files.modified = info.Size(), info.ModTime()
+	}
+	if info, err := os.Stat(auditHeadPath(path)); err == nil {
+		files.headSize, files.headModified = info.Size(), info.ModTime()
+	}
+	return files
+}
+
+// Audit verifies the store's hash chain. The result is kept until the
+// store is changed by something other than Append.
+func (s *EventStore) Audit() (AuditReport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files := statAuditFiles(s.path)
+	if s.audit != nil && s.auditFiles == files {
+		return *s.audit, nil
+	}
+	report, err := VerifyAudit(s.path, s.key)
+	if err != nil {
+		return report, err
+	}
+	s.audit, s.auditFiles = &report, files
+	return report, nil
+}
+
+// advance accounts for an event of length bytes written after the last.
+func (s *EventStore) advance(id uint64, length int) {
+	s.lastID = id
+	s.size += int64(length) + 1
+	s.lines++
+	if s.lines%storeCheckpointInterval == 0 {
+		s.checkpoints = append(s.checkpoints, storeCheckpoint{id: id, offset: s.size, line: s.lines})
+	}
+}
+
+// scan calls f for every event and its length in bytes, oldest first,
+// until f returns false.
+func (s *EventStore) scan(f func(HistoryEvent, int) bool) error {
+	file, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		var event HistoryEvent
+		if err := json.Unmarshal(scanner.Bytes(), &event); err != nil {
+			return fmt.Errorf("%s:%d: %s", s.path, lineNumber, err)
+		}
+		if !f(event, len(scanner.Bytes())) {
+			break
+		}
+	}
+	return scanner.Err()
+}
+
+// Query returns up to limit events matching filter, newest first. A limit
+// of zero or less returns every match.
+func (s *EventStore) Query(filter func(HistoryEvent) bool, limit int) ([]HistoryEvent, error) {
+	return s.QueryBefore(0, filter, limit)
+}
+
+// QueryBefore is Query for events with an ID below before, or all events if
+// before is zero. Only the end of the file is read when the matches are
+// recent, and a checkpoint skips over events newer than before.
+func (s *EventStore) QueryBefore(before uint64, filter func(HistoryEvent) bool, limit int) ([]HistoryEvent, error) {
+	return s.query(before, time.Time{}, filter, limit)
+}
+
+// QuerySince is Query for every event from since on. Events are appended,
+// and imports merged in, in time order, so reading back from the end stops
+// at the first event before since instead of going through the whole store.
+func (s *EventStore) QuerySince(since time.Time, filter func(HistoryEvent) bool) ([]HistoryEvent, error) {
+	return s.query(0, since, filter, 0)
+}
+
+func (s *EventStore) query(before uint64, since time.Time, filter func(HistoryEvent) bool, limit int) ([]HistoryEvent, error) {
+	// Hold the lock so a concurrent Append can't leave a half-written
+	// line at the end of the file.
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	end, lineNumber := s.size, s.lines
+	if before > 0 {
+		i := sort.Search(len(s.checkpoints), func(i int) bool {
+			return s.checkpoints[i].id >= before-1
+		})
+		if i < len(s.checkpoints) {
+			end, lineNumber = s.checkpoints[i].offset, s.checkpoints[i].line
+		}
+	}
+
+	events := []HistoryEvent{}
+	var decodeErr error
+	err := readLinesBackward(s.file, end, tailBlockSize, func(line []byte) bool {
+		var event HistoryEvent
+		if err := json.Unmarshal(line, &event); err != nil {
+			decodeErr = fmt.Errorf("%s:%d: %s", s.path, lineNumber, err)
+			return false
+		}
+		lineNumber--
+		if before > 0 && event.ID >= before {
+			return true
+		}
+		if event.Time.Before(since) {
+			return false
+		}
+		if filter == nil || filter(event) {
+			events = append(events, event)
+		}
+		return limit <= 0 || len(events) < limit
+	})
+	if err == nil {
+		err = decodeErr
+	}
+	return events, err
+}
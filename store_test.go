@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEventStoreAppendAndReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	store, err := OpenEventStore(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Append(HistoryEvent{Type: EventCommandIssued, Outcome: OutcomeSuccess, Detail: "toggle"})
+	store.Append(HistoryEvent{Type: EventStateChanged, Outcome: OutcomeSuccess, Detail: "open"})
+	store.Close()
+
+	store, err = OpenEventStore(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	event, err := store.Append(HistoryEvent{Type: EventStateChanged, Outcome: OutcomeSuccess, Detail: "closed"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, int(event.ID), 3)
+	if time.Since(event.Time) > time.Minute {
+		t.Fatalf("Expected event time to default to now, was %s", event.Time)
+	}
+
+	events, err := store.Query(func(event HistoryEvent) bool {
+		return event.Type == EventStateChanged
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, len(events), 2)
+	stringEqual(t, events[0].Detail, "closed")
+	stringEqual(t, events[1].Detail, "open")
+}
+
+func TestEventStoreReportsCorruptLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	if err := ioutil.WriteFile(path, []byte("{\"id\":1}\nTOGGLE DOOR\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := OpenEventStore(path, testAuditKey)
+	if err == nil || !strings.HasSuffix(err.Error(), "events.jsonl:2: invalid character 'T' looking for beginning of value") {
+		t.Fatalf("Expected line number in error, got %v", err)
+	}
+}
+
+func TestEventStoreDropsTornLastLine(t *testing.T) {
+	store := CreateTestStore(t)
+	store.Append(HistoryEvent{Type: EventStateChanged, Outcome: OutcomeSuccess, Detail: "open"})
+	store.Append(HistoryEvent{Type: EventStateChanged, Outcome: OutcomeSuccess, Detail: "closed"})
+	path := store.path
+	store.Close()
+
+	// A power cut part way through the third.
+	file, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(`{"id":3,"type":"state_cha`)
+	file.Close()
+
+	store, err := OpenEventStore(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	stringEqual(t, string(store.torn), `{"id":3,"type":"state_cha`)
+	if report, _ := VerifyAudit(path, testAuditKey); !report.Verified {
+		t.Fatalf("expected the store to verify without the torn line, got '%s'", report.Error)
+	}
+	event, err := store.Append(HistoryEvent{Type: EventStateChanged, Outcome: OutcomeSuccess, Detail: "open"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, int(event.ID), 3)
+}
+
+func TestEventStoreLock(t *testing.T) {
+	store := CreateTestStore(t)
+	if _, err := OpenEventStore(store.path, testAuditKey); err != ErrStoreInUse {
+		t.Fatalf("expected the open store to be locked, got %v", err)
+	}
+
+	// Other processes leave events for the server to append when it next
+	// opens the store.
+	store.Append(HistoryEvent{Type: EventCommandIssued, Outcome: OutcomeSuccess, Detail: "toggle"})
+	queued := time.Now().Add(-time.Minute).Truncate(time.Second)
+	if err := QueuePendingEvent(store.path, HistoryEvent{Time: queued, Type: EventUpdateApplied, Outcome: OutcomeSuccess, Detail: "v2.1.0"}); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	store, err := OpenEventStore(store.path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	events, _ := store.Query(nil, 0)
+	numberEqual(t, len(events), 2)
+	numberEqual(t, int(events[0].ID), 2)
+	stringEqual(t, events[0].Detail, "v2.1.0")
+	if !events[0].Time.Equal(queued) {
+		t.Errorf("expected the queued time, got %s", events[0].Time)
+	}
+	if report, _ := VerifyAudit(store.path, testAuditKey); !report.Verified {
+		t.Errorf("expected the chain to verify, got '%s'", report.Error)
+	}
+	if data, _ := ioutil.ReadFile(pendingEventsPath(store.path)); len(data) != 0 {
+		t.Errorf("expected the queue to be emptied, got %q", data)
+	}
+}
+
+func TestCommandsAreRecorded(t *testing.T) {
+	store := CreateTestStore(t)
+	router := NewRouter(RouteConfig{
+		DoorStatus:   CreateDummyStatus("closed"),
+		ToggleSwitch: CreateDummyRelay(false),
+		Logger:       DummyLogger,
+		Store:        store,
+		Door:         "garage",
+	})
+
+	req := signedRequest(t, "POST", "/api/v2/open", SharedSecret)
+	req.RemoteAddr = "192.168.1.20:51234"
+	req.Header.Set("user", "dillon")
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	req = signedRequest(t, "POST", "/api/v2/toggle", "Unverified Signature")
+	req.RemoteAddr = "10.0.0.9:40000"
+	router.ServeHTTP(httptest.NewRecorder(), req)
+
+	events, err := store.Query(nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, len(events), 2)
+
+	stringEqual(t, events[0].Type, EventAuthFailure)
+	stringEqual(t, events[0].Outcome, OutcomeDenied)
+	stringEqual(t, events[0].Detail, "Signature does not match")
+	stringEqual(t, events[0].SourceIP, "10.0.0.9")
+
+	stringEqual(t, events[1].Type, EventCommandIssued)
+	stringEqual(t, events[1].Outcome, OutcomeSuccess)
+	stringEqual(t, events[1].Detail, "open")
+	stringEqual(t, events[1].User, "dillon")
+	stringEqual(t, events[1].Door, "garage")
+	stringEqual(t, events[1].SourceIP, "192.168.1.20")
+}
+
+func TestAuthFailuresAreLimited(t *testing.T) {
+	window := authFailureWindow
+	authFailureWindow = 50 * time.Millisecond
+	defer func() { authFailureWindow = window }()
+
+	store := CreateTestStore(t)
+	router := NewRouter(RouteConfig{
+		DoorStatus:   CreateDummyStatus("closed"),
+		ToggleSwitch: CreateDummyRelay(false),
+		Logger:       DummyLogger,
+		Store:        store,
+		Door:         "garage",
+	})
+	fail := func(ip string) {
+		req := signedRequest(t, "POST", "/api/v2/toggle", "Unverified Signature")
+		req.RemoteAddr = ip + ":40000"
+		router.ServeHTTP(httptest.NewRecorder(), req)
+	}
+
+	for i := 0; i < 4; i++ {
+		fail("10.0.0.9")
+	}
+	fail("10.0.0.10")
+	events, _ := store.Query(nil, 0)
+	numberEqual(t, len(events), 2)
+
+	// The rest are counted into one event when the window ends.
+	for i := 0; i < 100 && len(events) < 3; i++ {
+		time.Sleep(5 * time.Millisecond)
+		events, _ = store.Query(nil, 0)
+	}
+	numberEqual(t, len(events), 3)
+	stringEqual(t, events[0].SourceIP, "10.0.0.9")
+	numberEqual(t, events[0].Count, 3)
+	stringEqual(t, events[0].Detail, "Signature does not match")
+
+	time.Sleep(3 * authFailureWindow)
+	events, _ = store.Query(nil, 0)
+	numberEqual(t, len(events), 3)
+}
+
+func TestStateChangesAreRecorded(t *testing.T) {
+	store := CreateTestStore(t)
+	hub := NewEventHub(10)
+	status := "open"
+	doorStatus := func(context.Context, int) (string, error) { return status, nil }
+	watcher := NewDoorWatcher(doorStatus, DummyLogger, 0, hub)
+	RecordStateChanges(watcher, store, "garage", DummyLogger)
+
+	watcher.Poll()
+	// More log records than the hub keeps can't push the change out.
+	for i := 0; i < 20; i++ {
+		hub.Publish("log", "ignored")
+	}
+	status = "closed"
+	watcher.Poll()
+	watcher.Poll()
+
+	events, _ := store.Query(nil, 0)
+	numberEqual(t, len(events), 2)
+	stringEqual(t, events[0].Type, EventStateChanged)
+	stringEqual(t, events[0].Detail, "closed")
+	stringEqual(t, events[1].Detail, "open")
+}
+
+func TestEventStoreQueryBefore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	store, err := OpenEventStore(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3*storeCheckpointInterval; i++ {
+		store.Append(HistoryEvent{Type: EventCommandIssued, Outcome: OutcomeSuccess, Detail: "toggle"})
+	}
+	store.Close()
+
+	// Reopening rebuilds the checkpoints from the file.
+	store, err = OpenEventStore(path, testAuditKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	numberEqual(t, len(store.checkpoints), 3)
+
+	for before, expected := range map[uint64][]int{
+		1:     {},
+		2:     {1},
+		300:   {299, 298},
+		513:   {512, 511},
+		769:   {768, 767},
+		10000: {768, 767},
+	} {
+		events, err := store.QueryBefore(before, nil, 2)
+		if err != nil {
+			t.Fatal(err)
+		}
+		numberEqual(t, len(events), len(expected))
+		for i, event := range events {
+			numberEqual(t, int(event.ID), expected[i])
+		}
+	}
+}
+
+func TestEventStoreQuerySince(t *testing.T) {
+	store := CreateTestStore(t)
+	at := func(hour int) time.Time { return time.Date(2017, 3, 1, hour, 0, 0, 0, time.UTC) }
+	for _, hour := range []int{10, 8, 11, 12} {
+		store.Append(HistoryEvent{Time: at(hour), Type: EventCommandIssued, Outcome: OutcomeSuccess, Detail: "toggle"})
+	}
+
+	// Reading stops at the 8:00 event, so the one before it isn't reached.
+	events, err := store.QuerySince(at(9), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, len(events), 2)
+	numberEqual(t, int(events[0].ID), 4)
+	numberEqual(t, int(events[1].ID), 3)
+}
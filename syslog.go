@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const netSinkTimeout = 5 * time.Second
+
+// netSinkQueueSize is how many records may wait to be sent before more are
+// dropped.
+const netSinkQueueSize = 1000
+
+var errNetSinkFull = errors.New("log queue is full")
+
+// netSink sends each record as one message over a connection, dialing again
+// after a failure so a restarted syslog daemon is picked back up. Records
+// are sent from their own goroutine, so a slow or unreachable server can't
+// hold up whoever is logging; they are dropped when the queue is full.
+type netSink struct {
+	network string
+	address string
+	conn    net.Conn
+	format  func(Record) []byte
+	queue   chan []byte
+
+	mu      sync.Mutex
+	dropped int
+}
+
+func newNetSink(network string, address string, format func(Record) []byte) *netSink {
+	s := &netSink{network: network, address: address, format: format, queue: make(chan []byte, netSinkQueueSize)}
+	go s.run()
+	return s
+}
+
+func (s *netSink) WriteRecord(record Record) error {
+	select {
+	case s.queue <- s.format(record):
+		return nil
+	default:
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+		return errNetSinkFull
+	}
+}
+
+// run sends queued records, and says how many were dropped once there is
+// room again.
+func (s *netSink) run() {
+	for message := range s.queue {
+		s.send(message)
+
+		s.mu.Lock()
+		dropped := s.dropped
+		s.dropped = 0
+		s.mu.Unlock()
+		if dropped > 0 {
+			s.send(s.format(Record{Time: time.Now(), Level: LevelWarn, Message: "Dropped log records", Fields: []Field{{"count", dropped}}}))
+		}
+	}
+}
+
+func (s *netSink) send(message []byte) error {
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			s.conn, err = net.DialTimeout(s.network, s.address, netSinkTimeout)
+			if err != nil {
+				s.conn = nil
+				return err
+			}
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(netSinkTimeout))
+		if _, err = s.conn.Write(message); err == nil {
+			return nil
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+	return err
+}
+
+const (
+	syslogAppName        = "garage-server"
+	syslogFacilityDaemon = 3
+
+	// syslogSDID names the structured data element carrying a record's
+	// fields. 32473 is the enterprise number reserved for documentation;
+	// the project has none of its own.
+	syslogSDID = "garage@32473"
+)
+
+var syslogSeverity = map[Level]int{
+	LevelDebug: 7,
+	LevelInfo:  6,
+	LevelWarn:  4,
+	LevelError: 3,
+}
+
+// NewSyslogSink sends records to the syslog server at rawURL, which is one
+// of udp://host[:port], tcp://host[:port] or unix:///path/to/socket, as RFC
+// 5424 messages with the fields as structured data.
+func NewSyslogSink(rawURL string) (LogSink, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil || hostname == "" {
+		hostname = "-"
+	}
+	pid := os.Getpid()
+	format := func(record Record) []byte {
+		return formatSyslog(record, hostname, pid)
+	}
+
+	switch u.Scheme {
+	case "udp", "tcp":
+		address := u.Host
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), "514")
+		}
+		if u.Scheme == "tcp" {
+			// RFC 6587 octet counting, so messages can hold newlines.
+			format = func(record Record) []byte {
+				message := formatSyslog(record, hostname, pid)
+				return append([]byte(fmt.Sprintf("%d ", len(message))), message...)
+			}
+		}
+		return newNetSink(u.Scheme, address, format), nil
+	case "unix":
+		return newNetSink("unixgram", u.Path, format), nil
+	}
+	return nil, fmt.Errorf("unsupported syslog address '%s'", rawURL)
+}
+
+// formatSyslog renders a record as an RFC 5424 message.
+func formatSyslog(record Record, hostname string, pid int) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "<%d>1 %s %s %s %d - ",
+		syslogFacilityDaemon*8+syslogSeverity[record.Level],
+		record.Time.Format("2006-01-02T15:04:05.000000Z07:00"),
+		hostname, syslogAppName, pid)
+
+	if len(record.Fields) == 0 {
+		buf.WriteString("-")
+	} else {
+		buf.WriteString("[" + syslogSDID)
+		for _, field := range record.Fields {
+			fmt.Fprintf(&buf, ` %s="%s"`, syslogParamName(field.Key), syslogParamEscaper.Replace(fmt.Sprint(fieldValue(field.Value))))
+		}
+		buf.WriteString("]")
+	}
+
+	buf.WriteString(" ")
+	buf.WriteString(record.Message)
+	return buf.Bytes()
+}
+
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// syslogParamName drops the characters RFC 5424 doesn't allow in a
+// parameter name.
+func syslogParamName(key string) string {
+	name := strings.Map(func(r rune) rune {
+		if r <= ' ' || r > '~' || r == '=' || r == ']' || r == '"' {
+			return -1
+		}
+		return r
+	}, key)
+	if name == "" {
+		return "field"
+	}
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return name
+}
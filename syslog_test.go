@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testRecord() Record {
+	return Record{
+		Time:    time.Date(2017, 3, 4, 18, 21, 7, 512000000, time.FixedZone("CST", -6*60*60)),
+		Level:   LevelWarn,
+		Message: "Invalid wait 'soon'",
+		Fields:  []Field{{"door", "garage"}, {"path", `/status?x="]`}, {"status", 400}},
+	}
+}
+
+var expectedSyslog = regexp.MustCompile(`^<28>1 2017-03-04T18:21:07\.512000-06:00 \S+ garage-server \d+ - \[garage@32473 door="garage" path="/status\?x=\\"\\]" status="400"\] Invalid wait 'soon'$`)
+
+func checkSyslogMessage(t *testing.T, message string) {
+	if !expectedSyslog.MatchString(message) {
+		t.Fatalf("Unexpected syslog message %q", message)
+	}
+}
+
+func TestSyslogOverUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := NewSyslogSink("udp://" + conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteRecord(testRecord()); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkSyslogMessage(t, string(buf[:n]))
+}
+
+func TestSyslogOverTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	messages := make(chan string)
+	go func() {
+		// Drop the first connection after one message to check the sink
+		// dials again.
+		for i := 0; i < 2; i++ {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			reader := bufio.NewReader(conn)
+			length, err := reader.ReadString(' ')
+			if err == nil {
+				n, _ := strconv.Atoi(strings.TrimSpace(length))
+				message := make([]byte, n)
+				if _, err := io.ReadFull(reader, message); err == nil {
+					messages <- string(message)
+				}
+			}
+			conn.Close()
+		}
+	}()
+
+	sink, err := NewSyslogSink("tcp://" + listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.WriteRecord(testRecord())
+	checkSyslogMessage(t, <-messages)
+
+	// The first write after the server hangs up can still succeed, so
+	// keep writing until one arrives on the new connection.
+	deadline := time.After(5 * time.Second)
+	for {
+		sink.WriteRecord(testRecord())
+		select {
+		case message := <-messages:
+			checkSyslogMessage(t, message)
+			return
+		case <-time.After(10 * time.Millisecond):
+		case <-deadline:
+			t.Fatal("Expected the sink to reconnect")
+		}
+	}
+}
+
+func TestSyslogOverUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "log")
+	conn, err := net.ListenPacket("unixgram", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	sink, err := NewSyslogSink("unix://" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := testRecord()
+	record.Level = LevelError
+	record.Fields = nil
+	if err := sink.WriteRecord(record); err != nil {
+		t.Fatal(err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	expected := fmt.Sprintf("<27>1 2017-03-04T18:21:07.512000-06:00 %s garage-server %d - - Invalid wait 'soon'", hostname, os.Getpid())
+	stringEqual(t, string(buf[:n]), expected)
+}
+
+func TestSyslogAddress(t *testing.T) {
+	if _, err := NewSyslogSink("http://localhost"); err == nil {
+		t.Fatal("Expected an error for an unsupported scheme")
+	}
+	sink, err := NewSyslogSink("udp://logs.local")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stringEqual(t, sink.(*netSink).address, "logs.local:514")
+}
+
+func TestSyslogDropsWhenFull(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Not running yet, as if the server were stuck.
+	format := func(record Record) []byte { return []byte(record.Message) }
+	sink := &netSink{network: "udp", address: conn.LocalAddr().String(), format: format, queue: make(chan []byte, 1)}
+	record := testRecord()
+	if err := sink.WriteRecord(record); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.WriteRecord(record); err != errNetSinkFull {
+		t.Fatalf("expected the record to be dropped, got %v", err)
+	}
+
+	go sink.run()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 2048)
+	for _, expected := range []string{"Invalid wait 'soon'", "Dropped log records"} {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stringEqual(t, string(buf[:n]), expected)
+	}
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io"
+)
+
+const tailBlockSize = 64 * 1024
+
+// readLinesBackward calls f with each line of r before offset end, last line
+// first, until f returns false. It reads blockSize bytes at a time from the
+// end, so the last few lines of a large file cost a single read. A newline
+// at end doesn't start another line.
+func readLinesBackward(r io.ReaderAt, end int64, blockSize int, f func(line []byte) bool) error {
+	var partial []byte
+	first := true
+	for end > 0 {
+		size := int64(blockSize)
+		if end < size {
+			size = end
+		}
+		end -= size
+
+		data := make([]byte, size, size+int64(len(partial)))
+		if _, err := r.ReadAt(data, end); err != nil && err != io.EOF {
+			return err
+		}
+		data = append(data, partial...)
+
+		for {
+			i := bytes.LastIndexByte(data, '\n')
+			if i < 0 {
+				break
+			}
+			line := data[i+1:]
+			data = data[:i]
+			if first && len(line) == 0 {
+				first = false
+				continue
+			}
+			first = false
+			if !f(line) {
+				return nil
+			}
+		}
+		partial = data
+	}
+
+	if len(partial) > 0 || !first {
+		f(partial)
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+type countingReader struct {
+	*strings.Reader
+	read int
+}
+
+func (r *countingReader) ReadAt(p []byte, off int64) (int, error) {
+	n, err := r.Reader.ReadAt(p, off)
+	r.read += n
+	return n, err
+}
+
+func readAllBackward(t *testing.T, text string, blockSize int) []string {
+	var lines []string
+	err := readLinesBackward(strings.NewReader(text), int64(len(text)), blockSize, func(line []byte) bool {
+		lines = append(lines, string(line))
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestReadLinesBackward(t *testing.T) {
+	for _, blockSize := range []int{1, 3, 7, 1024} {
+		lines := readAllBackward(t, "first\nsecond line\n\nlast\n", blockSize)
+		stringEqual(t, strings.Join(lines, "|"), "last||second line|first")
+
+		lines = readAllBackward(t, "no trailing\nnewline", blockSize)
+		stringEqual(t, strings.Join(lines, "|"), "newline|no trailing")
+	}
+	numberEqual(t, len(readAllBackward(t, "", 4)), 0)
+}
+
+func TestReadLinesBackwardReadsOnlyTheEnd(t *testing.T) {
+	text := strings.Repeat("TOGGLE DOOR - 2016-05-24 17:07:43.384659988 -0500 CDT\n", 10000)
+	reader := &countingReader{Reader: strings.NewReader(text)}
+
+	count := 0
+	readLinesBackward(reader, int64(len(text)), 1024, func(line []byte) bool {
+		count++
+		return count < 3
+	})
+	numberEqual(t, count, 3)
+	numberEqual(t, reader.read, 1024)
+}
@@ -0,0 +1,492 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dillonhafer/garage-server/door"
+)
+
+// Span kinds, as OTLP numbers them.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+const (
+	traceBatchSize     = 512
+	traceQueueSize     = 2048
+	traceFlushInterval = 5 * time.Second
+)
+
+// A Span times one step of a request. Spans are only started under a request
+// that is being traced, so every method is safe to call on a nil *Span.
+type Span struct {
+	tracer   *Tracer
+	name     string
+	kind     int
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+
+	mu         sync.Mutex
+	attributes []Field
+	err        error
+}
+
+func (s *Span) SetAttributes(fields ...Field) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.attributes = append(s.attributes, fields...)
+	s.mu.Unlock()
+}
+
+// RecordError marks the span as failed, unless err is nil.
+func (s *Span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	s.err = err
+	s.mu.Unlock()
+}
+
+// End queues the span for export. A span is only exported once.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if !s.end.IsZero() {
+		s.mu.Unlock()
+		return
+	}
+	s.end = time.Now()
+	s.mu.Unlock()
+	s.tracer.enqueue(s)
+}
+
+func (s *Span) TraceID() string { return hex.EncodeToString(s.traceID[:]) }
+func (s *Span) SpanID() string  { return hex.EncodeToString(s.spanID[:]) }
+
+const spanKey contextKey = "span"
+
+// SpanFromContext returns the span ctx is running under, or nil.
+func SpanFromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey).(*Span)
+	return span
+}
+
+// StartSpan starts a child of the span in ctx. Outside a traced request it
+// returns ctx and a nil span, so callers needn't check whether tracing is on.
+func StartSpan(ctx context.Context, name string, fields ...Field) (context.Context, *Span) {
+	parent := SpanFromContext(ctx)
+	if parent == nil {
+		return ctx, nil
+	}
+	span := parent.tracer.newSpan(name, spanKindInternal, parent.traceID, parent.spanID)
+	span.attributes = fields
+	return context.WithValue(ctx, spanKey, span), span
+}
+
+// traced runs f in a span called name and records its error.
+func traced(ctx context.Context, name string, f func() error) error {
+	_, span := StartSpan(ctx, name)
+	err := f()
+	span.RecordError(err)
+	span.End()
+	return err
+}
+
+// Tracer batches finished spans and exports them to an OpenTelemetry
+// collector as OTLP/HTTP JSON.
+type Tracer struct {
+	service  string
+	version  string
+	endpoint string
+	headers  map[string]string
+	logger   *Logger
+	client   *http.Client
+
+	mu      sync.Mutex
+	queue   []*Span
+	dropped int
+	flush   chan struct{}
+	closing chan chan struct{}
+}
+
+// NewTracer exports spans to the collector at endpoint, the base URL that
+// /v1/traces is appended to, sending headers with every export.
+func NewTracer(service string, endpoint string, headers map[string]string, logger *Logger) *Tracer {
+	t := &Tracer{
+		service:  service,
+		version:  Version,
+		endpoint: strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		headers:  headers,
+		logger:   logger,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		flush:    make(chan struct{}, 1),
+		closing:  make(chan chan struct{}),
+	}
+	go t.run(traceFlushInterval)
+	return t
+}
+
+func (t *Tracer) run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			t.export()
+		case <-t.flush:
+			t.export()
+		case done := <-t.closing:
+			t.export()
+			close(done)
+			return
+		}
+	}
+}
+
+// Close exports the spans still queued and stops the exporter.
+func (t *Tracer) Close() {
+	done := make(chan struct{})
+	t.closing <- done
+	<-done
+}
+
+func (t *Tracer) newSpan(name string, kind int, traceID [16]byte, parentID [8]byte) *Span {
+	span := &Span{tracer: t, name: name, kind: kind, traceID: traceID, parentID: parentID, start: time.Now()}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// enqueue drops spans rather than blocking a request when the collector
+// can't keep up.
+func (t *Tracer) enqueue(span *Span) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.queue) >= traceQueueSize {
+		t.dropped++
+		return
+	}
+	t.queue = append(t.queue, span)
+	if len(t.queue) >= traceBatchSize {
+		select {
+		case t.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (t *Tracer) export() {
+	t.mu.Lock()
+	spans, dropped := t.queue, t.dropped
+	t.queue, t.dropped = nil, 0
+	t.mu.Unlock()
+
+	if dropped > 0 {
+		t.logger.Warn("Dropped spans", Field{"count", dropped})
+	}
+	for len(spans) > 0 {
+		batch := spans
+		if len(batch) > traceBatchSize {
+			batch = batch[:traceBatchSize]
+		}
+		spans = spans[len(batch):]
+		if err := t.post(batch); err != nil {
+			t.logger.Warn("Could not export spans", Field{"endpoint", t.endpoint}, Field{"count", len(batch)}, Field{"error", err.Error()})
+		}
+	}
+}
+
+func (t *Tracer) post(spans []*Span) error {
+	body, err := json.Marshal(t.encode(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", t.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	res, err := t.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", res.Status)
+	}
+	return nil
+}
+
+// The OTLP/JSON encoding of a batch of spans.
+type (
+	otlpTraces struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpAttribute `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	otlpSpan struct {
+		TraceID           string          `json:"traceId"`
+		SpanID            string          `json:"spanId"`
+		ParentSpanID      string          `json:"parentSpanId,omitempty"`
+		Name              string          `json:"name"`
+		Kind              int             `json:"kind"`
+		StartTimeUnixNano string          `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+		Attributes        []otlpAttribute `json:"attributes,omitempty"`
+		Status            *otlpStatus     `json:"status,omitempty"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+	otlpAttribute struct {
+		Key   string    `json:"key"`
+		Value otlpValue `json:"value"`
+	}
+	otlpValue struct {
+		StringValue *string  `json:"stringValue,omitempty"`
+		IntValue    *string  `json:"intValue,omitempty"`
+		DoubleValue *float64 `json:"doubleValue,omitempty"`
+		BoolValue   *bool    `json:"boolValue,omitempty"`
+	}
+)
+
+func otlpAttributes(fields []Field) []otlpAttribute {
+	attributes := make([]otlpAttribute, 0, len(fields))
+	for _, field := range fields {
+		var value otlpValue
+		switch v := field.Value.(type) {
+		case string:
+			value.StringValue = &v
+		case int:
+			s := strconv.Itoa(v)
+			value.IntValue = &s
+		case float64:
+			value.DoubleValue = &v
+		case bool:
+			value.BoolValue = &v
+		default:
+			s := fmt.Sprint(v)
+			value.StringValue = &s
+		}
+		attributes = append(attributes, otlpAttribute{Key: field.Key, Value: value})
+	}
+	return attributes
+}
+
+func (t *Tracer) encode(spans []*Span) otlpTraces {
+	var encoded []otlpSpan
+	for _, span := range spans {
+		span.mu.Lock()
+		s := otlpSpan{
+			TraceID:           span.TraceID(),
+			SpanID:            span.SpanID(),
+			Name:              span.name,
+			Kind:              span.kind,
+			StartTimeUnixNano: strconv.FormatInt(span.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.end.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.attributes),
+		}
+		if span.parentID != [8]byte{} {
+			s.ParentSpanID = hex.EncodeToString(span.parentID[:])
+		}
+		if span.err != nil {
+			s.Status = &otlpStatus{Code: 2, Message: span.err.Error()}
+		}
+		span.mu.Unlock()
+		encoded = append(encoded, s)
+	}
+	return otlpTraces{ResourceSpans: []otlpResourceSpans{{
+		Resource: otlpResource{Attributes: otlpAttributes([]Field{
+			{"service.name", t.service},
+			{"service.version", t.version},
+		})},
+		ScopeSpans: []otlpScopeSpans{{
+			Scope: otlpScope{Name: "garage-server", Version: t.version},
+			Spans: encoded,
+		}},
+	}}}
+}
+
+// parseTraceparent reads a W3C traceparent header, so a request traced by
+// the client continues its trace.
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, ok bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || len(parts[0]) != 2 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil || traceID == [16]byte{} {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil || parentID == [8]byte{} {
+		return traceID, parentID, false
+	}
+	return traceID, parentID, true
+}
+
+// TraceHandler starts a server span for every request h serves, named after
+// the route mux matched, and lets door operations under it report their
+// steps. Without a tracer h is returned as is.
+func TraceHandler(tracer *Tracer, mux *http.ServeMux, h http.Handler) http.Handler {
+	if tracer == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		traceID, parentID, ok := parseTraceparent(req.Header.Get("traceparent"))
+		if !ok {
+			rand.Read(traceID[:])
+			parentID = [8]byte{}
+		}
+		route := "other"
+		if _, pattern := mux.Handler(req); pattern != "" && pattern != "/api/v2/" {
+			route = pattern
+		}
+		span := tracer.newSpan(req.Method+" "+route, spanKindServer, traceID, parentID)
+		span.attributes = []Field{
+			{"http.request.method", req.Method},
+			{"http.route", route},
+			{"url.path", req.URL.Path},
+			{"client.address", sourceIP(req)},
+			{"request.id", requestID(req)},
+		}
+		defer span.End()
+
+		recorder := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(recorder, req.WithContext(context.WithValue(req.Context(), spanKey, span)))
+
+		status := recorder.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+		span.SetAttributes(Field{"http.response.status_code", status})
+		if status >= 500 {
+			span.RecordError(fmt.Errorf("%d %s", status, http.StatusText(status)))
+		}
+	})
+}
+
+// traceRoute runs a route's handler in its own span, under the server span.
+func traceRoute(pattern string, f http.HandlerFunc) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ctx, span := StartSpan(req.Context(), "handler "+pattern)
+		defer span.End()
+		f(w, req.WithContext(ctx))
+	})
+}
+
+// doorSteps reports the steps of a door operation as children of the span
+// in ctx.
+func doorSteps(ctx context.Context) door.Tracer {
+	return func(step string) func(error) {
+		_, span := StartSpan(ctx, step)
+		return func(err error) {
+			span.RecordError(err)
+			span.End()
+		}
+	}
+}
+
+// TraceDoorStatus runs every read of doorStatus in a span.
+func TraceDoorStatus(doorStatus func(context.Context, int) (string, error)) func(context.Context, int) (string, error) {
+	return func(ctx context.Context, pin int) (string, error) {
+		ctx, span := StartSpan(ctx, "door.CheckDoorStatus", Field{"door.pin", pin})
+		if span == nil {
+			return doorStatus(ctx, pin)
+		}
+		defer span.End()
+		status, err := doorStatus(door.WithTracer(ctx, doorSteps(ctx)), pin)
+		span.RecordError(err)
+		span.SetAttributes(Field{"door.state", status})
+		return status, err
+	}
+}
+
+// TraceToggleSwitch runs every toggle of toggleSwitch in a span.
+func TraceToggleSwitch(toggleSwitch func(context.Context, int, int) error) func(context.Context, int, int) error {
+	return func(ctx context.Context, pin int, sleepTimeout int) error {
+		ctx, span := StartSpan(ctx, "door.ToggleSwitch", Field{"door.pin", pin}, Field{"relay.sleep_ms", sleepTimeout})
+		if span == nil {
+			return toggleSwitch(ctx, pin, sleepTimeout)
+		}
+		defer span.End()
+		err := toggleSwitch(door.WithTracer(ctx, doorSteps(ctx)), pin, sleepTimeout)
+		span.RecordError(err)
+		return err
+	}
+}
+
+// ParseOTLPHeaders reads OTEL_EXPORTER_OTLP_HEADERS: comma-separated
+// key=value pairs with URL-encoded values.
+func ParseOTLPHeaders(list string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(list, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		i := strings.Index(pair, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("'%s' is not key=value", pair)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(pair[i+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("'%s': %s", pair, err)
+		}
+		headers[strings.TrimSpace(pair[:i])] = value
+	}
+	return headers, nil
+}
+
+// tracerFromOptions exports traces to -otlp-endpoint, configured further by
+// the standard OTEL_EXPORTER_OTLP_HEADERS and OTEL_SERVICE_NAME. Tracing is
+// off without an endpoint.
+func tracerFromOptions(logger *Logger) (*Tracer, error) {
+	if options.otlpEndpoint == "" {
+		return nil, nil
+	}
+	headers, err := ParseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	if err != nil {
+		return nil, err
+	}
+	service := os.Getenv("OTEL_SERVICE_NAME")
+	if service == "" {
+		service = "garage-server"
+	}
+	return NewTracer(service, options.otlpEndpoint, headers, logger), nil
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testCollector is an in-process OTLP/HTTP collector.
+type testCollector struct {
+	*httptest.Server
+	mu      sync.Mutex
+	spans   []otlpSpan
+	service string
+	headers http.Header
+	status  int
+}
+
+func newTestCollector(t *testing.T, status int) *testCollector {
+	c := &testCollector{status: status}
+	c.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/v1/traces" || req.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected export %s %s", req.URL.Path, req.Header.Get("Content-Type"))
+		}
+		var traces otlpTraces
+		if err := json.NewDecoder(req.Body).Decode(&traces); err != nil {
+			t.Error(err)
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.headers = req.Header
+		for _, resource := range traces.ResourceSpans {
+			for _, attribute := range resource.Resource.Attributes {
+				if attribute.Key == "service.name" {
+					c.service = *attribute.Value.StringValue
+				}
+			}
+			for _, scope := range resource.ScopeSpans {
+				c.spans = append(c.spans, scope.Spans...)
+			}
+		}
+		w.WriteHeader(c.status)
+	}))
+	t.Cleanup(c.Close)
+	return c
+}
+
+func (c *testCollector) span(t *testing.T, name string) otlpSpan {
+	t.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, span := range c.spans {
+		if span.Name == name {
+			return span
+		}
+	}
+	t.Fatalf("no span '%s' in %d exported", name, len(c.spans))
+	return otlpSpan{}
+}
+
+func spanAttribute(span otlpSpan, key string) string {
+	for _, attribute := range span.Attributes {
+		if attribute.Key != key {
+			continue
+		}
+		if attribute.Value.StringValue != nil {
+			return *attribute.Value.StringValue
+		}
+		if attribute.Value.IntValue != nil {
+			return *attribute.Value.IntValue
+		}
+	}
+	return ""
+}
+
+func TestTraceRequest(t *testing.T) {
+	collector := newTestCollector(t, 200)
+	var logs bytes.Buffer
+	config := CreateTestRouteConfig(t, true, "open", false)
+	config.Logger = NewJSONLogger(&logs, LevelInfo)
+	config.Tracer = NewTracer("garage-test", collector.URL+"/", map[string]string{"Authorization": "Bearer collector"}, DummyLogger)
+	router := NewRouter(config)
+
+	req := signedRequest(t, "POST", "/api/v2/toggle", SharedSecret)
+	req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	req.Header.Set("X-Request-ID", "trace-me")
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, req)
+	responseEqual(t, writer.Code, 200)
+	config.Tracer.Close()
+
+	stringEqual(t, collector.headers.Get("Authorization"), "Bearer collector")
+	stringEqual(t, collector.service, "garage-test")
+
+	server := collector.span(t, "POST /api/v2/toggle")
+	numberEqual(t, server.Kind, spanKindServer)
+	stringEqual(t, server.TraceID, "4bf92f3577b34da6a3ce929d0e0e4736")
+	stringEqual(t, server.ParentSpanID, "00f067aa0ba902b7")
+	stringEqual(t, spanAttribute(server, "http.route"), "/api/v2/toggle")
+	stringEqual(t, spanAttribute(server, "http.response.status_code"), "200")
+	stringEqual(t, spanAttribute(server, "request.id"), "trace-me")
+
+	handler := collector.span(t, "handler /api/v2/toggle")
+	stringEqual(t, handler.ParentSpanID, server.SpanID)
+	authenticate := collector.span(t, "authenticate")
+	stringEqual(t, authenticate.ParentSpanID, handler.SpanID)
+	toggle := collector.span(t, "door.ToggleSwitch")
+	stringEqual(t, toggle.ParentSpanID, handler.SpanID)
+	stringEqual(t, toggle.TraceID, server.TraceID)
+	if toggle.Status != nil {
+		t.Errorf("expected the toggle to succeed, got %+v", toggle.Status)
+	}
+
+	// The request log carries the trace, so logs and spans can be matched.
+	if !strings.Contains(logs.String(), `"request_id":"trace-me","trace_id":"4bf92f3577b34da6a3ce929d0e0e4736"`) {
+		t.Errorf("expected the trace in the logs:\n%s", logs.String())
+	}
+}
+
+func TestTraceFailures(t *testing.T) {
+	collector := newTestCollector(t, 200)
+	config := CreateTestRouteConfig(t, false, "open", true)
+	config.Tracer = NewTracer("garage-server", collector.URL, nil, DummyLogger)
+	router := NewRouter(config)
+
+	writer := httptest.NewRecorder()
+	router.ServeHTTP(writer, signedRequest(t, "GET", "/api/v2/status", "Unverified Signature"))
+	responseEqual(t, writer.Code, 403)
+	writer = httptest.NewRecorder()
+	router.ServeHTTP(writer, signedRequest(t, "POST", "/api/v2/toggle", SharedSecret))
+	responseEqual(t, writer.Code, 500)
+	config.Tracer.Close()
+
+	authenticate := collector.span(t, "authenticate")
+	if authenticate.Status == nil || authenticate.Status.Code != 2 {
+		t.Errorf("expected the rejected signature to fail its span, got %+v", authenticate.Status)
+	}
+	server := collector.span(t, "POST /api/v2/toggle")
+	if server.Status == nil || server.Status.Code != 2 {
+		t.Errorf("expected the 500 to fail its span, got %+v", server.Status)
+	}
+	if collector.span(t, "door.ToggleSwitch").Status == nil {
+		t.Error("expected the relay error on the door span")
+	}
+	// A fresh trace is started without a traceparent.
+	if server.ParentSpanID != "" || len(server.TraceID) != 32 {
+		t.Errorf("expected a root span, got trace %s parent %s", server.TraceID, server.ParentSpanID)
+	}
+}
+
+func TestTraceDoorSteps(t *testing.T) {
+	collector := newTestCollector(t, 200)
+	tracer := NewTracer("garage-server", collector.URL, nil, DummyLogger)
+	ctx, parent := StartSpan(context.Background(), "untraced")
+	if parent != nil {
+		t.Fatal("expected no span outside a traced request")
+	}
+	parent = tracer.newSpan("door.ToggleSwitch", spanKindInternal, [16]byte{1}, [8]byte{})
+	ctx = context.WithValue(ctx, spanKey, parent)
+
+	steps := doorSteps(ctx)
+	steps("gpio.lock")(nil)
+	steps("gpio.write")(errors.New("gpio busy"))
+	parent.End()
+	tracer.Close()
+
+	lock := collector.span(t, "gpio.lock")
+	stringEqual(t, lock.ParentSpanID, parent.SpanID())
+	write := collector.span(t, "gpio.write")
+	if write.Status == nil || write.Status.Message != "gpio busy" {
+		t.Errorf("expected the write error, got %+v", write.Status)
+	}
+}
+
+func TestTraceExportFailure(t *testing.T) {
+	collector := newTestCollector(t, 503)
+	var logs bytes.Buffer
+	tracer := NewTracer("garage-server", collector.URL, nil, NewTextLogger(&logs, LevelWarn))
+	_, span := StartSpan(context.WithValue(context.Background(), spanKey, tracer.newSpan("request", spanKindServer, [16]byte{1}, [8]byte{})), "step")
+	span.End()
+	tracer.Close()
+
+	if !strings.Contains(logs.String(), `WARN Could not export spans`) || !strings.Contains(logs.String(), "503 Service Unavailable") {
+		t.Errorf("expected the failed export to be logged:\n%s", logs.String())
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	traceID, parentID, ok := parseTraceparent("00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	if !ok || traceID[0] != 0x4b || parentID[7] != 0xb7 {
+		t.Errorf("expected the traceparent to parse, got %x %x", traceID, parentID)
+	}
+	for _, header := range []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e47zz-00f067aa0ba902b7-01",
+	} {
+		if _, _, ok := parseTraceparent(header); ok {
+			t.Errorf("expected '%s' to be rejected", header)
+		}
+	}
+}
+
+func TestParseOTLPHeaders(t *testing.T) {
+	headers, err := ParseOTLPHeaders("api-key=secret, Authorization=Basic%20dXNlcg%3D%3D,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	numberEqual(t, len(headers), 2)
+	stringEqual(t, headers["api-key"], "secret")
+	stringEqual(t, headers["Authorization"], "Basic dXNlcg==")
+
+	if _, err := ParseOTLPHeaders("api-key"); err == nil {
+		t.Error("expected a header without a value to be rejected")
+	}
+}
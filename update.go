@@ -2,6 +2,7 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/kardianos/osext"
 	"github.com/mcuadros/go-version"
@@ -22,20 +23,23 @@ type Release struct {
 	Assets  []Assets `json:"assets"`
 }
 
-func latestRelease() Release {
+func latestRelease() (Release, error) {
 	url := "https://api.github.com/repos/dillonhafer/garage-server/releases/latest"
 
-	res, _ := http.Get(url)
+	var release Release
+	res, err := http.Get(url)
+	if err != nil {
+		return release, err
+	}
 	defer res.Body.Close()
 
 	decoder := json.NewDecoder(res.Body)
-	var release Release
-	var _ = decoder.Decode(&release)
+	err = decoder.Decode(&release)
 
-	return release
+	return release, err
 }
 
-func downloadNewRelease(url string) {
+func downloadNewRelease(url string) error {
 	tokens := strings.Split(url, "/")
 	fileName := tokens[len(tokens)-1]
 
@@ -50,29 +54,29 @@ func downloadNewRelease(url string) {
 	output, err := os.Create(fileName)
 	if err != nil {
 		fmt.Println("Error while creating", fileName, "-", err)
-		return
+		return err
 	}
 	defer output.Close()
 
 	response, err := http.Get(url)
 	if err != nil {
 		fmt.Println("Error while downloading", url, "-", err)
-		return
+		return err
 	}
 	defer response.Body.Close()
 
 	_, err = io.Copy(output, response.Body)
 	if err != nil {
 		fmt.Println("Error while downloading", url, "-", err)
-		return
+		return err
 	}
 
 	fmt.Println("Download finished.")
 
-	replaceBinary(fileName)
+	return replaceBinary(fileName)
 }
 
-func replaceBinary(path string) {
+func replaceBinary(path string) error {
 	fmt.Println("Updating server...")
 	filename, _ := osext.Executable()
 	fmt.Println("Copying", path, "to", filename)
@@ -80,17 +84,36 @@ func replaceBinary(path string) {
 
 	if err != nil {
 		fmt.Println("Could not copy file:", err)
-		return
+		return err
 	}
+	return nil
 }
 
-func CheckForUpdates() {
+// CheckForUpdates installs the latest release if it is newer than this one
+// and passes the attempt to record.
+func CheckForUpdates(record func(HistoryEvent)) {
 	println("Checking for updates...")
-	release := latestRelease()
+	release, err := latestRelease()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Could not check for updates:", err)
+		return
+	}
 	fmt.Fprintf(os.Stderr, "Current version is: %s - latest version is: %s\n", Version, release.Version)
 
 	if version.Compare(release.Version, Version, ">") {
-		downloadNewRelease(release.Assets[0].DownloadUrl)
+		if len(release.Assets) == 0 {
+			err = errors.New("release has no assets")
+		} else {
+			err = downloadNewRelease(release.Assets[0].DownloadUrl)
+		}
+
+		outcome := OutcomeSuccess
+		detail := release.Version
+		if err != nil {
+			outcome = OutcomeFailure
+			detail = fmt.Sprintf("%s: %s", release.Version, err)
+		}
+		record(HistoryEvent{Type: EventUpdateApplied, Outcome: outcome, Detail: detail})
 	} else {
 		println("You're up to date!")
 	}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// Build metadata, set by build.sh with -ldflags "-X main.Version=...". A
+// plain `go build` reports the last release and no commit.
+var (
+	Version   = "6.0.0"
+	Commit    = ""
+	BuildDate = ""
+)
+
+// startTime is when the server started, for uptime.
+var startTime = time.Now()
+
+// doorBackend is how the server drives its door.
+const doorBackend = "gpio"
+
+// The API and signature schemes this server speaks. The unversioned routes
+// are "legacy".
+var (
+	apiVersions  = []string{"v2"}
+	authVersions = []string{"hmac-sha512"}
+)
+
+// versionString is the one-line version printed by -version.
+func versionString() string {
+	s := "garage-server v" + Version
+	if Commit != "" {
+		s += " (" + Commit
+		if BuildDate != "" {
+			s += ", built " + BuildDate
+		}
+		s += ")"
+	}
+	return fmt.Sprintf("%s %s %s/%s", s, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
+
+// DoorInfo describes one door the server drives.
+type DoorInfo struct {
+	Name    string `json:"name"`
+	Backend string `json:"backend"`
+}
+
+// ServerInfo is what /version reports: the build, the runtime, and what
+// this server is configured to do, so clients can tell which features they
+// can use.
+type ServerInfo struct {
+	Version      string     `json:"version"`
+	Commit       string     `json:"commit,omitempty"`
+	BuildDate    string     `json:"build_date,omitempty"`
+	GoVersion    string     `json:"go_version"`
+	OS           string     `json:"os"`
+	Arch         string     `json:"arch"`
+	StartedAt    time.Time  `json:"started_at"`
+	Uptime       int64      `json:"uptime_seconds"`
+	Doors        []DoorInfo `json:"doors"`
+	Features     []string   `json:"features"`
+	APIVersions  []string   `json:"api_versions"`
+	AuthVersions []string   `json:"auth_versions"`
+}
+
+// serverInfo describes a server built from c. Uptime is filled in per
+// request.
+func serverInfo(c RouteConfig) ServerInfo {
+	features := []string{"control", "events", "exports", "history", "long_polling", "open_close", "readiness", "stats"}
+	if c.Legacy {
+		features = append(features, "legacy_api")
+	}
+	if c.Store != nil && c.Store.key != nil {
+		features = append(features, "audit")
+	}
+	if c.MetricsAccess.Token != "" || len(c.MetricsAccess.Allow) > 0 {
+		features = append(features, "metrics")
+	}
+	if c.Tracer != nil {
+		features = append(features, "tracing")
+	}
+	if c.Cert != "" {
+		features = append(features, "tls")
+	}
+	if c.Webhooks != nil {
+		features = append(features, "webhooks")
+	}
+	if c.Notifier != nil {
+		features = append(features, "email")
+	}
+	if c.MQTT != nil {
+		features = append(features, "mqtt")
+	}
+	if c.HomeKit != nil {
+		features = append(features, "homekit")
+	}
+	sort.Strings(features)
+
+	api := apiVersions
+	if c.Legacy {
+		api = append([]string{"legacy"}, api...)
+	}
+
+	return ServerInfo{
+		Version:      Version,
+		Commit:       Commit,
+		BuildDate:    BuildDate,
+		GoVersion:    runtime.Version(),
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		StartedAt:    startTime.UTC().Truncate(time.Second),
+		Doors:        []DoorInfo{{Name: c.Door, Backend: doorBackend}},
+		Features:     features,
+		APIVersions:  api,
+		AuthVersions: authVersions,
+	}
+}
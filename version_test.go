@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestAPIVersion(t *testing.T) {
+	commit, buildDate := Commit, BuildDate
+	Commit, BuildDate = "abc1234", "2026-10-19T12:00:00Z"
+	defer func() { Commit, BuildDate = commit, buildDate }()
+
+	config := CreateTestRouteConfig(t, false, "closed", false)
+	config.MetricsAccess = MetricsAccess{}
+	writer := httptest.NewRecorder()
+	NewRouter(config).ServeHTTP(writer, signedRequest(t, "GET", "/api/v2/version", SharedSecret))
+	responseEqual(t, writer.Code, 200)
+	stringEqual(t, writer.Header().Get("Content-Type"), "application/json")
+
+	var info ServerInfo
+	if err := json.Unmarshal(writer.Body.Bytes(), &info); err != nil {
+		t.Fatal(err)
+	}
+	stringEqual(t, info.Version, Version)
+	stringEqual(t, info.Commit, "abc1234")
+	stringEqual(t, info.BuildDate, "2026-10-19T12:00:00Z")
+	stringEqual(t, info.GoVersion, runtime.Version())
+	stringEqual(t, info.OS+"/"+info.Arch, runtime.GOOS+"/"+runtime.GOARCH)
+	if info.Uptime < 0 || info.StartedAt.IsZero() {
+		t.Errorf("expected an uptime, got %d since %s", info.Uptime, info.StartedAt)
+	}
+	numberEqual(t, len(info.Doors), 1)
+	stringEqual(t, info.Doors[0].Name+" "+info.Doors[0].Backend, "garage gpio")
+	stringEqual(t, strings.Join(info.Features, ","), "audit,control,events,exports,history,long_polling,open_close,readiness,stats")
+	stringEqual(t, strings.Join(info.APIVersions, ","), "v2")
+	stringEqual(t, strings.Join(info.AuthVersions, ","), "hmac-sha512")
+}
+
+func TestServerInfoFeatures(t *testing.T) {
+	config := CreateTestRouteConfig(t, true, "closed", false)
+	config.Cert = "/ssl/garage.cert"
+	config.Tracer = &Tracer{}
+	config.Webhooks = &WebhookDispatcher{}
+	config.Notifier = &Notifier{}
+	config.MQTT = &MQTTBridge{}
+	config.HomeKit = &HomeKitBridge{}
+
+	info := serverInfo(config)
+	stringEqual(t, strings.Join(info.Features, ","), "audit,control,email,events,exports,history,homekit,legacy_api,long_polling,metrics,mqtt,open_close,readiness,stats,tls,tracing,webhooks")
+	stringEqual(t, strings.Join(info.APIVersions, ","), "legacy,v2")
+}
+
+func TestVersionString(t *testing.T) {
+	commit, buildDate := Commit, BuildDate
+	defer func() { Commit, BuildDate = commit, buildDate }()
+
+	Commit, BuildDate = "", ""
+	stringEqual(t, versionString(), "garage-server v"+Version+" "+runtime.Version()+" "+runtime.GOOS+"/"+runtime.GOARCH)
+
+	Commit, BuildDate = "abc1234", "2026-10-19T12:00:00Z"
+	if !strings.HasPrefix(versionString(), "garage-server v"+Version+" (abc1234, built 2026-10-19T12:00:00Z) go") {
+		t.Errorf("unexpected version %q", versionString())
+	}
+}
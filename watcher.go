@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// DoorState is the data of every "state" event.
+type DoorState struct {
+	Status  string `json:"doorStatus"`
+	Version uint64 `json:"version"`
+}
+
+// DoorWatcher polls the reed switch and publishes a state event whenever the
+// door changes, so clients don't have to poll GPIO themselves. Every change
+// bumps a version number that long-polling clients wait on.
+type DoorWatcher struct {
+	doorStatus func(context.Context, int) (string, error)
+	logger     *Logger
+	statusPin  int
+	hub        *EventHub
+
+	mu      sync.Mutex
+	state   string
+	version uint64
+	changed chan struct{}
+	failed  bool
+	hooks   []func(DoorState)
+}
+
+func NewDoorWatcher(doorStatus func(context.Context, int) (string, error), logger *Logger, statusPin int, hub *EventHub) *DoorWatcher {
+	return &DoorWatcher{
+		doorStatus: doorStatus,
+		logger:     logger,
+		statusPin:  statusPin,
+		hub:        hub,
+		changed:    make(chan struct{}),
+	}
+}
+
+// OnChange calls hook with every change, in order, from the goroutine
+// polling the door. Unlike a hub subscriber, a hook is never dropped for
+// falling behind.
+func (d *DoorWatcher) OnChange(hook func(DoorState)) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.hooks = append(d.hooks, hook)
+}
+
+func (d *DoorWatcher) Poll() {
+	status, err := d.doorStatus(context.Background(), d.statusPin)
+
+	d.mu.Lock()
+	if err != nil {
+		// Only report the first failure so a missing sensor doesn't flood
+		// the log every poll.
+		if !d.failed {
+			d.logger.Error(fmt.Sprintf("Could not read pin '%d' on Raspberry Pi", d.statusPin), Field{"error", err})
+		}
+		d.failed = true
+		d.mu.Unlock()
+		return
+	}
+	d.failed = false
+
+	if status == d.state {
+		d.mu.Unlock()
+		return
+	}
+	d.state = status
+	d.version++
+	close(d.changed)
+	d.changed = make(chan struct{})
+
+	state := DoorState{Status: status, Version: d.version}
+	d.hub.Publish("state", state)
+	hooks := d.hooks
+	d.mu.Unlock()
+
+	for _, hook := range hooks {
+		hook(state)
+	}
+}
+
+func (d *DoorWatcher) State() (string, uint64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.state, d.version
+}
+
+// Wait blocks until the state version differs from since, the timeout
+// expires or done is closed, and returns the state at that point.
+func (d *DoorWatcher) Wait(since uint64, timeout time.Duration, done <-chan struct{}) (string, uint64) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		d.mu.Lock()
+		state, version, changed := d.state, d.version, d.changed
+		d.mu.Unlock()
+
+		if version != since {
+			return state, version
+		}
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return state, version
+		case <-done:
+			return state, version
+		}
+	}
+}
+
+func (d *DoorWatcher) Run(interval time.Duration) {
+	for {
+		d.Poll()
+		time.Sleep(interval)
+	}
+}
@@ -0,0 +1,518 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Failed deliveries are retried after webhookBackoffMin, doubling up to
+// webhookBackoffMax, and dropped after webhookMaxAttempts.
+var (
+	webhookBackoffMin  = 10 * time.Second
+	webhookBackoffMax  = time.Hour
+	webhookMaxAttempts = 12
+	webhookTimeout     = 10 * time.Second
+)
+
+// webhookLogSize is how many attempts the delivery log keeps.
+const webhookLogSize = 100
+
+// OutcomeAbandoned marks the last attempt of a delivery that is dropped.
+const OutcomeAbandoned = "abandoned"
+
+// webhookEventTypes are the events a subscription can ask for.
+var webhookEventTypes = map[string]bool{
+	EventCommandIssued: true,
+	EventStateChanged:  true,
+	EventAuthFailure:   true,
+	EventUpdateApplied: true,
+}
+
+// WebhookSubscription posts the events it lists, or every event if it lists
+// none, to URL, signed with Secret.
+type WebhookSubscription struct {
+	ID     string   `json:"id"`
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Secret string   `json:"secret"`
+}
+
+func (s WebhookSubscription) wants(event HistoryEvent) bool {
+	if len(s.Events) == 0 {
+		return true
+	}
+	for _, eventType := range s.Events {
+		if event.Type == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// LoadWebhookSubscriptions reads a JSON array of subscriptions from path.
+func LoadWebhookSubscriptions(path string) ([]WebhookSubscription, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var subscriptions []WebhookSubscription
+	if err := json.Unmarshal(data, &subscriptions); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for _, s := range subscriptions {
+		if !validRequestID.MatchString(s.ID) {
+			return nil, fmt.Errorf("invalid subscription id '%s'", s.ID)
+		}
+		if seen[s.ID] {
+			return nil, fmt.Errorf("duplicate subscription '%s'", s.ID)
+		}
+		seen[s.ID] = true
+		if u, err := url.Parse(s.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("subscription '%s': invalid url '%s'", s.ID, s.URL)
+		}
+		if s.Secret == "" {
+			return nil, fmt.Errorf("subscription '%s': no secret", s.ID)
+		}
+		for _, eventType := range s.Events {
+			if !webhookEventTypes[eventType] {
+				return nil, fmt.Errorf("subscription '%s': unknown event '%s'", s.ID, eventType)
+			}
+		}
+	}
+	return subscriptions, nil
+}
+
+// webhookQueuePath is where deliveries are queued for the event store at
+// path.
+func webhookQueuePath(path string) string {
+	return filepath.Join(filepath.Dir(path), "webhooks.queue.json")
+}
+
+// WebhookPayload is the body of every delivery.
+type WebhookPayload struct {
+	Delivery     string       `json:"delivery"`
+	Subscription string       `json:"subscription"`
+	Event        HistoryEvent `json:"event"`
+}
+
+// webhookDelivery is an event waiting to be posted to a subscription.
+type webhookDelivery struct {
+	ID           string       `json:"id"`
+	Subscription string       `json:"subscription"`
+	Event        HistoryEvent `json:"event"`
+	Attempts     int          `json:"attempts"`
+	NextAttempt  time.Time    `json:"next_attempt"`
+}
+
+// WebhookAttempt is one entry in the delivery log.
+type WebhookAttempt struct {
+	Delivery     string     `json:"delivery"`
+	Subscription string     `json:"subscription"`
+	EventID      uint64     `json:"event_id"`
+	EventType    string     `json:"event_type"`
+	Attempt      int        `json:"attempt"`
+	Time         time.Time  `json:"time"`
+	Outcome      string     `json:"outcome"`
+	StatusCode   int        `json:"status_code,omitempty"`
+	Error        string     `json:"error,omitempty"`
+	Duration     float64    `json:"duration_ms"`
+	NextAttempt  *time.Time `json:"next_attempt,omitempty"`
+}
+
+// WebhookSignature signs a delivery: the hex HMAC-SHA512 of the timestamp,
+// a dot and the body, keyed with the subscription's secret.
+func WebhookSignature(secret string, timestamp string, body []byte) string {
+	mac := hmac.New(sha512.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is how long to wait after a delivery's attempts-th
+// failure.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBackoffMin
+	for i := 1; i < attempts && backoff < webhookBackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > webhookBackoffMax {
+		backoff = webhookBackoffMax
+	}
+	return backoff
+}
+
+// WebhookDispatcher posts events to the subscriptions that want them.
+// Deliveries are queued in a file until they succeed or are dropped, so a
+// restart doesn't lose them.
+type WebhookDispatcher struct {
+	subscriptions map[string]WebhookSubscription
+	order         []WebhookSubscription
+	path          string
+	client        *http.Client
+	logger        *Logger
+
+	mu       sync.Mutex
+	queue    []webhookDelivery
+	attempts []WebhookAttempt
+	events   chan HistoryEvent
+	wake     chan struct{}
+	stop     chan struct{}
+	done     chan struct{}
+}
+
+// NewWebhookDispatcher delivers to subscriptions, queueing deliveries in
+// the file at path. Deliveries left there for subscriptions that no longer
+// exist are dropped.
+func NewWebhookDispatcher(subscriptions []WebhookSubscription, path string, logger *Logger) (*WebhookDispatcher, error) {
+	d := &WebhookDispatcher{
+		subscriptions: make(map[string]WebhookSubscription),
+		order:         subscriptions,
+		path:          path,
+		client:        &http.Client{Timeout: webhookTimeout},
+		logger:        logger,
+		events:        make(chan HistoryEvent, 64),
+		wake:          make(chan struct{}, 1),
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	for _, s := range subscriptions {
+		d.subscriptions[s.ID] = s
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	var queue []webhookDelivery
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &queue); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+	}
+	for _, delivery := range queue {
+		if _, ok := d.subscriptions[delivery.Subscription]; !ok {
+			logger.Warn("Dropped webhook delivery for removed subscription", Field{"subscription", delivery.Subscription}, Field{"delivery", delivery.ID})
+			continue
+		}
+		d.queue = append(d.queue, delivery)
+	}
+	if len(d.queue) > 0 {
+		logger.Info("Resuming webhook deliveries", Field{"queued", len(d.queue)})
+	}
+	return d, nil
+}
+
+// Enqueue passes event to Run to queue for every subscription that wants
+// it. It is meant to be passed to EventStore.OnAppend, which holds the
+// store's lock, so the queue file is written elsewhere and the event is
+// dropped rather than block.
+func (d *WebhookDispatcher) Enqueue(event HistoryEvent) {
+	select {
+	case d.events <- event:
+	default:
+		d.logger.Error("Dropped webhook event; too many are waiting to be queued", Field{"event", event.ID})
+	}
+}
+
+// receive queues the events Enqueue passes on until Close, and then those
+// still waiting, so they are saved for the next start.
+func (d *WebhookDispatcher) receive(done chan struct{}) {
+	defer close(done)
+	for {
+		select {
+		case event := <-d.events:
+			d.queueEvent(event)
+		case <-d.stop:
+			for {
+				select {
+				case event := <-d.events:
+					d.queueEvent(event)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// queueEvent queues event for every subscription that wants it and saves
+// the queue.
+func (d *WebhookDispatcher) queueEvent(event HistoryEvent) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	queued := false
+	for _, s := range d.order {
+		if s.wants(event) {
+			d.queue = append(d.queue, webhookDelivery{ID: newRequestID(), Subscription: s.ID, Event: event, NextAttempt: time.Now()})
+			queued = true
+		}
+	}
+	if !queued {
+		return
+	}
+	if err := d.save(); err != nil {
+		d.logger.Error("Could not save webhook queue", Field{"error", err})
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+// save replaces the queue file in one rename, so it is never seen half
+// written. d.mu must be held.
+func (d *WebhookDispatcher) save() error {
+	queue := d.queue
+	if queue == nil {
+		queue = []webhookDelivery{}
+	}
+	encoded, err := json.Marshal(queue)
+	if err != nil {
+		return err
+	}
+	tmp := d.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(encoded)
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, d.path)
+}
+
+// due takes the deliveries whose next attempt has come, and says how long
+// until the next one after them.
+func (d *WebhookDispatcher) due(now time.Time) ([]webhookDelivery, time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var due []webhookDelivery
+	wait := time.Duration(-1)
+	for _, delivery := range d.queue {
+		if !delivery.NextAttempt.After(now) {
+			due = append(due, delivery)
+		} else if next := delivery.NextAttempt.Sub(now); wait < 0 || next < wait {
+			wait = next
+		}
+	}
+	return due, wait
+}
+
+// Run queues and delivers events until Close.
+func (d *WebhookDispatcher) Run() {
+	defer close(d.done)
+	received := make(chan struct{})
+	go d.receive(received)
+	defer func() { <-received }()
+	for {
+		due, wait := d.due(time.Now())
+		for _, delivery := range due {
+			select {
+			case <-d.stop:
+				return
+			default:
+			}
+			d.finish(delivery, d.deliver(delivery))
+		}
+		if len(due) > 0 {
+			continue
+		}
+
+		var timer *time.Timer
+		var fired <-chan time.Time
+		if wait >= 0 {
+			timer = time.NewTimer(wait)
+			fired = timer.C
+		}
+		select {
+		case <-d.stop:
+			return
+		case <-d.wake:
+		case <-fired:
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// Close stops delivering, leaving what is queued for the next start.
+func (d *WebhookDispatcher) Close() {
+	close(d.stop)
+	<-d.done
+}
+
+// deliver posts delivery once and reports how it went.
+func (d *WebhookDispatcher) deliver(delivery webhookDelivery) WebhookAttempt {
+	s := d.subscriptions[delivery.Subscription]
+	attempt := WebhookAttempt{
+		Delivery:     delivery.ID,
+		Subscription: delivery.Subscription,
+		EventID:      delivery.Event.ID,
+		EventType:    delivery.Event.Type,
+		Attempt:      delivery.Attempts + 1,
+		Time:         time.Now(),
+		Outcome:      OutcomeFailure,
+	}
+	defer func() {
+		attempt.Duration = float64(time.Since(attempt.Time)) / float64(time.Millisecond)
+	}()
+
+	body, err := json.Marshal(WebhookPayload{Delivery: delivery.ID, Subscription: s.ID, Event: delivery.Event})
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	req, err := http.NewRequest("POST", s.URL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	timestamp := strconv.FormatInt(attempt.Time.Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "garage-server/"+Version)
+	req.Header.Set("X-Garage-Event", delivery.Event.Type)
+	req.Header.Set("X-Garage-Delivery", delivery.ID)
+	req.Header.Set("X-Garage-Timestamp", timestamp)
+	req.Header.Set("X-Garage-Signature", WebhookSignature(s.Secret, timestamp, body))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt
+	}
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	resp.Body.Close()
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		attempt.Error = resp.Status
+		return attempt
+	}
+	attempt.Outcome = OutcomeSuccess
+	return attempt
+}
+
+// finish records attempt, and takes the delivery off the queue or puts it
+// back for a later attempt.
+func (d *WebhookDispatcher) finish(delivery webhookDelivery, attempt WebhookAttempt) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	log := d.logger.With(Field{"subscription", delivery.Subscription}, Field{"delivery", delivery.ID}, Field{"attempt", attempt.Attempt})
+	keep := false
+	switch {
+	case attempt.Outcome == OutcomeSuccess:
+		log.Debug("Webhook delivered", Field{"status", attempt.StatusCode})
+	case attempt.Attempt >= webhookMaxAttempts:
+		attempt.Outcome = OutcomeAbandoned
+		log.Error("Gave up on webhook delivery", Field{"error", attempt.Error})
+	default:
+		next := time.Now().Add(webhookBackoff(attempt.Attempt))
+		attempt.NextAttempt = &next
+		delivery.Attempts = attempt.Attempt
+		delivery.NextAttempt = next
+		keep = true
+		log.Warn("Webhook delivery failed", Field{"error", attempt.Error}, Field{"retry_at", next.Format(time.RFC3339)})
+	}
+
+	for i := range d.queue {
+		if d.queue[i].ID != delivery.ID {
+			continue
+		}
+		if keep {
+			d.queue[i] = delivery
+		} else {
+			d.queue = append(d.queue[:i], d.queue[i+1:]...)
+		}
+		break
+	}
+	if err := d.save(); err != nil {
+		log.Error("Could not save webhook queue", Field{"error", err})
+	}
+
+	d.attempts = append(d.attempts, attempt)
+	if len(d.attempts) > webhookLogSize {
+		d.attempts = d.attempts[len(d.attempts)-webhookLogSize:]
+	}
+}
+
+// Deliveries lists up to limit recent attempts, newest first, optionally
+// only those to one subscription, and how many deliveries are queued.
+func (d *WebhookDispatcher) Deliveries(subscription string, limit int) ([]WebhookAttempt, int) {
+	attempts := []WebhookAttempt{}
+	if d == nil {
+		return attempts, 0
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for i := len(d.attempts) - 1; i >= 0 && len(attempts) < limit; i-- {
+		if subscription == "" || d.attempts[i].Subscription == subscription {
+			attempts = append(attempts, d.attempts[i])
+		}
+	}
+	queued := 0
+	for _, delivery := range d.queue {
+		if subscription == "" || delivery.Subscription == subscription {
+			queued++
+		}
+	}
+	return attempts, queued
+}
+
+// WebhookDeliveriesHandler serves the delivery log. subscription and limit
+// narrow it down.
+func WebhookDeliveriesHandler(webhooks *WebhookDispatcher, logger *Logger) http.HandlerFunc {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		log := requestLogger(logger, req)
+		log.Info("Webhook deliveries")
+
+		query := req.URL.Query()
+		limit := webhookLogSize
+		if value := query.Get("limit"); value != "" {
+			var err error
+			if limit, err = strconv.Atoi(value); err != nil || limit < 1 {
+				apiErr := invalidLogParameter("limit", value)
+				logAPIError(log, apiErr)
+				writeAPIError(w, req, apiErr)
+				return
+			}
+		}
+
+		var jsonResp struct {
+			Deliveries []WebhookAttempt `json:"deliveries"`
+			Queued     int              `json:"queued"`
+		}
+		jsonResp.Deliveries, jsonResp.Queued = webhooks.Deliveries(query.Get("subscription"), limit)
+		message, err := json.Marshal(jsonResp)
+		if err != nil {
+			log.Error("Could not encode response", Field{"error", err})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(message)
+	})
+}
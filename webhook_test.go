@@ -0,0 +1,256 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver answers deliveries with the next status in statuses,
+// then 204, and keeps the ones it accepted after checking the signature.
+type webhookReceiver struct {
+	t        *testing.T
+	secret   string
+	mu       sync.Mutex
+	statuses []int
+	payloads []WebhookPayload
+}
+
+func (r *webhookReceiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		r.t.Error(err)
+	}
+	if req.Header.Get("X-Garage-Signature") != WebhookSignature(r.secret, req.Header.Get("X-Garage-Timestamp"), body) {
+		r.t.Error("delivery has the wrong signature")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.statuses) > 0 {
+		w.WriteHeader(r.statuses[0])
+		r.statuses = r.statuses[1:]
+		return
+	}
+	var payload WebhookPayload
+	if err := json.Unmarshal(body, &payload); err != nil {
+		r.t.Error(err)
+	}
+	if req.Header.Get("X-Garage-Event") != payload.Event.Type || req.Header.Get("X-Garage-Delivery") != payload.Delivery {
+		r.t.Errorf("headers don't match the payload: %v", req.Header)
+	}
+	r.payloads = append(r.payloads, payload)
+	w.WriteHeader(204)
+}
+
+func (r *webhookReceiver) received() []WebhookPayload {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]WebhookPayload{}, r.payloads...)
+}
+
+func fastWebhookRetries(t *testing.T) {
+	min, max, attempts := webhookBackoffMin, webhookBackoffMax, webhookMaxAttempts
+	webhookBackoffMin, webhookBackoffMax = 5*time.Millisecond, 20*time.Millisecond
+	t.Cleanup(func() { webhookBackoffMin, webhookBackoffMax, webhookMaxAttempts = min, max, attempts })
+}
+
+func waitForWebhooks(t *testing.T, d *WebhookDispatcher, attempts int) []WebhookAttempt {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		log, queued := d.Deliveries("", webhookLogSize)
+		if len(log) >= attempts && queued == 0 {
+			return log
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d attempts, got %d with %d queued", attempts, len(log), queued)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestLoadWebhookSubscriptions(t *testing.T) {
+	tests := []struct {
+		config string
+		err    string
+	}{
+		{`[{"id": "porch-lights", "url": "https://lights.local/hook", "events": ["state_changed"], "secret": "s"}]`, ""},
+		{`[{"id": "all", "url": "http://10.0.0.2:8080/", "secret": "s"}]`, ""},
+		{`[{"id": "porch lights", "url": "https://lights.local/hook", "secret": "s"}]`, "invalid subscription id 'porch lights'"},
+		{`[{"id": "a", "url": "https://a.local/", "secret": "s"}, {"id": "a", "url": "https://b.local/", "secret": "s"}]`, "duplicate subscription 'a'"},
+		{`[{"id": "a", "url": "ftp://a.local/", "secret": "s"}]`, "subscription 'a': invalid url 'ftp://a.local/'"},
+		{`[{"id": "a", "url": "https://a.local/"}]`, "subscription 'a': no secret"},
+		{`[{"id": "a", "url": "https://a.local/", "events": ["opened"], "secret": "s"}]`, "subscription 'a': unknown event 'opened'"},
+	}
+	for _, test := range tests {
+		path := filepath.Join(t.TempDir(), "webhooks.json")
+		if err := ioutil.WriteFile(path, []byte(test.config), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadWebhookSubscriptions(path)
+		message := ""
+		if err != nil {
+			message = err.Error()
+		}
+		stringEqual(t, message, test.err)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	expected := []time.Duration{10 * time.Second, 20 * time.Second, 40 * time.Second, 80 * time.Second}
+	for i, backoff := range expected {
+		if got := webhookBackoff(i + 1); got != backoff {
+			t.Errorf("attempt %d: expected %s, got %s", i+1, backoff, got)
+		}
+	}
+	if got := webhookBackoff(20); got != time.Hour {
+		t.Errorf("expected the backoff to stop at an hour, got %s", got)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	receiver := &webhookReceiver{t: t, secret: "porch secret"}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	config := CreateTestRouteConfig(t, false, "closed", false)
+	subscriptions := []WebhookSubscription{{ID: "porch-lights", URL: server.URL, Events: []string{EventStateChanged}, Secret: "porch secret"}}
+	d, err := NewWebhookDispatcher(subscriptions, webhookQueuePath(config.Store.path), DummyLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.Store.OnAppend(d.Enqueue)
+	config.Webhooks = d
+	go d.Run()
+	defer d.Close()
+
+	config.Store.Append(HistoryEvent{Type: EventCommandIssued, User: "dillon", Door: "garage", Outcome: OutcomeSuccess, Detail: "open"})
+	opened, _ := config.Store.Append(HistoryEvent{Type: EventStateChanged, Door: "garage", Outcome: OutcomeSuccess, Detail: "open"})
+	log := waitForWebhooks(t, d, 1)
+
+	payloads := receiver.received()
+	numberEqual(t, len(payloads), 1)
+	stringEqual(t, payloads[0].Subscription, "porch-lights")
+	numberEqual(t, int(payloads[0].Event.ID), int(opened.ID))
+	stringEqual(t, payloads[0].Event.Detail, "open")
+	stringEqual(t, log[0].Delivery, payloads[0].Delivery)
+	stringEqual(t, log[0].Outcome, OutcomeSuccess)
+	numberEqual(t, log[0].StatusCode, 204)
+
+	spec := loadOpenAPISpec(t)
+	operation := spec.child("paths").child("/api/v2/webhooks/deliveries").child("get")
+	writer := httptest.NewRecorder()
+	NewRouter(config).ServeHTTP(writer, signedRequest(t, "GET", "/api/v2/webhooks/deliveries?subscription=porch-lights", SharedSecret))
+	checkDocumentedResponse(t, spec, operation, "deliveries", writer)
+	responseEqual(t, writer.Code, 200)
+	if !strings.Contains(writer.Body.String(), `"outcome":"success"`) {
+		t.Errorf("expected the delivery in the log, got %s", writer.Body.String())
+	}
+
+	writer = httptest.NewRecorder()
+	NewRouter(config).ServeHTTP(writer, signedRequest(t, "GET", "/api/v2/webhooks/deliveries?limit=none", SharedSecret))
+	checkDocumentedResponse(t, spec, operation, "deliveries", writer)
+	responseEqual(t, writer.Code, 400)
+}
+
+func TestWebhookRetry(t *testing.T) {
+	fastWebhookRetries(t)
+	receiver := &webhookReceiver{t: t, secret: "s", statuses: []int{500, 503}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	store := CreateTestStore(t)
+	d, err := NewWebhookDispatcher([]WebhookSubscription{{ID: "all", URL: server.URL, Secret: "s"}}, webhookQueuePath(store.path), DummyLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.OnAppend(d.Enqueue)
+	go d.Run()
+	defer d.Close()
+
+	store.Append(HistoryEvent{Type: EventStateChanged, Door: "garage", Outcome: OutcomeSuccess, Detail: "open"})
+	log := waitForWebhooks(t, d, 3)
+
+	numberEqual(t, len(receiver.received()), 1)
+	stringEqual(t, log[2].Outcome+" "+log[1].Outcome+" "+log[0].Outcome, "failure failure success")
+	numberEqual(t, log[2].StatusCode, 500)
+	numberEqual(t, log[0].Attempt, 3)
+	if log[2].NextAttempt == nil || log[0].NextAttempt != nil {
+		t.Error("expected only failed attempts to be retried")
+	}
+	stringEqual(t, log[0].Delivery, log[2].Delivery)
+}
+
+func TestWebhookAbandoned(t *testing.T) {
+	fastWebhookRetries(t)
+	webhookMaxAttempts = 2
+	receiver := &webhookReceiver{t: t, secret: "s", statuses: []int{500, 500, 500}}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+
+	store := CreateTestStore(t)
+	d, err := NewWebhookDispatcher([]WebhookSubscription{{ID: "all", URL: server.URL, Secret: "s"}}, webhookQueuePath(store.path), DummyLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.OnAppend(d.Enqueue)
+	go d.Run()
+	defer d.Close()
+
+	store.Append(HistoryEvent{Type: EventAuthFailure, Outcome: OutcomeDenied, Detail: "Invalid signature"})
+	log := waitForWebhooks(t, d, 2)
+	stringEqual(t, log[1].Outcome+" "+log[0].Outcome, "failure abandoned")
+}
+
+func TestWebhookQueuePersists(t *testing.T) {
+	fastWebhookRetries(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	store := CreateTestStore(t)
+	path := webhookQueuePath(store.path)
+	subscriptions := []WebhookSubscription{{ID: "porch-lights", URL: down.URL, Secret: "s"}, {ID: "removed", URL: down.URL, Secret: "s"}}
+	d, err := NewWebhookDispatcher(subscriptions, path, DummyLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.OnAppend(d.Enqueue)
+	store.Append(HistoryEvent{Type: EventStateChanged, Door: "garage", Outcome: OutcomeSuccess, Detail: "open"})
+	// The queue isn't written under the store's lock, but by Run.
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("expected the queue to be saved by Run, got %v", err)
+	}
+	go d.Run()
+	time.Sleep(20 * time.Millisecond)
+	d.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatal(err)
+	}
+
+	// The server restarts with the receiver back up and one subscription
+	// removed.
+	receiver := &webhookReceiver{t: t, secret: "s"}
+	server := httptest.NewServer(receiver)
+	defer server.Close()
+	d, err = NewWebhookDispatcher([]WebhookSubscription{{ID: "porch-lights", URL: server.URL, Secret: "s"}}, path, DummyLogger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, queued := d.Deliveries("", webhookLogSize)
+	numberEqual(t, queued, 1)
+	go d.Run()
+	defer d.Close()
+
+	waitForWebhooks(t, d, 1)
+	payloads := receiver.received()
+	numberEqual(t, len(payloads), 1)
+	stringEqual(t, payloads[0].Event.Detail, "open")
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// A minimal RFC 6455 server implementation, just enough for the control
+// channel: text/binary messages, fragmentation, ping/pong and close.
+
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+const (
+	opContinuation = 0x0
+	opText         = 0x1
+	opBinary       = 0x2
+	opClose        = 0x8
+	opPing         = 0x9
+	opPong         = 0xA
+)
+
+const maxMessageSize = 64 * 1024
+
+var (
+	errMessageTooLarge = errors.New("websocket: message too large")
+	errReservedBits    = errors.New("websocket: reserved bits set")
+)
+
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+
+	writeMu sync.Mutex
+
+	closeOnce sync.Once
+	closeErr  error
+}
+
+func headerContains(header http.Header, name string, value string) bool {
+	for _, v := range header[http.CanonicalHeaderKey(name)] {
+		for _, token := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), value) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func websocketAccept(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key + websocketGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func upgradeWebSocket(w http.ResponseWriter, req *http.Request) (*wsConn, error) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != "GET" ||
+		!headerContains(req.Header, "Connection", "upgrade") ||
+		!headerContains(req.Header, "Upgrade", "websocket") ||
+		req.Header.Get("Sec-WebSocket-Version") != "13" ||
+		key == "" {
+		writeAPIError(w, req, &APIError{Status: http.StatusBadRequest, Code: "invalid_handshake", Message: "Not a WebSocket handshake"})
+		return nil, errors.New("websocket: not a websocket handshake")
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		writeAPIError(w, req, &APIError{Status: 500, Code: "streaming_unsupported", Message: "The connection can't be taken over for a WebSocket"})
+		return nil, errors.New("websocket: response does not support hijacking")
+	}
+
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		return nil, err
+	}
+
+	response := "HTTP/1.1 101 Switching Protocols\r\n" +
+		"Upgrade: websocket\r\n" +
+		"Connection: Upgrade\r\n" +
+		"Sec-WebSocket-Accept: " + websocketAccept(key) + "\r\n\r\n"
+	if _, err := conn.Write([]byte(response)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return &wsConn{conn: conn, reader: rw.Reader}, nil
+}
+
+func (c *wsConn) readFrame() (fin bool, opcode byte, payload []byte, err error) {
+	var header [2]byte
+	if _, err = io.ReadFull(c.reader, header[:]); err != nil {
+		return
+	}
+	fin = header[0]&0x80 != 0
+	// No extensions are negotiated, so RSV1-3 must be clear.
+	if header[0]&0x70 != 0 {
+		err = errReservedBits
+		return
+	}
+	opcode = header[0] & 0x0F
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+
+	switch length {
+	case 126:
+		var ext [2]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = uint64(binary.BigEndian.Uint16(ext[:]))
+	case 127:
+		var ext [8]byte
+		if _, err = io.ReadFull(c.reader, ext[:]); err != nil {
+			return
+		}
+		length = binary.BigEndian.Uint64(ext[:])
+	}
+
+	if length > maxMessageSize {
+		err = errMessageTooLarge
+		return
+	}
+	if !masked {
+		err = errors.New("websocket: client frames must be masked")
+		return
+	}
+
+	var mask [4]byte
+	if _, err = io.ReadFull(c.reader, mask[:]); err != nil {
+		return
+	}
+	payload = make([]byte, length)
+	if _, err = io.ReadFull(c.reader, payload); err != nil {
+		return
+	}
+	for i := range payload {
+		payload[i] ^= mask[i%4]
+	}
+	return
+}
+
+// ReadMessage returns the next text or binary message, answering pings and
+// close frames along the way. io.EOF is returned once the peer closes.
+func (c *wsConn) ReadMessage() (byte, []byte, error) {
+	var opcode byte
+	var message []byte
+	for {
+		fin, op, payload, err := c.readFrame()
+		if err != nil {
+			switch err {
+			case errMessageTooLarge:
+				c.Close(1009)
+			case errReservedBits:
+				c.Close(1002)
+			}
+			return 0, nil, err
+		}
+
+		switch op {
+		case opPing:
+			if err := c.WriteMessage(opPong, payload); err != nil {
+				return 0, nil, err
+			}
+			continue
+		case opPong:
+			continue
+		case opClose:
+			c.Close(1000)
+			return 0, nil, io.EOF
+		case opText, opBinary:
+			opcode = op
+			message = payload
+		case opContinuation:
+			message = append(message, payload...)
+			if len(message) > maxMessageSize {
+				c.Close(1009)
+				return 0, nil, errMessageTooLarge
+			}
+		default:
+			c.Close(1002)
+			return 0, nil, errors.New("websocket: unknown opcode")
+		}
+
+		if fin {
+			return opcode, message, nil
+		}
+	}
+}
+
+func (c *wsConn) WriteMessage(opcode byte, payload []byte) error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	frame := []byte{0x80 | opcode}
+	length := len(payload)
+	switch {
+	case length < 126:
+		frame = append(frame, byte(length))
+	case length <= 0xFFFF:
+		frame = append(frame, 126, byte(length>>8), byte(length))
+	default:
+		var ext [8]byte
+		binary.BigEndian.PutUint64(ext[:], uint64(length))
+		frame = append(frame, 127)
+		frame = append(frame, ext[:]...)
+	}
+	frame = append(frame, payload...)
+
+	_, err := c.conn.Write(frame)
+	return err
+}
+
+// Close sends a close frame with the given status code and closes the
+// underlying connection. Only the first call does anything, so a deferred
+// Close doesn't follow one that already gave a reason.
+func (c *wsConn) Close(code int) error {
+	c.closeOnce.Do(func() {
+		c.WriteMessage(opClose, []byte{byte(code >> 8), byte(code)})
+		c.closeErr = c.conn.Close()
+	})
+	return c.closeErr
+}